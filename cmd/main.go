@@ -14,6 +14,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -23,6 +25,7 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb-binlog/pkg/util"
 	"github.com/pingcap/tidb-binlog/pkg/version"
@@ -30,17 +33,39 @@ import (
 	"go.uber.org/zap"
 )
 
+// the exit codes, so the scripts can know why pitr exits
+const (
+	exitSuccess = 0
+	// exitFailed means the command failed
+	exitFailed = 1
+	// exitInvalidArgs means the command, flags or config file is invalid
+	exitInvalidArgs = 2
+	// exitVerifyFailed means verify finds the merged binlogs are different from the original binlogs
+	exitVerifyFailed = 3
+	// exitSignaled is added by the signal number when pitr is stopped by a signal, like the shells do
+	exitSignaled = 128
+)
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	cfg := pitr.NewConfig()
 	if err := cfg.Parse(os.Args[1:]); err != nil {
-		log.Fatal("verifying flags failed. See 'pitr --help'.", zap.Error(err))
+		if errors.Cause(err) == flag.ErrHelp {
+			os.Exit(exitSuccess)
+		}
+		log.Error("verifying flags failed. See 'pitr --help'.", zap.Error(err))
+		os.Exit(exitInvalidArgs)
+	}
+	if cfg.PrintVersion {
+		fmt.Println(version.GetRawVersionInfo())
+		os.Exit(exitSuccess)
 	}
 
 	if err := util.InitLogger(cfg.LogLevel, cfg.LogFile); err != nil {
-		log.Fatal("Failed to initialize log", zap.Error(err))
+		log.Error("Failed to initialize log", zap.Error(err))
+		os.Exit(exitInvalidArgs)
 	}
 	version.PrintVersionInfo("PITR")
 
@@ -51,22 +76,30 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	r, err := pitr.New(cfg)
+	r, err := pitr.NewProcessor(cfg)
 	if err != nil {
-		log.Fatal("create pitr failed", zap.Error(err))
+		log.Error("create pitr failed", zap.String("command", cfg.Command), zap.Error(err))
+		os.Exit(exitFailed)
 	}
 
 	go func() {
 		sig := <-sc
 		log.Info("got signal to exit.", zap.Stringer("signale", sig))
 		r.Close()
-		os.Exit(0)
+		os.Exit(exitSignaled + int(sig.(syscall.Signal)))
 	}()
 
+	code := exitSuccess
 	if err := r.Process(); err != nil {
-		log.Error("pitr processing failed", zap.Error(err))
+		log.Error("pitr processing failed", zap.String("command", cfg.Command), zap.Error(err))
+		code = exitFailed
+		if errors.Cause(err) == pitr.ErrVerifyFailed {
+			code = exitVerifyFailed
+		}
 	}
 	if err := r.Close(); err != nil {
-		log.Fatal("close pitr failed", zap.Error(err))
+		log.Error("close pitr failed", zap.Error(err))
+		code = exitFailed
 	}
+	os.Exit(code)
 }
@@ -0,0 +1,397 @@
+package pitr
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"github.com/pingcap/tidb-binlog/pkg/loader"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// maxConflictKeys limits the keys saved to detect the conflicts, all the workers are flushed if exceed
+const maxConflictKeys = 100000
+
+// Applier replays the binlogs in data dir to MySQL or TiDB.
+// the dmls are sharded by key and executed by the workers in batched transactions,
+// the dmls which change the keys in different workers are executed after the workers are flushed,
+// and the ddls are executed in order after all the dmls before them.
+type Applier struct {
+	cfg *Config
+
+	db *sql.DB
+
+	filter *filter.Filter
+
+	// tableInfos caches the table info got from the destination database, the key is the quoted table name
+	tableInfos map[string]*tableInfo
+
+	// out is where the sqls are printed in dry run
+	out io.Writer
+
+	workers []chan []*dmlSQL
+	// batches is the sqls not sent to every worker
+	batches [][]*dmlSQL
+	// pending is the number of batches sent but not executed
+	pending sync.WaitGroup
+	// conflictKeys records which worker the keys are sent to, it's reset after the workers are flushed
+	conflictKeys map[string]int
+
+	errMu sync.Mutex
+	err   error
+}
+
+// NewApplier creates a Applier object connected to the destination database.
+func NewApplier(cfg *Config) (*Applier, error) {
+	log.Info("New Applier", zap.Stringer("config", cfg))
+
+	db, err := loader.CreateDB(cfg.DestDB.User, cfg.DestDB.Password, cfg.DestDB.Host, cfg.DestDB.Port)
+	if err != nil {
+		return nil, errors.Annotate(err, "connect destination database failed")
+	}
+
+	return newApplier(cfg, db), nil
+}
+
+func newApplier(cfg *Config, db *sql.DB) *Applier {
+	return &Applier{
+		cfg:          cfg,
+		db:           db,
+		filter:       filter.NewFilter(cfg.IgnoreDBs, cfg.IgnoreTables, cfg.DoDBs, cfg.DoTables),
+		tableInfos:   make(map[string]*tableInfo),
+		out:          os.Stdout,
+		conflictKeys: make(map[string]int),
+	}
+}
+
+// Process replays the binlogs with commit ts in [start ts, stop ts], it returns after all the sqls are executed
+func (a *Applier) Process() error {
+	if err := checkManifest(a.cfg.Dir); err != nil {
+		return errors.Trace(err)
+	}
+
+	dirs, err := searchBinlogDirs(a.cfg.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !a.cfg.DryRun {
+		a.startWorkers()
+		defer a.stopWorkers()
+	}
+
+	// the tables' directories are replayed as one stream, the ddls may change the tables in other directories
+	if err := readBinlogStream(dirs, a.cfg.StartTSO, a.cfg.StopTSO, a.apply); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(a.flush())
+}
+
+// Close closes the Applier object.
+func (a *Applier) Close() error {
+	return errors.Trace(a.db.Close())
+}
+
+func (a *Applier) startWorkers() {
+	a.workers = make([]chan []*dmlSQL, a.cfg.Workers)
+	a.batches = make([][]*dmlSQL, a.cfg.Workers)
+	for i := range a.workers {
+		a.workers[i] = make(chan []*dmlSQL, 1)
+		go a.runWorker(a.workers[i])
+	}
+}
+
+func (a *Applier) stopWorkers() {
+	for _, ch := range a.workers {
+		close(ch)
+	}
+	a.workers = nil
+}
+
+// runWorker executes every batch in one transaction, the batches are skipped after any error
+func (a *Applier) runWorker(ch chan []*dmlSQL) {
+	for batch := range ch {
+		if a.getErr() == nil {
+			if err := a.executeBatch(batch); err != nil {
+				a.setErr(err)
+			}
+		}
+		a.pending.Done()
+	}
+}
+
+func (a *Applier) executeBatch(batch []*dmlSQL) error {
+	txn, err := a.db.Begin()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, s := range batch {
+		if _, err := txn.Exec(s.sql, s.args...); err != nil {
+			txn.Rollback()
+			return errors.Annotatef(err, "execute %s with args %v failed", s.sql, s.args)
+		}
+	}
+	return errors.Trace(txn.Commit())
+}
+
+func (a *Applier) getErr() error {
+	a.errMu.Lock()
+	defer a.errMu.Unlock()
+	return a.err
+}
+
+// setErr saves the first error of the workers
+func (a *Applier) setErr(err error) {
+	a.errMu.Lock()
+	defer a.errMu.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+// apply executes the ddl after the dmls before it, or dispatches the dml events to the workers
+func (a *Applier) apply(binlog *pb.Binlog) error {
+	if err := a.getErr(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if binlog.Tp == pb.BinlogType_DDL {
+		if err := a.flush(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := a.executeDDL(string(binlog.DdlQuery)); err != nil {
+			return errors.Annotatef(err, "apply binlog with commit ts %d failed", binlog.CommitTs)
+		}
+		return nil
+	}
+
+	for i := range binlog.DmlData.GetEvents() {
+		ev := &binlog.DmlData.Events[i]
+		if a.filter.SkipSchemaAndTable(ev.GetSchemaName(), ev.GetTableName()) {
+			continue
+		}
+		if err := a.applyEvent(ev); err != nil {
+			return errors.Annotatef(err, "apply binlog with commit ts %d failed", binlog.CommitTs)
+		}
+	}
+	return nil
+}
+
+func (a *Applier) applyEvent(ev *pb.Event) error {
+	info, err := a.getTableInfo(ev.GetSchemaName(), ev.GetTableName())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rv, err := decodeRow(ev.GetRow(), info, ev.GetTp() == pb.EventType_Update)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var sqls []*dmlSQL
+	if a.cfg.SafeMode {
+		sqls, err = genSafeRowSQLs(ev.GetTp(), info, rv)
+	} else {
+		var s dmlSQL
+		s.sql, s.args, err = genRowSQL(ev.GetTp(), info, rv)
+		sqls = []*dmlSQL{&s}
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if a.cfg.DryRun {
+		for _, s := range sqls {
+			if _, err := fmt.Fprintln(a.out, formatSQL(s)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+
+	worker, err := a.dispatch(genConflictKeys(info, rv))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	a.batches[worker] = append(a.batches[worker], sqls...)
+	if len(a.batches[worker]) >= a.cfg.BatchSize {
+		a.send(worker)
+	}
+	return nil
+}
+
+// dispatch returns the worker to execute the event with the keys,
+// the workers are flushed if the keys are sent to different workers before
+func (a *Applier) dispatch(keys []string) (int, error) {
+	worker := -1
+	for _, key := range keys {
+		w, ok := a.conflictKeys[key]
+		if !ok {
+			continue
+		}
+		if worker != -1 && w != worker {
+			log.Debug("keys conflict, flush the workers", zap.Strings("keys", keys))
+			if err := a.flush(); err != nil {
+				return 0, errors.Trace(err)
+			}
+			worker = -1
+			break
+		}
+		worker = w
+	}
+
+	if len(a.conflictKeys) >= maxConflictKeys {
+		if err := a.flush(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		worker = -1
+	}
+	if worker == -1 {
+		worker = int(crc32.ChecksumIEEE([]byte(keys[0])) % uint32(len(a.workers)))
+	}
+	for _, key := range keys {
+		a.conflictKeys[key] = worker
+	}
+	return worker, nil
+}
+
+// send sends the batch to the worker
+func (a *Applier) send(worker int) {
+	if len(a.batches[worker]) == 0 {
+		return
+	}
+	a.pending.Add(1)
+	a.workers[worker] <- a.batches[worker]
+	a.batches[worker] = nil
+}
+
+// flush sends all the batches and waits for them to be executed
+func (a *Applier) flush() error {
+	for i := range a.batches {
+		a.send(i)
+	}
+	a.pending.Wait()
+	a.conflictKeys = make(map[string]int)
+	return errors.Trace(a.getErr())
+}
+
+// executeDDL executes the ddl on the destination database, and removes the cached info of the tables changed by it,
+// the ddl is skipped only if all the tables are skipped by filter
+func (a *Applier) executeDDL(ddl string) error {
+	tables, err := ddlTables(ddl)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	skip := true
+	for _, table := range tables {
+		if !a.filter.SkipSchemaAndTable(table.Schema, table.Table) {
+			skip = false
+			break
+		}
+	}
+	if skip {
+		return nil
+	}
+
+	if a.cfg.DryRun {
+		_, err := fmt.Fprintf(a.out, "%s;\n", strings.TrimRight(ddl, "; \n"))
+		return errors.Trace(err)
+	}
+
+	log.Info("execute ddl", zap.String("ddl", ddl))
+	if _, err := a.db.Exec(ddl); err != nil {
+		return errors.Annotatef(err, "execute ddl %s failed", ddl)
+	}
+	for _, table := range tables {
+		delete(a.tableInfos, quoteSchema(table.Schema, table.Table))
+		// the tables are dropped with the database
+		if table.Table == "" {
+			for key, info := range a.tableInfos {
+				if info.schema == table.Schema {
+					delete(a.tableInfos, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Applier) getTableInfo(schema, table string) (*tableInfo, error) {
+	if info, ok := a.tableInfos[quoteSchema(schema, table)]; ok {
+		return info, nil
+	}
+
+	info, err := getTableInfo(a.db, schema, table)
+	if err != nil {
+		return nil, errors.Annotatef(err, "get table info of %s failed", quoteSchema(schema, table))
+	}
+	a.tableInfos[quoteSchema(schema, table)] = info
+	return info, nil
+}
+
+// genConflictKeys returns the values of the unique keys in the row and the changed row,
+// the events with a same key must be executed in order. all the columns are used if the table has no unique key.
+func genConflictKeys(info *tableInfo, rv *rowValues) []string {
+	rows := [][]interface{}{rv.values}
+	if rv.changed != nil {
+		rows = append(rows, rv.changed)
+	}
+
+	var keys []string
+	for _, values := range rows {
+		valueOf := make(map[string]interface{}, len(rv.names))
+		for i, name := range rv.names {
+			valueOf[name] = values[i]
+		}
+
+		indexes := info.uniqueKeys
+		if len(indexes) == 0 {
+			indexes = []indexInfo{{columns: rv.names}}
+		}
+		for _, index := range indexes {
+			key := fmt.Sprintf("%s|%s|", quoteSchema(info.schema, info.table), index.name)
+			hasNull := false
+			for _, col := range index.columns {
+				// the unique key with null values doesn't conflict with others
+				if valueOf[col] == nil && len(info.uniqueKeys) != 0 {
+					hasNull = true
+					break
+				}
+				key += fmt.Sprintf("%v|", valueOf[col])
+			}
+			if !hasNull {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, quoteSchema(info.schema, info.table))
+	}
+	return keys
+}
+
+// formatSQL returns the sql with the args as a comment, used in dry run
+func formatSQL(s *dmlSQL) string {
+	args := make([]string, 0, len(s.args))
+	for _, arg := range s.args {
+		switch v := arg.(type) {
+		case nil:
+			args = append(args, "NULL")
+		case string:
+			args = append(args, strconv.Quote(v))
+		case []byte:
+			args = append(args, strconv.Quote(string(v)))
+		default:
+			args = append(args, fmt.Sprintf("%v", v))
+		}
+	}
+	return fmt.Sprintf("%s; -- args: [%s]", s.sql, strings.Join(args, ", "))
+}
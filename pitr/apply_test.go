@@ -0,0 +1,153 @@
+package pitr
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"gotest.tools/assert"
+)
+
+func TestApply(t *testing.T) {
+	dir := "./applytest"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
+	assert.Assert(t, err == nil)
+	ddl.ResetDB()
+
+	schema, table := "test", "tba"
+	rowDML := func(tp pb.EventType, row [][]byte, ts int64) *pb.Binlog {
+		return &pb.Binlog{Tp: pb.BinlogType_DML, CommitTs: ts, DmlData: &pb.DMLData{Events: []pb.Event{{
+			Tp: tp, SchemaName: &schema, TableName: &table, Row: row,
+		}}}}
+	}
+	b, err := OpenMyBinlogger(dir)
+	assert.Assert(t, err == nil)
+	for _, bin := range []*pb.Binlog{
+		genTestDDL(schema, table, "use test;create table tba (a int primary key, b int, c int unique)", 100),
+		genTestRowDML(schema, table, pb.EventType_Insert, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 200),
+		rowDML(pb.EventType_Update, generateRow(1, 1, 1, 50), 210),
+		genTestRowDML(schema, table, pb.EventType_Delete, []int64{2, 3}, 220),
+		// the unique key 4 is released by the update and then used by the insert, they must be executed in order
+		rowDML(pb.EventType_Update, generateRow(4, 4, 4, 100), 230),
+		rowDML(pb.EventType_Insert, generateRow(12, 12, 4, 0), 240),
+		genTestDDL(schema, table, "use test;alter table tba add column d int", 300),
+		genTestRowDML(schema, table, pb.EventType_Insert, []int64{20, 21}, 310),
+	} {
+		data, _ := bin.Marshal()
+		_, err = b.WriteTail(&tb.Entity{Payload: data})
+		assert.Assert(t, err == nil)
+	}
+	b.Close()
+
+	checkRows := func() {
+		rows, err := ddl.db.Query("SELECT a, b, c FROM test.tba ORDER BY a")
+		assert.Assert(t, err == nil)
+		defer rows.Close()
+		var values []string
+		for rows.Next() {
+			var a, b, c int
+			assert.Assert(t, rows.Scan(&a, &b, &c) == nil)
+			values = append(values, fmt.Sprintf("%d,%d,%d", a, b, c))
+		}
+		assert.Equal(t, strings.Join(values, " "), "1,1,50 4,4,100 5,5,5 6,6,6 7,7,7 8,8,8 9,9,9 10,10,10 12,12,4 20,20,20 21,21,21")
+	}
+
+	cfg := NewConfig()
+	cfg.Dir = dir
+	cfg.Workers = 4
+	cfg.BatchSize = 2
+	applier := newApplier(cfg, ddl.db)
+	err = applier.Process()
+	assert.Assert(t, err == nil, err)
+	checkRows()
+
+	// the dmls can be applied again in safe mode
+	cfg.StartTSO, cfg.StopTSO = 200, 250
+	cfg.SafeMode = true
+	applier = newApplier(cfg, ddl.db)
+	err = applier.Process()
+	assert.Assert(t, err == nil, err)
+	checkRows()
+
+	// the dmls fail without safe mode
+	cfg.SafeMode = false
+	applier = newApplier(cfg, ddl.db)
+	err = applier.Process()
+	assert.ErrorContains(t, err, "Duplicate entry")
+
+	cfg.StartTSO, cfg.StopTSO = 210, 210
+	cfg.SafeMode = true
+	cfg.DryRun = true
+	applier = newApplier(cfg, ddl.db)
+	var out bytes.Buffer
+	applier.out = &out
+	err = applier.Process()
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, out.String(), "DELETE FROM `test`.`tba` WHERE `a` = ? LIMIT 1; -- args: [1]\n"+
+		"REPLACE INTO `test`.`tba`(`a`, `b`, `c`) VALUES(?, ?, ?); -- args: [1, 1, 50]\n")
+	checkRows()
+
+	err = ddl.ResetDB()
+	assert.Assert(t, err == nil)
+}
+
+func TestApplyStream(t *testing.T) {
+	dir := "./applystreamtest"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
+	assert.Assert(t, err == nil)
+	ddl.ResetDB()
+
+	// the table is renamed to the table whose directory sorts before it, and the dmls after it use the new name
+	write := func(subDir string, binlogs ...*pb.Binlog) {
+		b, err := OpenMyBinlogger(dir + "/" + subDir)
+		assert.Assert(t, err == nil)
+		for _, bin := range binlogs {
+			data, _ := bin.Marshal()
+			_, err = b.WriteTail(&tb.Entity{Payload: data})
+			assert.Assert(t, err == nil)
+		}
+		b.Close()
+	}
+	write("test_z",
+		genTestDDL("test", "z", "use test;create table z (a int primary key, b int, c int)", 100),
+		genTestRowDML("test", "z", pb.EventType_Insert, []int64{1, 2}, 110),
+	)
+	write("test_a",
+		genTestDDL("test", "a", "use test;rename table z to a", 120),
+		genTestRowDML("test", "a", pb.EventType_Insert, []int64{3}, 130),
+	)
+
+	cfg := NewConfig()
+	cfg.Dir = dir
+	cfg.Workers = 2
+	cfg.BatchSize = 2
+	applier := newApplier(cfg, ddl.db)
+	err = applier.Process()
+	assert.Assert(t, err == nil, err)
+	var count int
+	assert.Assert(t, ddl.db.QueryRow("SELECT COUNT(*) FROM test.a").Scan(&count) == nil)
+	assert.Equal(t, count, 3)
+
+	// the ddl is executed if any table changed by it is not skipped
+	cfg.DoTables = []TableName{{Schema: "test", Table: "a"}}
+	cfg.DryRun = true
+	applier = newApplier(cfg, ddl.db)
+	var out bytes.Buffer
+	applier.out = &out
+	assert.Assert(t, applier.executeDDL("use test;drop table x, a") == nil)
+	assert.Assert(t, applier.executeDDL("use test;rename table x to y") == nil)
+	assert.Equal(t, out.String(), "use test;drop table x, a;\n")
+
+	err = ddl.ResetDB()
+	assert.Assert(t, err == nil)
+}
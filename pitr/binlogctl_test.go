@@ -31,28 +31,97 @@ func genTestDML(schema, table string, ts int64) *pb.Binlog {
 	}
 }
 
+// generateDMLEvents generates a insert and a delete of the row with a = ts,
+// and an update of the row with a = 0, so the events of different ts can be merged
 func generateDMLEvents(schema, table string, ts int64) []pb.Event {
-	cols := generateColumns()
 	return []pb.Event{
 		{
 			Tp:         pb.EventType_Insert,
 			SchemaName: &schema,
 			TableName:  &table,
-			Row:        [][]byte{cols[0], cols[1]},
+			Row:        generateRow(ts, 2, 3, 0),
 		}, {
 			Tp:         pb.EventType_Delete,
 			SchemaName: &schema,
 			TableName:  &table,
-			Row:        [][]byte{cols[1], cols[1]},
+			Row:        generateRow(ts, 2, 3, 0),
 		}, {
 			Tp:         pb.EventType_Update,
 			SchemaName: &schema,
 			TableName:  &table,
-			Row:        [][]byte{cols[2]},
+			Row:        generateRow(0, 2, ts-1, ts),
 		},
 	}
 }
 
+// generateRow generates the columns a, b and c, c's changed value is set if it's not 0
+func generateRow(a, b, c, changedC int64) [][]byte {
+	cols := []*pb.Column{
+		{
+			Name:      "a",
+			Tp:        []byte{mysql.TypeInt24},
+			MysqlType: "int",
+			Value:     encodeIntValue(a),
+		}, {
+			Name:      "b",
+			Tp:        []byte{mysql.TypeInt24},
+			MysqlType: "int",
+			Value:     encodeIntValue(b),
+		}, {
+			Name:      "c",
+			Tp:        []byte{mysql.TypeInt24},
+			MysqlType: "int",
+			Value:     encodeIntValue(c),
+		},
+	}
+	if changedC != 0 {
+		cols[0].ChangedValue = cols[0].Value
+		cols[1].ChangedValue = cols[1].Value
+		cols[2].ChangedValue = encodeIntValue(changedC)
+	}
+
+	row := make([][]byte, 0, len(cols))
+	for _, col := range cols {
+		data, _ := col.Marshal()
+		row = append(row, data)
+	}
+	return row
+}
+
+// genTestUpdateDML generates an update of the row generateRow generates, which changes c to changedC
+func genTestUpdateDML(schema, table string, a, c, changedC, ts int64) *pb.Binlog {
+	return &pb.Binlog{
+		Tp: pb.BinlogType_DML,
+		DmlData: &pb.DMLData{Events: []pb.Event{{
+			Tp:         pb.EventType_Update,
+			SchemaName: &schema,
+			TableName:  &table,
+			Row:        generateRow(a, a, c, changedC),
+		}}},
+		CommitTs: ts,
+	}
+}
+
+// writeTestBinlogs appends the binlogs to the binlog files in dir
+func writeTestBinlogs(dir string, binlogs ...*pb.Binlog) error {
+	b, err := OpenMyBinlogger(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer b.Close()
+
+	for _, bin := range binlogs {
+		data, err := bin.Marshal()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := b.WriteTail(&tb.Entity{Payload: data}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
 // generate columns for test
 func generateColumns() [][]byte {
 	allColBytes := make([][]byte, 0, 3)
@@ -0,0 +1,154 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"go.uber.org/zap"
+)
+
+const (
+	// schemaCreateFileSuffix is the suffix of the database files in the dump of mydumper or dumpling, like db-schema-create.sql
+	schemaCreateFileSuffix = "-schema-create.sql"
+	// schemaFileSuffix is the suffix of the table files in the dump of mydumper or dumpling, like db.table-schema.sql
+	schemaFileSuffix = "-schema.sql"
+)
+
+// loadSchemaDDLs returns the ddls to create the schema before the binlogs without PD,
+// they're read from the dump in schemaDir, or the ddl jobs in schemaFile finished before beginTS
+func loadSchemaDDLs(schemaDir, schemaFile string, beginTS int64) ([]string, error) {
+	var (
+		ddls []string
+		err  error
+	)
+	switch {
+	case schemaDir != "":
+		ddls, err = readSchemaDir(schemaDir)
+	case schemaFile != "":
+		ddls, err = readSchemaFile(schemaFile, beginTS)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Info("load schema ddls success", zap.String("schema dir", schemaDir), zap.String("schema file", schemaFile), zap.Int("ddls", len(ddls)))
+	return ddls, nil
+}
+
+// readSchemaDir returns the ddls in the *-schema-create.sql and *-schema.sql files of a mydumper or dumpling dump,
+// the databases are created before the tables, and the other statements in the files like SET NAMES are ignored
+func readSchemaDir(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var dbDDLs, tableDDLs []string
+	created := make(map[string]bool)
+	createDB := func(schema string) {
+		if !created[schema] {
+			created[schema] = true
+			dbDDLs = append(dbDDLs, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteName(schema)))
+		}
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, schemaFileSuffix) && !strings.HasSuffix(name, schemaCreateFileSuffix) {
+			continue
+		}
+
+		stmts, err := parseSchemaFile(path.Join(dir, name))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, stmt := range stmts {
+			switch node := stmt.(type) {
+			case *ast.CreateDatabaseStmt:
+				createDB(node.Name)
+			case *ast.CreateTableStmt:
+				// the database is the prefix of the file name, unless the table name is qualified
+				schema := node.Table.Schema.O
+				if schema == "" {
+					schema = strings.SplitN(name, ".", 2)[0]
+				}
+				createDB(schema)
+				text := strings.TrimSuffix(strings.TrimSpace(stmt.Text()), ";")
+				tableDDLs = append(tableDDLs, fmt.Sprintf("USE %s;%s", quoteName(schema), text))
+			}
+		}
+	}
+	return append(dbDDLs, tableDDLs...), nil
+}
+
+func parseSchemaFile(file string) ([]ast.StmtNode, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	stmts, _, err := parser.New().Parse(string(data), "", "")
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse schema file %s failed", file)
+	}
+	return stmts, nil
+}
+
+// readSchemaFile returns the queries of the ddl jobs finished before beginTS in the file,
+// it's written by schema dump, or it's a json array of model.Job like the output of TiDB's /ddl/history http api
+func readSchemaFile(file string, beginTS int64) ([]string, error) {
+	jobs, err := loadHistoryDDLFile(file, beginTS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return historyDDLQueries(jobs), nil
+}
+
+// filterHistoryDDLJobs returns the jobs finished before beginTS, sorted by schema version, 0 means all the jobs
+func filterHistoryDDLJobs(allJobs []*model.Job, beginTS int64) []*model.Job {
+	sort.Slice(allJobs, func(i, j int) bool {
+		return allJobs[i].BinlogInfo.SchemaVersion < allJobs[j].BinlogInfo.SchemaVersion
+	})
+
+	jobs := make([]*model.Job, 0, 10)
+	for _, job := range allJobs {
+		if beginTS == 0 || int64(job.BinlogInfo.FinishedTS) < beginTS {
+			jobs = append(jobs, job)
+		} else {
+			log.Info("ignore history ddl job", zap.Reflect("job", job))
+		}
+	}
+	return jobs
+}
+
+// historyDDLQueries returns the queries of the done or synced jobs, with the database of the job used
+func historyDDLQueries(jobs []*model.Job) []string {
+	queries := make([]string, 0, len(jobs))
+	schemaNames := make(map[int64]string)
+	for _, job := range jobs {
+		if skipJob(job) {
+			continue
+		}
+
+		query := job.Query
+		switch job.Type {
+		case model.ActionCreateSchema:
+			schemaNames[job.SchemaID] = job.BinlogInfo.DBInfo.Name.O
+		case model.ActionDropSchema:
+			delete(schemaNames, job.SchemaID)
+		default:
+			if name, ok := schemaNames[job.SchemaID]; ok {
+				query = fmt.Sprintf("use %s;%s", quoteName(name), query)
+			}
+		}
+		queries = append(queries, query)
+	}
+	return queries
+}
@@ -0,0 +1,77 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pingcap/parser/model"
+	"gotest.tools/assert"
+)
+
+func TestReadSchemaDir(t *testing.T) {
+	dir := "./schematest"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	assert.Assert(t, os.MkdirAll(dir, 0755) == nil)
+
+	files := map[string]string{
+		"test-schema-create.sql": "/*!40101 SET NAMES binary*/;\nCREATE DATABASE `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;\n",
+		"test.t1-schema.sql":     "/*!40101 SET NAMES binary*/;\n/*!40014 SET FOREIGN_KEY_CHECKS=0*/;\nCREATE TABLE `t1` (\n  `a` int(11) NOT NULL,\n  `b` int(11) DEFAULT NULL,\n  PRIMARY KEY (`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;\n",
+		"test1.t2-schema.sql":    "CREATE TABLE `t2` (`a` int, `b` int, UNIQUE KEY `uk` (`b`));",
+		"test.t1.sql":            "INSERT INTO `t1` VALUES (1,1);",
+	}
+	for name, content := range files {
+		assert.Assert(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644) == nil)
+	}
+
+	ddls, err := readSchemaDir(dir)
+	assert.Assert(t, err == nil, err)
+	assert.DeepEqual(t, ddls, []string{
+		"CREATE DATABASE IF NOT EXISTS `test`",
+		"CREATE DATABASE IF NOT EXISTS `test1`",
+		"USE `test`;CREATE TABLE `t1` (\n  `a` int(11) NOT NULL,\n  `b` int(11) DEFAULT NULL,\n  PRIMARY KEY (`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		"USE `test1`;CREATE TABLE `t2` (`a` int, `b` int, UNIQUE KEY `uk` (`b`))",
+	})
+
+	os.RemoveAll(testTiDBDir)
+	ddlHandle, err := NewDDLHandle(nil, testTiDBDir, 0)
+	assert.Assert(t, err == nil)
+	for _, ddl := range ddls {
+		assert.Assert(t, ddlHandle.ExecuteDDL(ddl) == nil, ddl)
+	}
+	info, err := ddlHandle.GetTableInfo("test1", "t2")
+	assert.Assert(t, err == nil, err)
+	assert.DeepEqual(t, info.columns, []string{"a", "b"})
+	assert.Assert(t, ddlHandle.ResetDB() == nil)
+}
+
+func TestReadSchemaFile(t *testing.T) {
+	file := "./schematest.json"
+	defer os.Remove(file)
+
+	newJob := func(id int64, tp model.ActionType, query string, version int64, finishedTS uint64) *model.Job {
+		return &model.Job{
+			ID: id, Type: tp, SchemaID: 1, Query: query, State: model.JobStateSynced,
+			BinlogInfo: &model.HistoryInfo{SchemaVersion: version, FinishedTS: finishedTS, DBInfo: &model.DBInfo{ID: 1, Name: model.NewCIStr("test")}},
+		}
+	}
+	cancelled := newJob(4, model.ActionCreateTable, "create table t3 (a int)", 3, 150)
+	cancelled.State = model.JobStateCancelled
+	jobs := []*model.Job{
+		newJob(2, model.ActionCreateTable, "create table t1 (a int)", 2, 110),
+		newJob(1, model.ActionCreateSchema, "create database test", 1, 100),
+		cancelled,
+		// the job finished after the first binlog is in the binlogs
+		newJob(5, model.ActionAddColumn, "alter table t1 add column b int", 4, 200),
+	}
+	data, err := json.Marshal(jobs)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ioutil.WriteFile(file, data, 0644) == nil)
+
+	ddls, err := loadSchemaDDLs("", file, 200)
+	assert.Assert(t, err == nil, err)
+	assert.DeepEqual(t, ddls, []string{"create database test", "use `test`;create table t1 (a int)"})
+}
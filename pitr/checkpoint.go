@@ -0,0 +1,256 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	"go.uber.org/zap"
+)
+
+// the file name ends with "checkpoint", so it will be ignored when read binlog files in the dir
+const checkpointFileName = "pitr.checkpoint"
+
+// checkpoint records the progress of Map and Reduce, so a failed run can be resumed
+type checkpoint struct {
+	path string
+
+	// mu protects ReducedDirs, which are updated by the reduce workers concurrently
+	mu sync.Mutex
+
+	StartTS int64 `json:"start-ts"`
+	StopTS  int64 `json:"stop-ts"`
+
+	// MappedFiles are the input files which are fully mapped, in the order of mapping
+	MappedFiles []string `json:"mapped-files"`
+
+	// SplitNum is the number of hash buckets every table is split into, it can't be changed when resume
+	SplitNum int `json:"split-num"`
+
+	// WindowTxns and WindowTS are the limits of the merge windows, the windows are split by them when map,
+	// so they can't be changed when resume
+	WindowTxns int   `json:"window-txns"`
+	WindowTS   int64 `json:"window-ts"`
+
+	// TempFiles are the binlog files and their sizes in every partition after the last input file is mapped,
+	// the data not in it is written by the unfinished map and should be removed when resume
+	TempFiles map[string]map[string]int64 `json:"temp-files"`
+
+	// Windows are the barriers of the merge windows in the mapped files, see Merge.windows
+	Windows []int64 `json:"windows"`
+
+	// FirstTS and LastTS are the commit ts of the first and the last binlogs in the mapped files
+	FirstTS int64 `json:"first-ts"`
+	LastTS  int64 `json:"last-ts"`
+
+	// BootstrapDDLs, Schema and SchemaVersions are saved when map finishes, see Merge.bootstrapDDLs and schemaStore,
+	// so the ddls needn't be executed again when resume
+	BootstrapDDLs  []string        `json:"bootstrap-ddls,omitempty"`
+	Schema         []string        `json:"schema,omitempty"`
+	SchemaVersions []*tableVersion `json:"schema-versions,omitempty"`
+
+	// MapFinished means all the input files are mapped
+	MapFinished bool `json:"map-finished"`
+
+	// ReducedDirs are the temp sub directories which are fully reduced
+	ReducedDirs []string `json:"reduced-dirs"`
+}
+
+// loadCheckpoint loads the checkpoint saved in dir, returns an empty checkpoint if not exist
+func loadCheckpoint(dir string, startTS, stopTS int64, windowTxns int, windowTS int64) (*checkpoint, error) {
+	cp := &checkpoint{
+		path:       path.Join(dir, checkpointFileName),
+		StartTS:    startTS,
+		StopTS:     stopTS,
+		WindowTxns: windowTxns,
+		WindowTS:   windowTS,
+		TempFiles:  make(map[string]map[string]int64),
+	}
+
+	data, err := ioutil.ReadFile(cp.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return nil, errors.Trace(err)
+	}
+
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, errors.Annotatef(err, "unmarshal checkpoint %s failed", cp.path)
+	}
+	if cp.StartTS != startTS || cp.StopTS != stopTS {
+		return nil, errors.Errorf("checkpoint's ts range [%d, %d] is different from [%d, %d]", cp.StartTS, cp.StopTS, startTS, stopTS)
+	}
+	if cp.WindowTxns != windowTxns || cp.WindowTS != windowTS {
+		return nil, errors.Errorf("checkpoint's window txns %d and window ts %d are different from %d and %d", cp.WindowTxns, cp.WindowTS, windowTxns, windowTS)
+	}
+	if cp.TempFiles == nil {
+		cp.TempFiles = make(map[string]map[string]int64)
+	}
+
+	log.Info("load checkpoint", zap.String("path", cp.path), zap.Reflect("checkpoint", cp))
+	return cp, nil
+}
+
+// save writes the checkpoint to a temp file and then renames it, so the checkpoint file is always complete
+func (c *checkpoint) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(os.Rename(tmpPath, c.path))
+}
+
+// checkFiles checks the mapped files are the prefix of the files need to be mapped
+func (c *checkpoint) checkFiles(files []string) error {
+	if len(c.MappedFiles) > len(files) {
+		return errors.Errorf("checkpoint has %d mapped files, but only %d files need to be mapped", len(c.MappedFiles), len(files))
+	}
+
+	for i, f := range c.MappedFiles {
+		if files[i] != f {
+			return errors.Errorf("mapped file %s in checkpoint doesn't match file %s", f, files[i])
+		}
+	}
+
+	return nil
+}
+
+func (c *checkpoint) isMapped(file string) bool {
+	return containsString(c.MappedFiles, file)
+}
+
+// addMappedFile records the file is mapped, and the binlog files in every partition of tempDir
+func (c *checkpoint) addMappedFile(file string, tempDir string) error {
+	partitions, err := readPartitions(tempDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tempFiles := make(map[string]map[string]int64, len(partitions))
+	for _, partition := range partitions {
+		dirPath := path.Join(tempDir, partition)
+		names, err := binlogfile.ReadBinlogNames(dirPath)
+		if err != nil && errors.Cause(err) != binlogfile.ErrFileNotFound {
+			return errors.Trace(err)
+		}
+
+		tempFiles[partition] = make(map[string]int64, len(names))
+		for _, name := range names {
+			fi, err := os.Stat(path.Join(dirPath, name))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			tempFiles[partition][name] = fi.Size()
+		}
+	}
+
+	c.MappedFiles = append(c.MappedFiles, file)
+	c.TempFiles = tempFiles
+	return errors.Trace(c.save())
+}
+
+// cleanTempFiles removes the data in tempDir which is written after the last checkpoint
+func (c *checkpoint) cleanTempFiles(tempDir string) error {
+	tableDirs, err := readSubDirs(tempDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, tableDir := range tableDirs {
+		tablePath := path.Join(tempDir, tableDir)
+		if !c.hasTempTable(tableDir) {
+			log.Info("remove unfinished temp dir", zap.String("dir", tablePath))
+			if err := os.RemoveAll(tablePath); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+
+		subDirs, err := readSubDirs(tablePath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, subDir := range subDirs {
+			if err := c.cleanPartition(tempDir, path.Join(tableDir, subDir)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasTempTable returns true if any partition of the table dir is recorded in the checkpoint
+func (c *checkpoint) hasTempTable(tableDir string) bool {
+	for partition := range c.TempFiles {
+		if path.Dir(partition) == tableDir {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checkpoint) cleanPartition(tempDir, partition string) error {
+	dirPath := path.Join(tempDir, partition)
+	saved, ok := c.TempFiles[partition]
+	if !ok {
+		log.Info("remove unfinished temp dir", zap.String("dir", dirPath))
+		return errors.Trace(os.RemoveAll(dirPath))
+	}
+
+	names, err := binlogfile.ReadBinlogNames(dirPath)
+	if err != nil && errors.Cause(err) != binlogfile.ErrFileNotFound {
+		return errors.Trace(err)
+	}
+	for _, name := range names {
+		filePath := path.Join(dirPath, name)
+		size, ok := saved[name]
+		if !ok {
+			log.Info("remove unfinished temp file", zap.String("file", filePath))
+			if err := os.Remove(filePath); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+
+		if err := os.Truncate(filePath, size); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (c *checkpoint) finishMap() error {
+	c.MapFinished = true
+	return errors.Trace(c.save())
+}
+
+func (c *checkpoint) isReduced(dir string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return containsString(c.ReducedDirs, dir)
+}
+
+func (c *checkpoint) addReducedDir(dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ReducedDirs = append(c.ReducedDirs, dir)
+	sort.Strings(c.ReducedDirs)
+	return errors.Trace(c.save())
+}
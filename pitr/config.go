@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"runtime"
 	"strings"
 	"time"
 
@@ -13,7 +14,6 @@ import (
 	"github.com/pingcap/tidb-binlog/pkg/filter"
 	"github.com/pingcap/tidb-binlog/pkg/flags"
 	"github.com/pingcap/tidb-binlog/pkg/util"
-	"github.com/pingcap/tidb-binlog/pkg/version"
 	"github.com/pingcap/tidb/store/tikv/oracle"
 	"go.uber.org/zap"
 )
@@ -21,11 +21,46 @@ import (
 const (
 	toolName   = "tidb-binlog-pitr"
 	timeFormat = "2006-01-02 15:04:05"
+
+	defaultOutputDir      = "./new_binlog"
+	defaultMaxMemory      = 2 * 1024 * 1024 * 1024 // 2G
+	defaultOutputFileSize = 512 * 1024 * 1024      // 512M
+)
+
+// the sub commands of pitr
+const (
+	// CommandCompact merges the binlogs, it's the default command
+	CommandCompact = "compact"
+	// CommandInspect prints the binlogs
+	CommandInspect = "inspect"
+	// CommandStat prints the summaries of the binlogs
+	CommandStat = "stat"
+	// CommandVerify compares the merged binlogs with the original binlogs
+	CommandVerify = "verify"
+	// CommandApply replays the binlogs to a database
+	CommandApply = "apply"
+	// CommandSchemaDump writes the history ddl jobs to a file
+	CommandSchemaDump = "schema dump"
 )
 
+var commands = []struct {
+	name  string
+	usage string
+}{
+	{CommandCompact, "merge the binlogs in [start, stop], only the last change of every row is kept"},
+	{CommandInspect, "print the binlogs"},
+	{CommandStat, "print the summaries of the binlogs and estimate the size after compact"},
+	{CommandVerify, "replay the original binlogs and the merged binlogs, and compare the data"},
+	{CommandApply, "replay the binlogs to MySQL or TiDB"},
+	{CommandSchemaDump, "write the history ddl jobs got from PD to a file, which can be used instead of pd-urls"},
+}
+
 // Config is the main configuration for the retore tool.
 type Config struct {
 	*flag.FlagSet `toml:"-" json:"-"`
+	// Command is the sub command to run, the flags and the config section are different for every command
+	Command string `toml:"-" json:"command"`
+
 	Dir           string `toml:"data-dir" json:"data-dir"`
 	StartDatetime string `toml:"start-datetime" json:"start-datetime"`
 	StopDatetime  string `toml:"stop-datetime" json:"stop-datetime"`
@@ -33,6 +68,8 @@ type Config struct {
 	StopTSO       int64  `toml:"stop-tso" json:"stop-tso"`
 
 	PDURLs string `toml:"pd-urls" json:"pd-urls"`
+	// HistoryDDLFile is the file written by schema dump, the history ddl jobs are read from it instead of PD
+	HistoryDDLFile string `toml:"history-ddl-file" json:"history-ddl-file"`
 
 	DoTables []filter.TableName `toml:"replicate-do-table" json:"replicate-do-table"`
 	DoDBs    []string           `toml:"replicate-do-db" json:"replicate-do-db"`
@@ -43,30 +80,235 @@ type Config struct {
 	LogFile  string `toml:"log-file" json:"log-file"`
 	LogLevel string `toml:"log-level" json:"log-level"`
 
-	configFile   string
-	printVersion bool
+	// TiDBDir is the data directory of the embedded TiDB, empty means create a unique directory for every run
+	TiDBDir string `toml:"tidb-dir" json:"tidb-dir"`
+	// TiDBPort is the port of the embedded TiDB, 0 means choose a free port automatically
+	TiDBPort int `toml:"tidb-port" json:"tidb-port"`
+	// CheckSchema runs the embedded TiDB to check the schema tracked in memory, verify always runs it to replay the binlogs
+	CheckSchema bool `toml:"check-schema" json:"check-schema"`
+
+	CompactConfig `toml:"compact" json:"compact"`
+	InspectConfig `toml:"inspect" json:"inspect"`
+	StatConfig    `toml:"stat" json:"stat"`
+	VerifyConfig  `toml:"verify" json:"verify"`
+	ApplyConfig   `toml:"apply" json:"apply"`
+
+	SchemaDumpConfig `toml:"schema-dump" json:"schema-dump"`
+
+	// PrintVersion is set by -V, the caller should print the version info and exit
+	PrintVersion bool `toml:"-" json:"-"`
+
+	configFile string
+}
+
+// CompactConfig is the configuration of the compact command.
+type CompactConfig struct {
+	// TempDir is used to save the splited binlog files, empty means create a unique directory for every run
+	TempDir string `toml:"temp-dir" json:"temp-dir"`
+	// OutputDir is used to save the merged binlog files
+	OutputDir string `toml:"output-dir" json:"output-dir"`
+	// BaseDir is the output of a previous compact, the binlogs after its stop ts in data-dir are merged into it,
+	// and the schema at its start ts is read from its manifest
+	BaseDir string `toml:"base-dir" json:"base-dir"`
+	// SchemaDir and SchemaFile create the schema before the binlogs without PD, SchemaDir is a directory of
+	// the *-schema.sql files dumped by mydumper or dumpling, and SchemaFile is a json array of the history ddl jobs
+	SchemaDir  string `toml:"schema-dir" json:"schema-dir"`
+	SchemaFile string `toml:"schema-file" json:"schema-file"`
+	// OutputFormat is the format of the output files, binlog, sql, csv or columnar.
+	// csv and columnar save only the final row images without ddls, see exportSink for the encoding
+	OutputFormat string `toml:"output-format" json:"output-format"`
+	// OutputFileSize is the max size in bytes of a sql, csv or columnar file, a new file is created if exceeds
+	OutputFileSize int64 `toml:"output-file-size" json:"output-file-size"`
+	// SingleOutput merges all the tables into one binlog directory in the order of commit ts, which can be read by reparo.
+	// the dmls are not merged across any ddl, so the ddls of all the tables are barriers in the output
+	SingleOutput bool `toml:"single-output" json:"single-output"`
+	// WindowTxns and WindowDuration enable the transaction-preserving mode, the rows are only merged in the windows
+	// of WindowTxns transactions or WindowDuration of commit ts, and every window is output with the commit ts
+	// of its last transaction, so restoring to any commit ts in the output gets a consistent state. 0 and "" mean no limit
+	WindowTxns     int    `toml:"window-txns" json:"window-txns"`
+	WindowDuration string `toml:"window-duration" json:"window-duration"`
+
+	// Overwrite and Resume decide how to handle the directories which already exist
+	Overwrite bool `toml:"overwrite" json:"overwrite"`
+	Resume    bool `toml:"resume" json:"resume"`
+
+	// ReduceWorkers is the number of temp sub directories reduced concurrently
+	ReduceWorkers int `toml:"reduce-workers" json:"reduce-workers"`
+	// MaxMemory is the memory in bytes to reduce one hash bucket, the binlogs are split into buckets to fit it,
+	// and the events are spilled to disk if they still use more memory
+	MaxMemory int64 `toml:"max-memory" json:"max-memory"`
+}
+
+// InspectConfig is the configuration of the inspect command.
+type InspectConfig struct {
+	// Format is the format to print the binlogs, text or json
+	Format string `toml:"format" json:"format"`
+	// Tables is a comma separated list like "db1.table1,db2.*", only the binlogs of them are printed if not empty
+	Tables string `toml:"tables" json:"tables"`
+	// EventTypes is a comma separated list of insert, update, delete and ddl, only these events are printed if not empty
+	EventTypes string `toml:"event-types" json:"event-types"`
+}
+
+// StatConfig is the configuration of the stat command.
+type StatConfig struct {
+	// Format is the format to print the summaries, table or json
+	Format string `toml:"format" json:"format"`
+}
+
+// VerifyConfig is the configuration of the verify command.
+type VerifyConfig struct {
+	// MergedDir is the output directory of compact
+	MergedDir string `toml:"merged-dir" json:"merged-dir"`
+}
+
+// ApplyConfig is the configuration of the apply command.
+type ApplyConfig struct {
+	DestDB DBConfig `toml:"dest-db" json:"dest-db"`
+	// Workers is the number of workers to execute the dmls concurrently, the dmls are sharded by key
+	Workers int `toml:"workers" json:"workers"`
+	// BatchSize is the max number of sqls executed in one transaction
+	BatchSize int `toml:"batch-size" json:"batch-size"`
+	// SafeMode uses REPLACE for insert and DELETE + REPLACE for update, so the binlogs can be applied again
+	SafeMode bool `toml:"safe-mode" json:"safe-mode"`
+	// DryRun prints the sqls instead of executing them
+	DryRun bool `toml:"dry-run" json:"dry-run"`
+}
+
+// SchemaDumpConfig is the configuration of the schema dump command.
+type SchemaDumpConfig struct {
+	// OutputFile is the file to write the history ddl jobs
+	OutputFile string `toml:"output-file" json:"output-file"`
 }
 
-// NewConfig creates a Config object.
+// DBConfig is the configuration to connect MySQL or TiDB.
+type DBConfig struct {
+	Host     string `toml:"host" json:"host"`
+	User     string `toml:"user" json:"user"`
+	Password string `toml:"password" json:"-"`
+	Port     int    `toml:"port" json:"port"`
+}
+
+// NewConfig creates a Config object of the compact command, the flags are created when parse.
 func NewConfig() *Config {
-	c := &Config{}
-	c.FlagSet = flag.NewFlagSet(toolName, flag.ContinueOnError)
-	fs := c.FlagSet
+	return &Config{
+		Command:  CommandCompact,
+		LogLevel: "info",
+		CompactConfig: CompactConfig{
+			OutputDir:      defaultOutputDir,
+			OutputFormat:   outputFormatBinlog,
+			OutputFileSize: defaultOutputFileSize,
+			MaxMemory:      defaultMaxMemory,
+			ReduceWorkers:  runtime.NumCPU(),
+		},
+		InspectConfig: InspectConfig{Format: "text"},
+		StatConfig:    StatConfig{Format: "table"},
+		VerifyConfig:  VerifyConfig{MergedDir: defaultOutputDir},
+		ApplyConfig: ApplyConfig{
+			DestDB:    DBConfig{Host: "127.0.0.1", User: "root", Port: 3306},
+			Workers:   16,
+			BatchSize: 20,
+		},
+	}
+}
+
+// newFlagSet returns the flags of the command, the default values are the values in config
+func (c *Config) newFlagSet(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(toolName+" "+command, flag.ContinueOnError)
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Usage of %s:", toolName))
+		fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", toolName, command)
 		fs.PrintDefaults()
 	}
-	fs.StringVar(&c.Dir, "data-dir", "", "drainer data directory path")
-	fs.StringVar(&c.StartDatetime, "start-datetime", "", "recovery from start-datetime, empty string means starting from the beginning of the first file")
-	fs.StringVar(&c.StopDatetime, "stop-datetime", "", "recovery end in stop-datetime, empty string means never end.")
-	fs.Int64Var(&c.StartTSO, "start-tso", 0, "similar to start-datetime but in pd-server tso format")
-	fs.Int64Var(&c.StopTSO, "stop-tso", 0, "similar to stop-datetime, but in pd-server tso format")
-	fs.StringVar(&c.LogFile, "log-file", "", "log file path")
-	fs.StringVar(&c.LogLevel, "L", "info", "log level: debug, info, warn, error, fatal")
-	fs.StringVar(&c.configFile, "config", "", "[REQUIRED] path to configuration file")
-	fs.StringVar(&c.PDURLs, "pd-urls", "", "a comma separated list of PD endpoints")
-	fs.BoolVar(&c.printVersion, "V", false, "print pitr version info")
-	return c
+	fs.StringVar(&c.Dir, "data-dir", c.Dir, "directory of the binlog files")
+	fs.StringVar(&c.StartDatetime, "start-datetime", c.StartDatetime, "recovery from start-datetime, empty string means starting from the beginning of the first file")
+	fs.StringVar(&c.StopDatetime, "stop-datetime", c.StopDatetime, "recovery end in stop-datetime, empty string means never end.")
+	fs.Int64Var(&c.StartTSO, "start-tso", c.StartTSO, "similar to start-datetime but in pd-server tso format")
+	fs.Int64Var(&c.StopTSO, "stop-tso", c.StopTSO, "similar to stop-datetime, but in pd-server tso format")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "log file path")
+	fs.StringVar(&c.LogLevel, "L", c.LogLevel, "log level: debug, info, warn, error, fatal")
+	fs.StringVar(&c.configFile, "config", c.configFile, "path to configuration file")
+	fs.BoolVar(&c.PrintVersion, "V", false, "print pitr version info")
+
+	switch command {
+	case CommandCompact:
+		c.addTiDBFlags(fs)
+		fs.StringVar(&c.TempDir, "temp-dir", c.TempDir, "directory to save temporary files, empty string means creating a unique directory for every run")
+		fs.StringVar(&c.OutputDir, "output-dir", c.OutputDir, "directory to save the merged binlog files")
+		fs.StringVar(&c.BaseDir, "base-dir", c.BaseDir, "output directory of a previous compact, the binlogs after it in data-dir are merged into it")
+		fs.StringVar(&c.SchemaDir, "schema-dir", c.SchemaDir, "directory of the *-schema.sql files dumped by mydumper or dumpling, used to create the tables before the binlogs instead of pd-urls")
+		fs.StringVar(&c.SchemaFile, "schema-file", c.SchemaFile, "json file of the history ddl jobs, used to create the tables before the binlogs instead of pd-urls")
+		fs.StringVar(&c.OutputFormat, "output-format", c.OutputFormat, "format of the output files: binlog, sql, csv, columnar(a csv file for every column)")
+		fs.BoolVar(&c.SingleOutput, "single-output", c.SingleOutput, "merge all the tables into one binlog directory in the order of commit ts, the dmls are not merged across any ddl")
+		fs.IntVar(&c.WindowTxns, "window-txns", c.WindowTxns, "only merge the rows in every window of this number of transactions, 0 means no limit")
+		fs.StringVar(&c.WindowDuration, "window-duration", c.WindowDuration, "only merge the rows in every window of this duration of commit ts like 10m, empty string means no limit")
+		fs.Int64Var(&c.OutputFileSize, "output-file-size", c.OutputFileSize, "max size in bytes of a sql, csv or columnar file, a new file is created if exceeds")
+		fs.BoolVar(&c.Overwrite, "overwrite", c.Overwrite, "remove the directories which already exist, only the directories made by pitr or empty can be removed")
+		fs.BoolVar(&c.Resume, "resume", c.Resume, "reuse the directories which already exist")
+		fs.Int64Var(&c.MaxMemory, "max-memory", c.MaxMemory, "max memory in bytes used to reduce one hash bucket of a table, the binlogs are split into more buckets if it's smaller, and the events are spilled to disk if exceed")
+		fs.IntVar(&c.ReduceWorkers, "reduce-workers", c.ReduceWorkers, "number of workers to reduce the tables concurrently")
+	case CommandInspect:
+		fs.StringVar(&c.InspectConfig.Format, "format", c.InspectConfig.Format, "format to print the binlogs: text, json")
+		fs.StringVar(&c.Tables, "tables", c.Tables, "a comma separated list like db1.table1,db2.*, only print the binlogs of these tables")
+		fs.StringVar(&c.EventTypes, "event-types", c.EventTypes, "a comma separated list of insert, update, delete and ddl, only print these events")
+	case CommandStat:
+		c.addTiDBFlags(fs)
+		fs.StringVar(&c.StatConfig.Format, "format", c.StatConfig.Format, "format to print the summaries: table, json")
+	case CommandVerify:
+		c.addTiDBFlags(fs)
+		fs.StringVar(&c.MergedDir, "merged-dir", c.MergedDir, "directory of the merged binlog files, it's the output-dir of compact")
+	case CommandApply:
+		fs.StringVar(&c.DestDB.Host, "dest-host", c.DestDB.Host, "host of the destination database")
+		fs.IntVar(&c.DestDB.Port, "dest-port", c.DestDB.Port, "port of the destination database")
+		fs.StringVar(&c.DestDB.User, "dest-user", c.DestDB.User, "user of the destination database")
+		fs.StringVar(&c.DestDB.Password, "dest-password", c.DestDB.Password, "password of the destination database")
+		fs.IntVar(&c.Workers, "workers", c.Workers, "number of workers to execute the dmls concurrently")
+		fs.IntVar(&c.BatchSize, "batch-size", c.BatchSize, "max number of sqls executed in one transaction")
+		fs.BoolVar(&c.SafeMode, "safe-mode", c.SafeMode, "use REPLACE for insert and DELETE + REPLACE for update, so the binlogs can be applied again")
+		fs.BoolVar(&c.DryRun, "dry-run", c.DryRun, "print the sqls instead of executing them, the table info is still read from the destination database")
+	case CommandSchemaDump:
+		fs.StringVar(&c.PDURLs, "pd-urls", c.PDURLs, "a comma separated list of PD endpoints, used to get the history ddls")
+		fs.StringVar(&c.OutputFile, "output-file", c.OutputFile, "file to write the history ddls, they're finished before start-tso, or before the first binlog in data-dir if start-tso is not set")
+	}
+	return fs
+}
+
+// addTiDBFlags adds the flags used to run the embedded TiDB
+func (c *Config) addTiDBFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.PDURLs, "pd-urls", c.PDURLs, "a comma separated list of PD endpoints, used to get the history ddls")
+	fs.StringVar(&c.HistoryDDLFile, "history-ddl-file", c.HistoryDDLFile, "file written by schema dump, used to get the history ddls instead of pd-urls")
+	fs.StringVar(&c.TiDBDir, "tidb-dir", c.TiDBDir, "data directory of the embedded TiDB, empty string means creating a unique directory for every run")
+	fs.IntVar(&c.TiDBPort, "tidb-port", c.TiDBPort, "port of the embedded TiDB, 0 means choosing a free port automatically")
+	fs.BoolVar(&c.CheckSchema, "check-schema", c.CheckSchema, "run the embedded TiDB to execute the ddls too and check the schema tracked in memory with it, it's slow and used for debugging")
+}
+
+// printUsage prints the sub commands
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", toolName)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"%s <command> -h\" to get the flags of a command, the command is %s if not specified.\n", toolName, CommandCompact)
+}
+
+// parseCommand returns the sub command and the remaining args, the command is compact if args starts with a flag
+func parseCommand(args []string) (string, []string, error) {
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help") {
+		return CommandCompact, args, nil
+	}
+
+	switch args[0] {
+	case "-h", "--help", "help":
+		printUsage()
+		return "", nil, flag.ErrHelp
+	}
+	// the command may have several words like "schema dump"
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd.name, args[len(words):], nil
+		}
+	}
+	printUsage()
+	return "", nil, errors.Errorf("unknown command %s", args[0])
 }
 
 func (c *Config) String() string {
@@ -78,21 +320,28 @@ func (c *Config) String() string {
 	return string(cfgBytes)
 }
 
-// Parse parses keys/values from command line flags and toml configuration file.
+// Parse parses the sub command, and the keys/values from command line flags and toml configuration file.
+// It returns flag.ErrHelp if the usage is asked, and returns without checking the other flags if -V is set.
 func (c *Config) Parse(args []string) (err error) {
+	c.Command, args, err = parseCommand(args)
+	if err == flag.ErrHelp {
+		return err
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.FlagSet = c.newFlagSet(c.Command)
+
 	// Parse first to get config file
-	perr := c.FlagSet.Parse(args)
-	switch perr {
-	case nil:
-	case flag.ErrHelp:
-		os.Exit(0)
-	default:
-		os.Exit(2)
+	if err := c.FlagSet.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errors.Trace(err)
 	}
 
-	if c.printVersion {
-		fmt.Println(version.GetRawVersionInfo())
-		os.Exit(0)
+	if c.PrintVersion {
+		return nil
 	}
 
 	if c.configFile != "" {
@@ -150,9 +399,129 @@ func (c *Config) configFromFile(path string) error {
 }
 
 func (c *Config) validate() error {
-	if c.Dir == "" {
+	// schema dump only reads data-dir to get the first commit ts
+	if c.Dir == "" && c.Command != CommandSchemaDump {
 		return errors.New("data-dir is empty")
 	}
+	if c.PDURLs != "" && c.HistoryDDLFile != "" {
+		return errors.New("pd-urls and history-ddl-file can't be used together")
+	}
+
+	switch c.Command {
+	case CommandCompact:
+		if c.BaseDir != "" && c.StartTSO != 0 {
+			return errors.New("start-tso and start-datetime can't be used with base-dir, the binlogs after base are merged")
+		}
+		if c.SchemaDir != "" || c.SchemaFile != "" {
+			if c.SchemaDir != "" && c.SchemaFile != "" {
+				return errors.New("schema-dir and schema-file can't be used together")
+			}
+			if c.PDURLs != "" || c.HistoryDDLFile != "" {
+				return errors.New("schema-dir and schema-file can't be used with pd-urls or history-ddl-file")
+			}
+			if c.BaseDir != "" {
+				return errors.New("schema-dir and schema-file can't be used with base-dir, the schema is read from the manifest of base")
+			}
+		}
+		return c.CompactConfig.validate()
+	case CommandInspect:
+		return c.InspectConfig.validate()
+	case CommandStat:
+		if c.StatConfig.Format != "table" && c.StatConfig.Format != "json" {
+			return errors.Errorf("format %s is not supported by stat", c.StatConfig.Format)
+		}
+	case CommandVerify:
+		if c.MergedDir == "" {
+			return errors.New("merged-dir is empty")
+		}
+	case CommandApply:
+		return c.ApplyConfig.validate()
+	case CommandSchemaDump:
+		if c.PDURLs == "" {
+			return errors.New("pd-urls is empty")
+		}
+		if c.OutputFile == "" {
+			return errors.New("output-file is empty")
+		}
+	default:
+		return errors.Errorf("unknown command %s", c.Command)
+	}
+	return nil
+}
+
+func (c *InspectConfig) validate() error {
+	if c.Format != "text" && c.Format != "json" {
+		return errors.Errorf("format %s is not supported by inspect", c.Format)
+	}
+	if _, err := parseTableNames(c.Tables); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := parseEventTypes(c.EventTypes)
+	return errors.Trace(err)
+}
+
+func (c *ApplyConfig) validate() error {
+	if c.DestDB.Host == "" || c.DestDB.Port <= 0 {
+		return errors.Errorf("dest-db %s:%d is invalid", c.DestDB.Host, c.DestDB.Port)
+	}
+	if c.Workers <= 0 {
+		return errors.Errorf("workers %d is invalid, should be at least 1", c.Workers)
+	}
+	if c.BatchSize <= 0 {
+		return errors.Errorf("batch-size %d is invalid, should be at least 1", c.BatchSize)
+	}
+	return nil
+}
+
+// windowTS returns WindowDuration in the tso format, 0 means no limit
+func (c *CompactConfig) windowTS() (int64, error) {
+	if c.WindowDuration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.WindowDuration)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("window-duration %s is invalid, should be a positive duration like 10m", c.WindowDuration)
+	}
+	return int64(oracle.ComposeTS(int64(d/time.Millisecond), 0)), nil
+}
+
+func (c *CompactConfig) validate() error {
+	if c.Overwrite && c.Resume {
+		return errors.New("overwrite and resume can't be both set")
+	}
+
+	if c.Resume && c.TempDir == "" {
+		return errors.New("temp-dir is empty, resume needs the temp-dir of the previous run")
+	}
+
+	if c.MaxMemory <= 0 {
+		return errors.Errorf("max-memory %d is invalid, should be greater than 0", c.MaxMemory)
+	}
+
+	if c.ReduceWorkers < 1 {
+		return errors.Errorf("reduce-workers %d is invalid, should be at least 1", c.ReduceWorkers)
+	}
+
+	switch c.OutputFormat {
+	case outputFormatBinlog, outputFormatSQL, outputFormatCSV, outputFormatColumnar:
+	default:
+		return errors.Errorf("output-format %s is not supported", c.OutputFormat)
+	}
+
+	if c.WindowTxns < 0 {
+		return errors.Errorf("window-txns %d is invalid, should be at least 0", c.WindowTxns)
+	}
+	if _, err := c.windowTS(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if c.SingleOutput && c.OutputFormat != outputFormatBinlog {
+		return errors.Errorf("single-output only supports output-format %s", outputFormatBinlog)
+	}
+
+	if c.OutputFileSize <= 0 {
+		return errors.Errorf("output-file-size %d is invalid, should be greater than 0", c.OutputFileSize)
+	}
 
 	return nil
 }
@@ -0,0 +1,108 @@
+package pitr
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestConfigParse(t *testing.T) {
+	// the command is compact if not specified
+	cfg := NewConfig()
+	err := cfg.Parse([]string{"-data-dir", "./binlog", "-max-memory", "1024"})
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, cfg.Command, CommandCompact)
+	assert.Equal(t, cfg.MaxMemory, int64(1024))
+
+	// the window duration is converted to tso
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"-data-dir", "./binlog", "-window-duration", "1s"})
+	assert.Assert(t, err == nil, err)
+	windowTS, err := cfg.windowTS()
+	assert.Assert(t, err == nil)
+	assert.Equal(t, windowTS, int64(1000<<18))
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"-data-dir", "./binlog", "-window-duration", "-1s"})
+	assert.ErrorContains(t, err, "window-duration -1s is invalid")
+
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"-data-dir", "./binlog", "-schema-dir", "./dump", "-pd-urls", "127.0.0.1:2379"})
+	assert.ErrorContains(t, err, "can't be used with pd-urls")
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"-data-dir", "./binlog", "-schema-dir", "./dump", "-schema-file", "./jobs.json"})
+	assert.ErrorContains(t, err, "can't be used together")
+
+	// the command can have two words, and data-dir is optional
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"schema", "dump", "-pd-urls", "127.0.0.1:2379", "-output-file", "./ddls.json"})
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, cfg.Command, CommandSchemaDump)
+	assert.Equal(t, cfg.OutputFile, "./ddls.json")
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"schema", "dump", "-output-file", "./ddls.json"})
+	assert.ErrorContains(t, err, "pd-urls is empty")
+
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"unknown", "-data-dir", "./binlog"})
+	assert.Assert(t, err != nil)
+
+	// the help and flag errors are returned to the caller instead of exiting
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"help"})
+	assert.Equal(t, err, flag.ErrHelp)
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"verify", "-h"})
+	assert.Equal(t, err, flag.ErrHelp)
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"verify", "-unknown-flag"})
+	assert.ErrorContains(t, err, "flag provided but not defined")
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"-V"})
+	assert.Assert(t, err == nil, err)
+	assert.Assert(t, cfg.PrintVersion)
+
+	// the flags of other commands are not registered
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"verify", "-data-dir", "./binlog", "-merged-dir", "./merged"})
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, cfg.Command, CommandVerify)
+	assert.Equal(t, cfg.MergedDir, "./merged")
+	assert.Equal(t, cfg.newFlagSet(CommandVerify).Lookup("max-memory") == nil, true)
+
+	// the command reads its own section in config file, and the flags and env override it
+	configFile := "./test_config.toml"
+	content := `
+data-dir = "./binlog"
+
+[compact]
+output-dir = "./compacted"
+
+[apply.dest-db]
+host = "10.0.0.1"
+port = 4000
+user = "pitr"
+`
+	err = ioutil.WriteFile(configFile, []byte(content), 0644)
+	assert.Assert(t, err == nil)
+	defer os.Remove(configFile)
+
+	os.Setenv(toolName+"_DEST_PORT", "4001")
+	defer os.Unsetenv(toolName + "_DEST_PORT")
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"apply", "-config", configFile, "-dest-user", "root"})
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, cfg.Command, CommandApply)
+	assert.Equal(t, cfg.Dir, "./binlog")
+	assert.Equal(t, cfg.OutputDir, "./compacted")
+	assert.DeepEqual(t, cfg.DestDB, DBConfig{Host: "10.0.0.1", User: "root", Port: 4001})
+
+	// the unknown options in config file are not allowed
+	err = ioutil.WriteFile(configFile, []byte(content+"\n[verify]\nunknown = 1\n"), 0644)
+	assert.Assert(t, err == nil)
+	cfg = NewConfig()
+	err = cfg.Parse([]string{"verify", "-config", configFile})
+	assert.Assert(t, err != nil)
+}
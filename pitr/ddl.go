@@ -1,7 +1,9 @@
 package pitr
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -26,45 +28,94 @@ SELECT non_unique, index_name, seq_in_index, column_name
 FROM information_schema.statistics
 WHERE table_schema = ? AND table_name = ?
 ORDER BY seq_in_index ASC;`
-	alldatabases   = `SHOW DATABASES;`
-	alltables      = `SHOW TABLES;`
-	createMapDB    = `CREATE DATABASE _interval_map_;`
-	createMapTable = `USE _interval_map_; create table _inter_map_ (curKey varchar(128) unique, srcKey varchar(128));`
-	useIntervalDB  = `USE _interval_map_;`
+	alldatabases = `SHOW DATABASES;`
 )
 
 var (
 	// ErrTableNotExist means the table not exist.
 	ErrTableNotExist = errors.New("table not exist")
-
-	// used for run a mock tidb
-	defaultTiDBDir  = "/tmp/pitr_tidb"
-	defaultTiDBPort = 40404
 )
 
 // DDLHandle used to handle ddl, and privide the table info
 type DDLHandle struct {
+	// tracker applies the ddls to the table infos in memory
+	tracker *schemaTracker
+
+	// db is the embedded TiDB, it's nil if not run. the ddls are executed on it too,
+	// and the table infos tracked in memory are checked with the ones in it
 	db *sql.DB
 
+	// mu makes the ddls executed one by one, so the table info is always updated by the right ddl
+	mu sync.Mutex
+
 	tableInfos sync.Map
 
+	// versions keeps every version of the tables' info changed by the ddls executed with commit ts
+	versions *schemaStore
+
 	tidbServer *tidblite.TiDBServer
+
+	// tidbDir is the data directory of the mock tidb
+	tidbDir string
 }
 
-func NewDDLHandle(historyDDLs []*model.Job) (*DDLHandle, error) {
+// NewDDLHandle tracks the schema in memory, and runs a mock tidb with data in tidbDir and listening on tidbPort
+// if tidbDir is not empty, tidbPort = 0 means choose a free port automatically
+func NewDDLHandle(historyDDLs []*model.Job, tidbDir string, tidbPort int) (*DDLHandle, error) {
 	historySchema, err := NewSchema(historyDDLs)
 	if err != nil {
 		return nil, err
 	}
-
-	// run a mock tidb in local, used to execute ddl and get table info
-	if err := os.Mkdir(defaultTiDBDir, os.ModePerm); err != nil {
+	tracker, err := newSchemaTracker()
+	if err != nil {
 		return nil, err
 	}
-	tidbServer, err := tidblite.NewTiDBServer(tidblite.NewOptions(defaultTiDBDir).WithPort(defaultTiDBPort))
+
+	ddlHandle := &DDLHandle{
+		tracker:  tracker,
+		tidbDir:  tidbDir,
+		versions: newSchemaStore(),
+	}
+	if tidbDir != "" {
+		if ddlHandle.tidbServer, ddlHandle.db, err = runMockTiDB(tidbDir, tidbPort); err != nil {
+			return nil, err
+		}
+	}
+
+	tableInfos, err := historySchema.AllTableInfos()
 	if err != nil {
 		return nil, err
 	}
+	log.Info("history table info", zap.Reflect("tableInfos", tableInfos))
+	for _, info := range tableInfos {
+		ddlHandle.tableInfos.Store(quoteSchema(info.schema, info.table), info)
+		ddlHandle.versions.put(info.schema, info.table, 0, info)
+	}
+
+	return ddlHandle, nil
+}
+
+// runMockTiDB runs a mock tidb in local, used to replay the binlogs and check the table info tracked in memory
+func runMockTiDB(tidbDir string, tidbPort int) (*tidblite.TiDBServer, *sql.DB, error) {
+	if err := os.MkdirAll(tidbDir, os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+	// the data of mock tidb is rebuilt in every run, mark the dir to be removed by the next run
+	if err := markPITRDir(tidbDir); err != nil {
+		return nil, nil, err
+	}
+	if tidbPort == 0 {
+		port, err := getFreePort()
+		if err != nil {
+			return nil, nil, err
+		}
+		tidbPort = port
+	}
+	log.Info("run mock tidb", zap.String("dir", tidbDir), zap.Int("port", tidbPort))
+	tidbServer, err := tidblite.NewTiDBServer(tidblite.NewOptions(tidbDir).WithPort(tidbPort))
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var dbConn *sql.DB
 	for i := 0; i < 5; i++ {
@@ -76,48 +127,111 @@ func NewDDLHandle(historyDDLs []*model.Job) (*DDLHandle, error) {
 		break
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return tidbServer, dbConn, nil
+}
 
-	ddlHandle := &DDLHandle{
-		db:         dbConn,
-		tidbServer: tidbServer,
-	}
+// ExecuteDDL executes ddl, and then update the tables' info
+func (d *DDLHandle) ExecuteDDL(ddl string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	tableInfos, err := historySchema.AllTableInfos()
+	_, _, err := d.executeDDL(ddl)
+	return errors.Trace(err)
+}
+
+// ExecuteDDLAt executes ddl with commit ts, and then saves the info of every table changed by it as a new version
+// since the commit ts, the ddls before the binlogs are executed with commit ts 0
+func (d *DDLHandle) ExecuteDDLAt(ddl string, commitTS int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tables, infos, err := d.executeDDL(ddl)
 	if err != nil {
-		return nil, err
+		return errors.Trace(err)
 	}
-	log.Info("history table info", zap.Reflect("tableInfos", tableInfos))
-	for _, info := range tableInfos {
-		ddlHandle.tableInfos.Store(quoteSchema(info.schema, info.table), info)
+	for i, table := range tables {
+		if table.Table != "" {
+			d.versions.put(table.Schema, table.Table, commitTS, infos[i])
+		} else if isDropDatabaseDDL(ddl) {
+			d.versions.dropSchema(table.Schema, commitTS)
+		}
 	}
-
-	return ddlHandle, nil
+	return nil
 }
 
-// ExecuteDDL executes ddl, and then update the table's info
-func (d *DDLHandle) ExecuteDDL(ddl string) error {
+// executeDDL executes ddl and updates the info of the tables changed by it, the info is nil if the table doesn't exist after the ddl
+func (d *DDLHandle) executeDDL(ddl string) (tables []TableName, infos []*tableInfo, err error) {
 	log.Info("execute ddl", zap.String("ddl", ddl))
-	if _, err := d.db.Exec(ddl); err != nil {
-		return errors.Trace(err)
+	if d.db != nil {
+		if _, err := d.db.Exec(ddl); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
 	}
 
-	schema, table, err := parserSchemaTableFromDDL(ddl)
-	if err != nil {
-		return errors.Trace(err)
+	if err := d.tracker.executeDDL(ddl); err != nil {
+		return nil, nil, errors.Annotatef(err, "track ddl %s failed", ddl)
 	}
 
-	info, err := getTableInfo(d.db, schema, table)
+	tables, err = ddlTables(ddl)
 	if err != nil {
-		// ddl drop table
-		if err == ErrTableNotExist {
-			return nil
+		return nil, nil, errors.Trace(err)
+	}
+
+	infos = make([]*tableInfo, len(tables))
+	for i, table := range tables {
+		if table.Table == "" {
+			if isDropDatabaseDDL(ddl) {
+				d.tableInfos.Range(func(key, value interface{}) bool {
+					if value.(*tableInfo).schema == table.Schema {
+						d.tableInfos.Delete(key)
+					}
+					return true
+				})
+			}
+			continue
+		}
+
+		info, err := d.tracker.tableInfo(table.Schema, table.Table)
+		if err != nil && errors.Cause(err) != ErrTableNotExist {
+			return nil, nil, errors.Trace(err)
+		}
+		if d.db != nil {
+			if err := d.checkTableInfo(table.Schema, table.Table, info); err != nil {
+				return nil, nil, errors.Annotatef(err, "check table info after ddl %s failed", ddl)
+			}
 		}
+		// ddl drop table, or the old table of rename
+		if info == nil {
+			d.tableInfos.Delete(quoteSchema(table.Schema, table.Table))
+			continue
+		}
+		d.tableInfos.Store(quoteSchema(table.Schema, table.Table), info)
+		infos[i] = info
+	}
+
+	return tables, infos, nil
+}
+
+// checkTableInfo checks the table info tracked in memory is the same as the one in the mock tidb
+func (d *DDLHandle) checkTableInfo(schema, table string, info *tableInfo) error {
+	expected, err := getTableInfo(d.db, schema, table)
+	if err != nil && errors.Cause(err) != ErrTableNotExist {
 		return errors.Trace(err)
 	}
-	d.tableInfos.Store(quoteSchema(schema, table), info)
 
+	tracked, err := json.Marshal(info)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	queried, err := json.Marshal(expected)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !bytes.Equal(tracked, queried) {
+		return errors.Errorf("the table info of %s is %s, but %s in the mock tidb", quoteSchema(schema, table), tracked, queried)
+	}
 	return nil
 }
 
@@ -128,55 +242,73 @@ func (d *DDLHandle) GetTableInfo(schema, table string) (*tableInfo, error) {
 		info := v.(*tableInfo)
 		return info, nil
 	}
-	return getTableInfo(d.db, schema, table)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tracker.tableInfo(schema, table)
 }
 
-func (d *DDLHandle) getAllDatabaseNames() ([]string, error) {
-	rows, err := d.db.Query(alldatabases)
-	if err != nil {
-		return nil, errors.Trace(err)
+// GetTableInfoAt returns the table's info in effect at commit ts, it's the latest version not after the commit ts,
+// the table not changed by the ddls with commit ts is got by GetTableInfo
+func (d *DDLHandle) GetTableInfoAt(schema, table string, commitTS int64) (*tableInfo, error) {
+	info, ok := d.versions.get(schema, table, commitTS)
+	if !ok {
+		return d.GetTableInfo(schema, table)
 	}
-	defer rows.Close()
+	if info == nil {
+		return nil, errors.Annotatef(ErrTableNotExist, "table %s is dropped before commit ts %d", quoteSchema(schema, table), commitTS)
+	}
+	return info, nil
+}
 
-	var names []string
+func (d *DDLHandle) getAllDatabaseNames() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	for rows.Next() {
-		var name string
-		err = rows.Scan(&name)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-		if strings.EqualFold(name, "mysql") || strings.EqualFold(name, "INFORMATION_SCHEMA") || strings.EqualFold(name, "PERFORMANCE_SCHEMA") {
-			continue
-		}
-		names = append(names, name)
-	}
-	return names, nil
+	return d.tracker.databases(), nil
 }
 
+// ResetDB drops all the databases, and creates the test database again
 func (d *DDLHandle) ResetDB() error {
-	names, err := d.getAllDatabaseNames()
+	if err := d.dropAllDatabases(); err != nil {
+		return err
+	}
+
+	sql := "CREATE DATABASE IF NOT EXISTS test"
+	return d.ExecuteDDL(sql)
+}
+
+// dropAllDatabases drops the databases in memory and in the mock tidb, some databases may be created in the mock tidb directly
+func (d *DDLHandle) dropAllDatabases() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.tracker.reset(); err != nil {
+		return errors.Trace(err)
+	}
+	if d.db == nil {
+		return nil
+	}
+	names, err := getDatabaseNames(d.db)
 	if err != nil {
 		return err
 	}
-	var sql string
 	for _, v := range names {
-		sql = fmt.Sprintf("DROP DATABASE %s", v)
-		err = d.ExecuteDDL(sql)
-		if err != nil {
-			return err
+		if _, err := d.db.Exec(fmt.Sprintf("DROP DATABASE %s", quoteName(v))); err != nil {
+			return errors.Trace(err)
 		}
 	}
-
-	sql = "CREATE DATABASE IF NOT EXISTS test"
-	return d.ExecuteDDL(sql)
+	return nil
 }
 
 func (d *DDLHandle) Close() {
+	if d.tidbServer == nil {
+		return
+	}
 	d.tidbServer.Close()
 
-	if err := os.RemoveAll(defaultTiDBDir); err != nil {
-		log.Warn("remove temp dir", zap.String("dir", defaultTiDBDir), zap.Error(err))
+	if err := os.RemoveAll(d.tidbDir); err != nil {
+		log.Warn("remove temp dir", zap.String("dir", d.tidbDir), zap.Error(err))
 	}
 }
 
@@ -211,17 +343,20 @@ func getTableInfo(db *sql.DB, schema string, table string) (info *tableInfo, err
 		return nil, errors.Trace(err)
 	}
 
-	// put primary key at first place
-	// and set primaryKey
-	for i := 0; i < len(info.uniqueKeys); i++ {
-		if info.uniqueKeys[i].name == "PRIMARY" {
-			info.uniqueKeys[i], info.uniqueKeys[0] = info.uniqueKeys[0], info.uniqueKeys[i]
-			info.primaryKey = &info.uniqueKeys[0]
+	info.setPrimaryKey()
+
+	return
+}
+
+// setPrimaryKey puts primary key at first place and sets primaryKey
+func (t *tableInfo) setPrimaryKey() {
+	for i := 0; i < len(t.uniqueKeys); i++ {
+		if t.uniqueKeys[i].name == "PRIMARY" {
+			t.uniqueKeys[i], t.uniqueKeys[0] = t.uniqueKeys[0], t.uniqueKeys[i]
+			t.primaryKey = &t.uniqueKeys[0]
 			break
 		}
 	}
-
-	return
 }
 
 // getColsOfTbl returns a slice of the names of all columns,
@@ -308,136 +443,141 @@ func getUniqKeys(db *sql.DB, schema, table string) (uniqueKeys []indexInfo, err
 	return
 }
 
-// parserSchemaTableFromDDL parses ddl query to get schema and table
-// ddl like `use test; create table`
-func parserSchemaTableFromDDL(ddlQuery string) (schema, table string, err error) {
-	stmts, _, err := parser.New().Parse(ddlQuery, "", "")
+// ddlTables returns all the tables changed by ddl like `use test; drop table a, b`, the table is empty for a database ddl
+func ddlTables(ddlQuery string) ([]TableName, error) {
+	stmt, schema, err := parseDDL(ddlQuery)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
+	tables := stmtTables(schema, stmt)
+	if len(tables) == 0 {
+		return nil, errors.Errorf("unknown ddl type, ddl: %s", ddlQuery)
+	}
+	return tables, nil
+}
 
-	haveUseStmt := false
-
-	for _, stmt := range stmts {
-		switch node := stmt.(type) {
-		case *ast.UseStmt:
-			haveUseStmt = true
+// parseDDL parses ddl like `use test; create table`, it returns the ddl statement and the database used
+func parseDDL(ddlQuery string) (stmt ast.StmtNode, schema string, err error) {
+	stmts, _, err := parser.New().Parse(ddlQuery, "", "")
+	if err != nil {
+		return nil, "", err
+	}
+	if len(stmts) == 2 {
+		if node, ok := stmts[0].(*ast.UseStmt); ok {
 			schema = node.DBName
-		case *ast.CreateDatabaseStmt:
-			schema = node.Name
-		case *ast.DropDatabaseStmt:
-			schema = node.Name
-		case *ast.TruncateTableStmt:
-			if len(node.Table.Schema.O) != 0 {
-				schema = node.Table.Schema.O
-			}
-			table = node.Table.Name.O
-		case *ast.CreateIndexStmt:
-			if len(node.Table.Schema.O) != 0 {
-				schema = node.Table.Schema.O
-			}
-			table = node.Table.Name.O
-		case *ast.CreateTableStmt:
-			if len(node.Table.Schema.O) != 0 {
-				schema = node.Table.Schema.O
-			}
-			table = node.Table.Name.O
-		case *ast.DropIndexStmt:
-			if len(node.Table.Schema.O) != 0 {
-				schema = node.Table.Schema.O
-			}
-			table = node.Table.Name.O
-		case *ast.AlterTableStmt:
-			if len(node.Table.Schema.O) != 0 {
-				schema = node.Table.Schema.O
-			}
-			table = node.Table.Name.O
-		case *ast.DropTableStmt:
-			// FIXME: may drop more than one table in a ddl
-			if len(node.Tables[0].Schema.O) != 0 {
-				schema = node.Tables[0].Schema.O
-			}
-			table = node.Tables[0].Name.O
-		case *ast.RenameTableStmt:
-			if len(node.NewTable.Schema.O) != 0 {
-				schema = node.NewTable.Schema.O
-			}
-			table = node.NewTable.Name.O
-		default:
-			return "", "", errors.Errorf("unknown ddl type, ddl: %s", ddlQuery)
+			stmts = stmts[1:]
 		}
 	}
+	if len(stmts) != 1 {
+		return nil, "", errors.Errorf("invalid ddl %s", ddlQuery)
+	}
+	return stmts[0], schema, nil
+}
 
-	if haveUseStmt {
-		if len(stmts) != 2 {
-			return "", "", errors.Errorf("invalid ddl %s", ddlQuery)
+// stmtTables returns the tables changed by the ddl statement, nil if it's not a supported ddl.
+// the first table owns the ddl, it's the new table of a rename, and the referred table of create table like is not included
+func stmtTables(schema string, stmt ast.StmtNode) []TableName {
+	name := func(table *ast.TableName) TableName {
+		if len(table.Schema.O) != 0 {
+			return TableName{Schema: table.Schema.O, Table: table.Name.O}
 		}
-	} else {
-		if len(stmts) != 1 {
-			return "", "", errors.Errorf("invalid ddl %s", ddlQuery)
+		return TableName{Schema: schema, Table: table.Name.O}
+	}
+
+	var tables []TableName
+	switch node := stmt.(type) {
+	case *ast.CreateDatabaseStmt:
+		tables = append(tables, TableName{Schema: node.Name})
+	case *ast.DropDatabaseStmt:
+		tables = append(tables, TableName{Schema: node.Name})
+	case *ast.TruncateTableStmt:
+		tables = append(tables, name(node.Table))
+	case *ast.CreateIndexStmt:
+		tables = append(tables, name(node.Table))
+	case *ast.CreateTableStmt:
+		tables = append(tables, name(node.Table))
+	case *ast.DropIndexStmt:
+		tables = append(tables, name(node.Table))
+	case *ast.AlterTableStmt:
+		for _, spec := range node.Specs {
+			if spec.Tp == ast.AlterTableRenameTable {
+				tables = append(tables, name(spec.NewTable))
+			}
+		}
+		tables = append(tables, name(node.Table))
+	case *ast.DropTableStmt:
+		for _, table := range node.Tables {
+			tables = append(tables, name(table))
+		}
+	case *ast.RenameTableStmt:
+		for _, t2t := range node.TableToTables {
+			tables = append(tables, name(t2t.NewTable), name(t2t.OldTable))
 		}
+	default:
+		return nil
 	}
 
-	return
+	// the table may be renamed more than once, like `rename table a to b, b to c`
+	deduped := tables[:0]
+	seen := make(map[TableName]bool, len(tables))
+	for _, table := range tables {
+		if !seen[table] {
+			seen[table] = true
+			deduped = append(deduped, table)
+		}
+	}
+	return deduped
 }
 
-func (d *DDLHandle) getAllTableNames(schema string) ([]string, error) {
-	udb := fmt.Sprintf("USE %s;", schema)
-	rows, err := d.db.Query(udb + alltables)
+// isDropDatabaseDDL returns true if the ddl drops a database
+func isDropDatabaseDDL(ddl string) bool {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
 	if err != nil {
-		return nil, errors.Trace(err)
+		return false
 	}
-	defer rows.Close()
-
-	var names []string
-	for rows.Next() {
-		var name string
-		err = rows.Scan(&name)
-		if err != nil {
-			return nil, errors.Trace(err)
+	for _, stmt := range stmts {
+		if _, ok := stmt.(*ast.DropDatabaseStmt); ok {
+			return true
 		}
-		names = append(names, name)
 	}
-	return names, nil
+	return false
 }
 
-func (d *DDLHandle) createMapTable() error {
-	err := d.ExecuteDDL(createMapDB)
-	if err != nil {
-		return err
-	}
-	return d.ExecuteDDL(createMapTable)
+func (d *DDLHandle) getAllTableNames(schema string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.tracker.tables(schema)
 }
 
-func (d *DDLHandle) fetchMapKeyFromDB(key string) (string, error) {
-	sel := fmt.Sprintf(`SELECT srcKey FROM _inter_map_ WHERE curKey = '%s'`, key)
-	rows, err := d.db.Query(useIntervalDB + sel)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-	defer rows.Close()
+// dumpSchema returns the ddls to create all the databases and tables
+func (d *DDLHandle) dumpSchema() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	var cKey string
-	rows.Next()
-	err = rows.Scan(&cKey)
-	if err != nil {
-		return "", nil
-	}
-	return cKey, nil
+	return d.tracker.dumpSchema(), nil
 }
 
-func (d *DDLHandle) insertMapKeyFromDB(newKey, oldKey string) error {
-	s, err := d.fetchMapKeyFromDB(oldKey)
+// getDatabaseNames returns the databases in db, the system databases are not included
+func getDatabaseNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(alldatabases)
 	if err != nil {
-		return err
+		return nil, errors.Trace(err)
 	}
-	var ins string
-	if s != "" {
-		ins = fmt.Sprintf(`INSERT INTO _interval_map_._inter_map_ VALUES ('%s', '%s')`, newKey, s)
+	defer rows.Close()
+
+	var names []string
 
-	} else {
-		ins = fmt.Sprintf(`INSERT INTO _interval_map_._inter_map_ VALUES ('%s', '%s')`, newKey, oldKey)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if strings.EqualFold(name, "mysql") || strings.EqualFold(name, "INFORMATION_SCHEMA") || strings.EqualFold(name, "PERFORMANCE_SCHEMA") {
+			continue
+		}
+		names = append(names, name)
 	}
-	_, err = d.db.Exec(ins)
-	return err
+	return names, errors.Trace(rows.Err())
 }
@@ -15,8 +15,8 @@ func TestGetAllDatabaseNames(t *testing.T) {
 	sql := "use test; create table t1 (a int)"
 	sql1 := "create database test1"
 
-	os.RemoveAll(defaultTiDBDir)
-	ddl, err := NewDDLHandle(nil)
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
 	assert.Assert(t, err == nil)
 
 	err = ddl.ExecuteDDL(sql)
@@ -38,8 +38,8 @@ func TestGetAllDatabaseNames(t *testing.T) {
 
 func TestResetDB(t *testing.T) {
 	sql := "create database test1"
-	os.RemoveAll(defaultTiDBDir)
-	ddl, err := NewDDLHandle(nil)
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
 	assert.Assert(t, err == nil)
 
 	err = ddl.ResetDB()
@@ -86,8 +86,8 @@ func TestRestore(t *testing.T) {
 func TestGetAllTableNames(t *testing.T) {
 	sql := "create database test1"
 	sql1 := "use test1; create table t1(a int)"
-	os.RemoveAll(defaultTiDBDir)
-	ddl, err := NewDDLHandle(nil)
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
 	ddl.ResetDB()
 	assert.Assert(t, err == nil)
 	err = ddl.ExecuteDDL(sql)
@@ -102,29 +102,39 @@ func TestGetAllTableNames(t *testing.T) {
 	assert.Assert(t, len(s) == 1)
 }
 
-func TestFetchMapKeyFromDB(t *testing.T) {
-	os.RemoveAll(defaultTiDBDir)
-	ddl, err := NewDDLHandle(nil)
-	assert.Assert(t, err == nil)
-	ddl.ResetDB()
-
-	err = ddl.createMapTable()
-	assert.Assert(t, err == nil)
-
-	var key string
-	key, err = ddl.fetchMapKeyFromDB("mt")
-	assert.Assert(t, err == nil)
-	assert.Assert(t, key == "")
-
-	err = ddl.insertMapKeyFromDB("mt", "mt_src")
-	assert.Assert(t, err == nil)
-	key, err = ddl.fetchMapKeyFromDB("mt")
-	assert.Assert(t, err == nil)
-	assert.Assert(t, strings.EqualFold("mt_src", key))
+func TestCheckSchema(t *testing.T) {
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ddl.ResetDB() == nil)
+
+	// the table info tracked in memory is checked with the mock tidb after every ddl
+	ddls := []string{
+		"create database test1",
+		"use test1; create table t1 (id bigint primary key, a int, b int as (a + 1), c varchar(10), unique key uk_c (c))",
+		"use test1; create table t2 (a int, b varchar(10), c int, primary key (a, b), unique key (c), key (a, c))",
+		"use test1; alter table t1 add column d int first",
+		"use test1; alter table t1 add unique index uk_da (d, a)",
+		"use test1; alter table t1 change column d dd bigint",
+		"use test1; alter table t1 add column e int as (dd * 2) after a",
+		"use test1; alter table t1 rename index uk_da to uk_dda",
+		"use test1; create unique index uk_a on t1 (a)",
+		"use test1; drop index uk_c on t1",
+		"use test1; alter table t2 add unique key (c)",
+		"use test1; rename table t2 to t3",
+		"use test1; truncate table t3",
+		"use test; create table t4 like test1.t1",
+		"use test1; drop table t1",
+	}
+	for _, query := range ddls {
+		assert.NilError(t, ddl.ExecuteDDL(query), query)
+	}
 
-	err = ddl.insertMapKeyFromDB("mt_dst", "mt")
-	assert.Assert(t, err == nil)
-	key, err = ddl.fetchMapKeyFromDB("mt_dst")
+	schema, err := ddl.dumpSchema()
 	assert.Assert(t, err == nil)
-	assert.Assert(t, strings.EqualFold("mt_src", key))
+	assert.Assert(t, ddl.ResetDB() == nil)
+	for _, query := range schema {
+		assert.NilError(t, ddl.ExecuteDDL(query), query)
+	}
+	assert.Assert(t, ddl.ResetDB() == nil)
 }
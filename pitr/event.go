@@ -3,6 +3,7 @@ package pitr
 import (
 	"fmt"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
 	"go.uber.org/zap"
@@ -30,58 +31,117 @@ func (e *Event) String() string {
 	return fmt.Sprintf("{schema: %s, table: %s, eventType: %s, oldKey: %s, newKey: %s, isDeleted: %v}", e.schema, e.table, e.eventType, e.oldKey, e.newKey, e.isDeleted)
 }
 
-// Merge two event with same oldKey
-// insert + delete = nil, this event should be ignore
-// insert + update = insert, and need update oldKey
-// update + delete = nil, this event should be ignore
-// update + update = update
-// delete + insert = update
-func (e *Event) Merge(newEvent *Event) {
+// Merge merges newEvent into e, both of them change the same key, the result is the net change of the key.
+// the update which changes the key should be split by splitKeyChange before merge.
+// V0 is the row's value before all the events, V1 and V2 are the values after the events
+//
+//	e \ newEvent   | insert(V2)       | delete      | update(V2)
+//	insert(V1)     | error            | nil         | insert(V2)
+//	update(V0, V1) | error            | delete(V0)  | update(V0, V2)
+//	delete(V0)     | update(V0, V2)   | error       | error
+//	nil            | insert(V2)       | error       | error
+//
+// nil means the key is not changed at all, isDeleted is set to true and e should not be output,
+// but it's still kept to know the key doesn't exist.
+func (e *Event) Merge(newEvent *Event) error {
 	log.Info("merge two event", zap.Stringer("old event", e), zap.Stringer("new event", newEvent))
 	defer log.Info("after merge", zap.Stringer("event", e))
 
-	if e.eventType == pb.EventType_Insert {
+	if e.oldKey != newEvent.oldKey || newEvent.eventType == pb.EventType_Update && newEvent.oldKey != newEvent.newKey {
+		return errors.Errorf("can't merge event %s with different key into %s", newEvent, e)
+	}
+	if len(e.cols) != len(newEvent.cols) {
+		return errors.Errorf("can't merge event %s with %d columns into %s with %d columns", newEvent, len(newEvent.cols), e, len(e.cols))
+	}
+
+	if e.isDeleted {
 		if newEvent.eventType == pb.EventType_Insert {
-			// this should never happened
-		} else if newEvent.eventType == pb.EventType_Delete {
-			// this row is deleted
-			e.isDeleted = true
-		} else if newEvent.eventType == pb.EventType_Update {
-			// update the newValue
+			// the row is inserted again
 			e.eventType = pb.EventType_Insert
-			e.oldToNew(newEvent)
-			e.oldKey = newEvent.newKey
+			e.cols = copyColumns(newEvent.cols, true)
+			e.isDeleted = false
+			return nil
 		}
-	} else if e.eventType == pb.EventType_Update {
-		if newEvent.eventType == pb.EventType_Insert {
-			// this should not be happen
-		} else if newEvent.eventType == pb.EventType_Delete {
-			// this row is deleted
+		return errors.Errorf("can't merge %s event into the inserted and deleted event, the key %s doesn't exist", newEvent.eventType, e.oldKey)
+	}
+
+	switch e.eventType {
+	case pb.EventType_Insert:
+		switch newEvent.eventType {
+		case pb.EventType_Delete:
+			// the inserted row is deleted
 			e.isDeleted = true
-		} else if newEvent.eventType == pb.EventType_Update {
-			// update the newValue
-			e.newToNew(newEvent)
+			return nil
+		case pb.EventType_Update:
+			// still insert, but with the updated value
+			e.cols = copyColumns(newEvent.cols, false)
+			return nil
 		}
-	} else if e.eventType == pb.EventType_Delete {
+	case pb.EventType_Update:
+		switch newEvent.eventType {
+		case pb.EventType_Delete:
+			// delete the row with the value before update
+			e.eventType = pb.EventType_Delete
+			e.cols = copyColumns(e.cols, true)
+			return nil
+		case pb.EventType_Update:
+			for i, col := range newEvent.cols {
+				e.cols[i].ChangedValue = col.ChangedValue
+			}
+			return nil
+		}
+	case pb.EventType_Delete:
 		if newEvent.eventType == pb.EventType_Insert {
-			e.newToNew(newEvent)
+			// the deleted row is inserted again
 			e.eventType = pb.EventType_Update
-		} else if newEvent.eventType == pb.EventType_Delete {
-			// this should never happened
-		} else if newEvent.eventType == pb.EventType_Update {
-			// this should never happened
+			for i, col := range newEvent.cols {
+				e.cols[i].ChangedValue = col.Value
+			}
+			return nil
 		}
 	}
+
+	return errors.Errorf("can't merge %s event into %s event, the key %s is %s", newEvent.eventType, e.eventType, e.oldKey, e.keyState())
 }
 
-func (e *Event) oldToNew(newEvent *Event) {
-	for i, col := range newEvent.cols {
-		e.cols[i].Value = col.ChangedValue
+// keyState describes whether the key exists after e, used in error message
+func (e *Event) keyState() string {
+	if e.eventType == pb.EventType_Delete {
+		return "deleted"
 	}
+	return "existed"
 }
 
-func (e *Event) newToNew(newEvent *Event) {
-	for i, col := range newEvent.cols {
-		e.cols[i].ChangedValue = col.ChangedValue
+// splitKeyChange splits the update which changes the key into
+// a delete of the old key with the old value and an insert of the new key with the new value
+func (e *Event) splitKeyChange() (*Event, *Event) {
+	del := &Event{
+		schema:    e.schema,
+		table:     e.table,
+		eventType: pb.EventType_Delete,
+		oldKey:    e.oldKey,
+		cols:      copyColumns(e.cols, true),
+	}
+	ins := &Event{
+		schema:    e.schema,
+		table:     e.table,
+		eventType: pb.EventType_Insert,
+		oldKey:    e.newKey,
+		cols:      copyColumns(e.cols, false),
+	}
+	return del, ins
+}
+
+// copyColumns returns the columns with only Value, which is set to the old value or the changed value of cols
+func copyColumns(cols []*pb.Column, old bool) []*pb.Column {
+	newCols := make([]*pb.Column, 0, len(cols))
+	for _, col := range cols {
+		newCol := *col
+		if !old {
+			newCol.Value = col.ChangedValue
+		}
+		newCol.ChangedValue = nil
+		newCols = append(newCols, &newCol)
 	}
+	return newCols
 }
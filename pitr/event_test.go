@@ -0,0 +1,279 @@
+package pitr
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+// testRowKey returns the key of the row in table test.t with primary key a
+func testRowKey(a int64) string {
+	return fmt.Sprintf("test|t|%d|", a)
+}
+
+// newTestEvent returns the event of the row (a, b), the update changes it to (newA, newB)
+func newTestEvent(tp pb.EventType, a, b, newA, newB int64) *Event {
+	cols := []*pb.Column{
+		{Name: "a", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(a)},
+		{Name: "b", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(b)},
+	}
+	ev := &Event{
+		schema:    "test",
+		table:     "t",
+		eventType: tp,
+		oldKey:    testRowKey(a),
+		cols:      cols,
+	}
+	if tp == pb.EventType_Update {
+		cols[0].ChangedValue = encodeIntValue(newA)
+		cols[1].ChangedValue = encodeIntValue(newB)
+		ev.newKey = testRowKey(newA)
+	}
+	return ev
+}
+
+// decodeTestRow returns the value of a and b in cols, or the changed value if changed is true
+func decodeTestRow(t *testing.T, cols []*pb.Column, changed bool) (int64, int64) {
+	var values []int64
+	for _, col := range cols {
+		data := col.Value
+		if changed {
+			data = col.ChangedValue
+		}
+		_, val, err := codec.DecodeOne(data)
+		assert.Assert(t, err == nil)
+		values = append(values, val.GetInt64())
+	}
+	return values[0], values[1]
+}
+
+func TestEventMerge(t *testing.T) {
+	insert := func(b int64) *Event { return newTestEvent(pb.EventType_Insert, 1, b, 0, 0) }
+	del := func(b int64) *Event { return newTestEvent(pb.EventType_Delete, 1, b, 0, 0) }
+	update := func(b, newB int64) *Event { return newTestEvent(pb.EventType_Update, 1, b, 1, newB) }
+	// the row is inserted and then deleted
+	none := func() *Event {
+		ev := insert(1)
+		ev.isDeleted = true
+		return ev
+	}
+
+	cases := []struct {
+		old       *Event
+		new       *Event
+		err       bool
+		isDeleted bool
+		tp        pb.EventType
+		// the value before all the events and the value after, -1 means not exist
+		before int64
+		after  int64
+	}{
+		{old: insert(1), new: insert(2), err: true},
+		{old: insert(1), new: del(1), isDeleted: true},
+		{old: insert(1), new: update(1, 2), tp: pb.EventType_Insert, before: -1, after: 2},
+		{old: update(1, 2), new: insert(3), err: true},
+		{old: update(1, 2), new: del(2), tp: pb.EventType_Delete, before: 1, after: -1},
+		{old: update(1, 2), new: update(2, 3), tp: pb.EventType_Update, before: 1, after: 3},
+		{old: del(1), new: insert(2), tp: pb.EventType_Update, before: 1, after: 2},
+		{old: del(1), new: del(1), err: true},
+		{old: del(1), new: update(1, 2), err: true},
+		{old: none(), new: insert(2), tp: pb.EventType_Insert, before: -1, after: 2},
+		{old: none(), new: del(1), err: true},
+		{old: none(), new: update(1, 2), err: true},
+	}
+
+	for i, cs := range cases {
+		msg := fmt.Sprintf("case %d: %s + %s", i, cs.old.eventType, cs.new.eventType)
+		err := cs.old.Merge(cs.new)
+		if cs.err {
+			assert.Assert(t, err != nil, msg)
+			continue
+		}
+		assert.Assert(t, err == nil, msg)
+		assert.Equal(t, cs.old.isDeleted, cs.isDeleted, msg)
+		if cs.isDeleted {
+			continue
+		}
+
+		assert.Equal(t, cs.old.eventType, cs.tp, msg)
+		switch cs.tp {
+		case pb.EventType_Insert:
+			_, b := decodeTestRow(t, cs.old.cols, false)
+			assert.Equal(t, b, cs.after, msg)
+		case pb.EventType_Delete:
+			_, b := decodeTestRow(t, cs.old.cols, false)
+			assert.Equal(t, b, cs.before, msg)
+		case pb.EventType_Update:
+			_, b := decodeTestRow(t, cs.old.cols, false)
+			assert.Equal(t, b, cs.before, msg)
+			_, b = decodeTestRow(t, cs.old.cols, true)
+			assert.Equal(t, b, cs.after, msg)
+		}
+	}
+
+	// the update which changes key can't be merged directly
+	err := insert(1).Merge(newTestEvent(pb.EventType_Update, 1, 1, 2, 1))
+	assert.Assert(t, err != nil)
+}
+
+// testOp is an operation on the rows of table test.t, the row's primary key is changed from `from` to `to`
+type testOp struct {
+	tp   pb.EventType
+	from int64
+	to   int64
+}
+
+func (op testOp) String() string {
+	return fmt.Sprintf("%s(%d->%d)", op.tp, op.from, op.to)
+}
+
+// replayTestOps applies the ops on the rows one by one, and returns the events of them.
+// valid is false if any op can't be applied, and known is true if the op conflicts with
+// the previous ops, which means the conflict can be found without the rows before the ops.
+func replayTestOps(rows map[int64]int64, ops []testOp) (events []*Event, valid bool, known bool) {
+	touched := make(map[int64]bool)
+	check := func(a int64, exist bool) bool {
+		_, ok := rows[a]
+		if ok == exist {
+			return true
+		}
+		known = known || touched[a]
+		return false
+	}
+
+	valid = true
+	for i, op := range ops {
+		// every op sets b to a different value
+		b := int64(1000 + i)
+		switch op.tp {
+		case pb.EventType_Insert:
+			valid = check(op.to, false) && valid
+			events = append(events, newTestEvent(op.tp, op.to, b, 0, 0))
+			rows[op.to] = b
+		case pb.EventType_Delete:
+			valid = check(op.from, true) && valid
+			events = append(events, newTestEvent(op.tp, op.from, rows[op.from], 0, 0))
+			delete(rows, op.from)
+		case pb.EventType_Update:
+			valid = check(op.from, true) && valid
+			if op.to != op.from {
+				valid = check(op.to, false) && valid
+			}
+			events = append(events, newTestEvent(op.tp, op.from, rows[op.from], op.to, b))
+			delete(rows, op.from)
+			rows[op.to] = b
+		}
+		touched[op.from] = true
+		touched[op.to] = true
+	}
+	return
+}
+
+// applyTestEvents applies the merged events on the rows, returns false if any event can't be applied
+func applyTestEvents(t *testing.T, rows map[int64]int64, events []*Event) bool {
+	for _, ev := range events {
+		a, b := decodeTestRow(t, ev.cols, false)
+		_, ok := rows[a]
+		switch ev.eventType {
+		case pb.EventType_Insert:
+			if ok {
+				return false
+			}
+			rows[a] = b
+		case pb.EventType_Delete:
+			if !ok || rows[a] != b {
+				return false
+			}
+			delete(rows, a)
+		case pb.EventType_Update:
+			newA, newB := decodeTestRow(t, ev.cols, true)
+			if !ok || rows[a] != b || newA != a {
+				return false
+			}
+			rows[a] = newB
+		}
+	}
+	return true
+}
+
+func copyTestRows(rows map[int64]int64) map[int64]int64 {
+	newRows := make(map[int64]int64, len(rows))
+	for a, b := range rows {
+		newRows[a] = b
+	}
+	return newRows
+}
+
+// TestReduceReplay merges every combination of at most 3 ops on 2 rows, and compares
+// the rows after replaying the merged events with the rows after replaying the ops one by one
+func TestReduceReplay(t *testing.T) {
+	allOps := []testOp{
+		{pb.EventType_Insert, 1, 1}, {pb.EventType_Insert, 2, 2},
+		{pb.EventType_Delete, 1, 1}, {pb.EventType_Delete, 2, 2},
+		{pb.EventType_Update, 1, 1}, {pb.EventType_Update, 2, 2},
+		{pb.EventType_Update, 1, 2}, {pb.EventType_Update, 2, 1},
+	}
+	initRows := []map[int64]int64{
+		{}, {1: 100}, {2: 200}, {1: 100, 2: 200},
+	}
+
+	var sequences [][]testOp
+	var gen func(ops []testOp)
+	gen = func(ops []testOp) {
+		if len(ops) != 0 {
+			sequences = append(sequences, ops)
+		}
+		if len(ops) == 3 {
+			return
+		}
+		for _, op := range allOps {
+			gen(append(append([]testOp{}, ops...), op))
+		}
+	}
+	gen(nil)
+
+	var validNum int
+	for _, ops := range sequences {
+		for _, init := range initRows {
+			msg := fmt.Sprintf("ops %v on rows %v", ops, init)
+			expect := copyTestRows(init)
+			events, valid, known := replayTestOps(expect, ops)
+
+			r := newReducer(nil, defaultMaxMemory, "")
+			var err error
+			for _, ev := range events {
+				if err = r.HandleEvent(ev); err != nil {
+					break
+				}
+			}
+			if !valid {
+				// the conflict with the rows before the ops can't be found
+				if known {
+					assert.Assert(t, err != nil, msg)
+				}
+				continue
+			}
+			validNum++
+			assert.Assert(t, err == nil, msg)
+
+			var merged []*Event
+			keys := make(map[string]bool)
+			err = r.iterateEvents(func(ev *Event) error {
+				merged = append(merged, ev)
+				assert.Assert(t, !keys[ev.oldKey], msg)
+				keys[ev.oldKey] = true
+				return nil
+			})
+			assert.Assert(t, err == nil, msg)
+
+			rows := copyTestRows(init)
+			assert.Assert(t, applyTestEvents(t, rows, merged), msg)
+			assert.DeepEqual(t, rows, expect)
+		}
+	}
+	assert.Assert(t, validNum > 0)
+}
@@ -0,0 +1,275 @@
+package pitr
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+const (
+	// exportOpColumn is the column of the operation type, upsert or delete
+	exportOpColumn = "_op"
+	// exportCommitTSColumn is the column of the binlog's commit ts
+	exportCommitTSColumn = "_commit_ts"
+
+	exportOpUpsert = "upsert"
+	exportOpDelete = "delete"
+)
+
+// exportSink saves the final row images of the merged events as data files, the ddls are not saved.
+// every row has the operation type (upsert for insert and update, delete for delete), the commit ts,
+// and the columns of the table in the order of tableInfo.columns.
+//
+// in csv format, the files are named like test_t1-000000.csv, the first line is the header.
+// in columnar format, the files of a row group are in a directory named like test_t1-000000,
+// and every column is saved in its own file named like col-0000.csv, which has the column name as header.
+// a new file is created when the size exceeds maxFileSize, or after a ddl so the header is always the current columns.
+//
+// the values are encoded as below:
+//   - NULL is an empty field, and the empty string is "", so they are different
+//   - the numbers and decimals are not quoted
+//   - the strings, times and json are quoted with ", and the " inside is doubled
+//   - the binary strings, blobs and the strings which are not valid utf8 are in hex like 0x00ff, not quoted
+//   - the enums and sets are their index numbers and bitmasks, and the bits are unsigned integers
+//   - the dates, datetimes, times and timestamps are as they're saved in the binlog, without time zone.
+//     the timestamps are in the local time zone of the drainer which writes the binlog, because drainer
+//     decodes the rows with time.Local, so they should be read in the drainer's time zone
+type exportSink struct {
+	dir         string
+	columnar    bool
+	maxFileSize int64
+
+	getTableInfo func(schema, table string, commitTS int64) (*tableInfo, error)
+
+	seq int
+	// info is the table info of the opened files, the files are reopened if the table info changes
+	info  *tableInfo
+	files []*os.File
+	ws    []*bufio.Writer
+	size  int64
+}
+
+func newExportSink(dir string, columnar bool, maxFileSize int64, getTableInfo func(schema, table string, commitTS int64) (*tableInfo, error)) (*exportSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &exportSink{
+		dir:          dir,
+		columnar:     columnar,
+		maxFileSize:  maxFileSize,
+		getTableInfo: getTableInfo,
+	}, nil
+}
+
+// openFiles creates the files of the table, and writes the header
+func (s *exportSink) openFiles(info *tableInfo) error {
+	header := append([]string{exportOpColumn, exportCommitTSColumn}, info.columns...)
+	name := path.Join(s.dir, fmt.Sprintf("%s-%06d", path.Base(s.dir), s.seq))
+
+	var names []string
+	if s.columnar {
+		if err := os.MkdirAll(name, 0755); err != nil {
+			return errors.Trace(err)
+		}
+		for i := range header {
+			names = append(names, path.Join(name, fmt.Sprintf("col-%04d.csv", i)))
+		}
+	} else {
+		names = []string{name + ".csv"}
+	}
+
+	s.info = info
+	s.size = 0
+	for _, name := range names {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s.files = append(s.files, f)
+		s.ws = append(s.ws, bufio.NewWriter(f))
+	}
+
+	quoted := make([]string, 0, len(header))
+	for _, name := range header {
+		quoted = append(quoted, quoteCSVString(name))
+	}
+	_, err := s.writeRow(quoted)
+	return errors.Trace(err)
+}
+
+func (s *exportSink) closeFiles() error {
+	var firstErr error
+	for i, f := range s.files {
+		err := s.ws[i].Flush()
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(s.files) != 0 {
+		s.seq++
+	}
+	s.info = nil
+	s.files = nil
+	s.ws = nil
+	return errors.Trace(firstErr)
+}
+
+// writeRow writes the fields as a line of the csv file, or a line of every column's file
+func (s *exportSink) writeRow(fields []string) (int64, error) {
+	var size int64
+	if !s.columnar {
+		n, err := fmt.Fprintln(s.ws[0], strings.Join(fields, ","))
+		return int64(n), errors.Trace(err)
+	}
+	for i, field := range fields {
+		n, err := fmt.Fprintln(s.ws[i], field)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		size += int64(n)
+	}
+	return size, nil
+}
+
+func (s *exportSink) write(binlog *pb.Binlog) (int64, error) {
+	if binlog.Tp == pb.BinlogType_DDL {
+		return 0, errors.Trace(s.closeFiles())
+	}
+
+	var size int64
+	for i := range binlog.DmlData.GetEvents() {
+		ev := &binlog.DmlData.Events[i]
+		info, err := s.getTableInfo(ev.GetSchemaName(), ev.GetTableName(), binlog.CommitTs)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		fields, err := renderExportRow(ev, info, binlog.CommitTs)
+		if err != nil {
+			return 0, errors.Annotatef(err, "render row of binlog with commit ts %d failed", binlog.CommitTs)
+		}
+
+		if s.info != info {
+			if err := s.closeFiles(); err != nil {
+				return 0, errors.Trace(err)
+			}
+			if err := s.openFiles(info); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+		n, err := s.writeRow(fields)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		size += n
+		s.size += n
+		if s.size >= s.maxFileSize {
+			if err := s.closeFiles(); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+	}
+	return size, nil
+}
+
+func (s *exportSink) close() error {
+	return errors.Trace(s.closeFiles())
+}
+
+// renderExportRow returns the fields of the event's row image, the new values are used for update,
+// and the columns not in the event are NULL
+func renderExportRow(ev *pb.Event, info *tableInfo, commitTS int64) ([]string, error) {
+	op := exportOpUpsert
+	if ev.GetTp() == pb.EventType_Delete {
+		op = exportOpDelete
+	}
+
+	valueOf := make(map[string]string, len(info.columns))
+	for _, c := range ev.GetRow() {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		data := col.Value
+		if ev.GetTp() == pb.EventType_Update {
+			data = col.ChangedValue
+		}
+		value, err := formatExportValue(col, data)
+		if err != nil {
+			return nil, errors.Annotatef(err, "format value of column %s failed", col.Name)
+		}
+		valueOf[col.Name] = value
+	}
+
+	fields := make([]string, 0, len(info.columns)+2)
+	fields = append(fields, op, strconv.FormatInt(commitTS, 10))
+	for _, name := range info.columns {
+		fields = append(fields, valueOf[name])
+	}
+	return fields, nil
+}
+
+// formatExportValue renders the encoded value of the column as a csv field, see exportSink for the encoding
+func formatExportValue(col *pb.Column, data []byte) (string, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if val.IsNull() {
+		return "", nil
+	}
+
+	tp := col.Tp[0]
+	switch v := val.GetValue().(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case *types.MyDecimal:
+		return v.String(), nil
+	case types.BinaryLiteral:
+		return "0x" + hex.EncodeToString(v), nil
+	case string:
+		if tp == mysql.TypeDecimal || tp == mysql.TypeNewDecimal {
+			return v, nil
+		}
+		return quoteCSVString(v), nil
+	case []byte:
+		if isBinaryType(col.MysqlType) || !utf8.Valid(v) {
+			return "0x" + hex.EncodeToString(v), nil
+		}
+		if tp == mysql.TypeDecimal || tp == mysql.TypeNewDecimal {
+			return string(v), nil
+		}
+		return quoteCSVString(string(v)), nil
+	default:
+		return quoteCSVString(fmt.Sprintf("%v", v)), nil
+	}
+}
+
+// quoteCSVString quotes the string with ", and doubles the " inside
+func quoteCSVString(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,93 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestFormatExportValue(t *testing.T) {
+	for _, c := range []struct {
+		tp        byte
+		mysqlType string
+		value     interface{}
+		expected  string
+	}{
+		{mysql.TypeLong, "int", nil, ""},
+		{mysql.TypeLong, "int", int64(-1), "-1"},
+		{mysql.TypeNewDecimal, "decimal", "12.340", "12.340"},
+		{mysql.TypeTimestamp, "timestamp", "2019-10-01 12:00:00", `"2019-10-01 12:00:00"`},
+		{mysql.TypeEnum, "enum", uint64(2), "2"},
+		{mysql.TypeBit, "bit", uint64(5), "5"},
+		{mysql.TypeJSON, "json", `{"a": 1}`, `"{""a"": 1}"`},
+		{mysql.TypeVarchar, "varchar", []byte(""), `""`},
+		{mysql.TypeVarchar, "varchar", []byte("a,b\n"), "\"a,b\n\""},
+		{mysql.TypeVarchar, "varbinary", []byte("ab"), "0x6162"},
+		{mysql.TypeString, "char", []byte{0xff}, "0xff"},
+	} {
+		col := &pb.Column{Tp: []byte{c.tp}, MysqlType: c.mysqlType}
+		value, err := formatExportValue(col, encodeDatum(t, c.value))
+		assert.Assert(t, err == nil, err)
+		assert.Equal(t, value, c.expected, "type %s", c.mysqlType)
+	}
+}
+
+func TestExportSink(t *testing.T) {
+	dir := "./exportsinktest/test_tbx"
+	os.RemoveAll("./exportsinktest")
+	defer os.RemoveAll("./exportsinktest")
+
+	info := &tableInfo{schema: "test", table: "tbx", columns: []string{"a", "b", "c"}}
+	newInfo := &tableInfo{schema: "test", table: "tbx", columns: []string{"a", "b", "c", "d"}}
+	getTableInfo := func(schema, table string, commitTS int64) (*tableInfo, error) { return info, nil }
+
+	schema, table := "test", "tbx"
+	dml := genTestRowDML(schema, table, pb.EventType_Delete, []int64{1}, 200)
+	dml.DmlData.Events = append(dml.DmlData.Events, pb.Event{
+		Tp: pb.EventType_Update, SchemaName: &schema, TableName: &table, Row: generateRow(2, 2, 2, 5),
+	})
+	binlogs := []*pb.Binlog{
+		genTestDDL(schema, table, "use test;create table tbx (a int primary key, b int, c int);", 100),
+		dml,
+		genTestDDL(schema, table, "alter table test.tbx add column d int", 300),
+		genTestRowDML(schema, table, pb.EventType_Insert, []int64{3}, 310),
+	}
+	write := func(s sink) {
+		for _, bin := range binlogs {
+			if bin.Tp == pb.BinlogType_DDL && bin.CommitTs == 300 {
+				info = newInfo
+			}
+			_, err := s.write(bin)
+			assert.Assert(t, err == nil, err)
+		}
+		assert.Assert(t, s.close() == nil)
+	}
+	readFile := func(name string) string {
+		data, err := ioutil.ReadFile(name)
+		assert.Assert(t, err == nil, err)
+		return string(data)
+	}
+
+	s, err := newExportSink(dir, false, 1024, getTableInfo)
+	assert.Assert(t, err == nil)
+	write(s)
+	// a new file is created after the ddl, and the missing column is NULL
+	assert.Equal(t, readFile(dir+"/test_tbx-000000.csv"), `"_op","_commit_ts","a","b","c"`+"\n"+
+		"delete,200,1,1,1\n"+
+		"upsert,200,2,2,5\n")
+	assert.Equal(t, readFile(dir+"/test_tbx-000001.csv"), `"_op","_commit_ts","a","b","c","d"`+"\n"+
+		"upsert,310,3,3,3,\n")
+
+	os.RemoveAll(dir)
+	info = &tableInfo{schema: "test", table: "tbx", columns: []string{"a", "b", "c"}}
+	s, err = newExportSink(dir, true, 1024, getTableInfo)
+	assert.Assert(t, err == nil)
+	write(s)
+	assert.Equal(t, readFile(dir+"/test_tbx-000000/col-0000.csv"), "\"_op\"\ndelete\nupsert\n")
+	assert.Equal(t, readFile(dir+"/test_tbx-000000/col-0004.csv"), "\"c\"\n1\n5\n")
+	assert.Equal(t, readFile(dir+"/test_tbx-000001/col-0005.csv"), "\"d\"\n\n")
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
@@ -29,6 +30,43 @@ func searchFiles(dir string) ([]string, error) {
 	return binlogFiles, nil
 }
 
+// searchBinlogDirs returns the directories which contain binlog files. it's dir itself if the binlog files are in it,
+// otherwise it's the sub directories like the output of compact, and the database level directories are in front.
+func searchBinlogDirs(dir string) ([]string, error) {
+	names, err := bf.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(bf.FilterBinlogNames(names)) != 0 {
+		return []string{dir}, nil
+	}
+
+	subDirs, err := readSubDirs(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var dbDirs, tableDirs []string
+	for _, subDir := range subDirs {
+		names, err := bf.ReadDir(path.Join(dir, subDir))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(bf.FilterBinlogNames(names)) == 0 {
+			continue
+		}
+		if strings.HasSuffix(subDir, "_") {
+			dbDirs = append(dbDirs, path.Join(dir, subDir))
+		} else {
+			tableDirs = append(tableDirs, path.Join(dir, subDir))
+		}
+	}
+	if len(dbDirs) == 0 && len(tableDirs) == 0 {
+		return nil, errors.Errorf("no binlog file found in %s", dir)
+	}
+
+	return append(dbDirs, tableDirs...), nil
+}
+
 // filterFiles assume fileNames is sorted by commit time stamp,
 // and may filter files not not overlap with [startTS, endTS]
 func filterFiles(fileNames []string, startTS int64, endTS int64) ([]string, int64, error) {
@@ -0,0 +1,368 @@
+package pitr
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	parsertypes "github.com/pingcap/parser/types"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+const (
+	eventTypeInsert = "insert"
+	eventTypeUpdate = "update"
+	eventTypeDelete = "delete"
+	eventTypeDDL    = "ddl"
+)
+
+// Inspector prints the binlogs in data dir, it can read the original binlogs and the merged binlogs
+type Inspector struct {
+	cfg *Config
+
+	filter *filter.Filter
+
+	// tablesFilter only keeps the tables in cfg.Tables, it's nil if cfg.Tables is empty
+	tablesFilter *filter.Filter
+
+	// eventTypes is the set of event types to print, all the events are printed if it's nil
+	eventTypes map[string]bool
+
+	out io.Writer
+}
+
+// inspectBinlog is a binlog printed in json
+type inspectBinlog struct {
+	CommitTs int64          `json:"commit-ts"`
+	Datetime string         `json:"datetime"`
+	Type     string         `json:"type"`
+	DDLQuery string         `json:"ddl-query,omitempty"`
+	Events   []inspectEvent `json:"events,omitempty"`
+}
+
+// inspectEvent is a dml event printed in json
+type inspectEvent struct {
+	Schema  string          `json:"schema"`
+	Table   string          `json:"table"`
+	Type    string          `json:"type"`
+	Columns []inspectColumn `json:"columns"`
+}
+
+// inspectColumn is a column of dml event printed in json, the changed value is only set for update
+type inspectColumn struct {
+	Name         string      `json:"name"`
+	MysqlType    string      `json:"mysql-type"`
+	Value        interface{} `json:"value"`
+	ChangedValue interface{} `json:"changed-value,omitempty"`
+}
+
+// NewInspector creates a Inspector object, the binlogs are printed to stdout.
+func NewInspector(cfg *Config) (*Inspector, error) {
+	log.Info("New Inspector", zap.Stringer("config", cfg))
+
+	tablesFilter, err := parseTableNames(cfg.Tables)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	eventTypes, err := parseEventTypes(cfg.EventTypes)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &Inspector{
+		cfg:          cfg,
+		filter:       filter.NewFilter(cfg.IgnoreDBs, cfg.IgnoreTables, cfg.DoDBs, cfg.DoTables),
+		tablesFilter: tablesFilter,
+		eventTypes:   eventTypes,
+		out:          os.Stdout,
+	}, nil
+}
+
+// Process prints the binlogs with commit ts in [start ts, stop ts],
+// one line for a ddl or a dml event in text format, and one line for a binlog in json format
+func (i *Inspector) Process() error {
+	if err := checkManifest(i.cfg.Dir); err != nil {
+		return errors.Trace(err)
+	}
+
+	dirs, err := searchBinlogDirs(i.cfg.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	w := bufio.NewWriter(i.out)
+	err = readBinlogDirs(dirs, i.cfg.StartTSO, i.cfg.StopTSO, func(binlog *pb.Binlog) error {
+		if i.cfg.InspectConfig.Format == "json" {
+			return i.printJSONBinlog(w, binlog)
+		}
+		return i.printBinlog(w, binlog)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(w.Flush())
+}
+
+// Close closes the Inspector object.
+func (i *Inspector) Close() error {
+	return nil
+}
+
+// printBinlog prints the binlog like:
+// 400 1970-01-01 08:00:00 DDL use test; create table t (a int primary key, b int)
+// 401 1970-01-01 08:00:00 Insert `test`.`t` a=1, b=2
+// 401 1970-01-01 08:00:00 Update `test`.`t` a=1, b=2->3
+func (i *Inspector) printBinlog(w io.Writer, binlog *pb.Binlog) error {
+	if binlog.Tp == pb.BinlogType_DDL {
+		if i.skipDDL(binlog) {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "%d %s DDL %s\n", binlog.CommitTs, tsToDatetime(binlog.CommitTs), binlog.DdlQuery)
+		return errors.Trace(err)
+	}
+
+	for _, ev := range binlog.DmlData.GetEvents() {
+		if i.skipEvent(&ev) {
+			continue
+		}
+		row, err := formatTextRow(ev.GetRow(), ev.GetTp() == pb.EventType_Update)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, err = fmt.Fprintf(w, "%d %s %s %s %s\n", binlog.CommitTs, tsToDatetime(binlog.CommitTs), ev.GetTp(), quoteSchema(ev.GetSchemaName(), ev.GetTableName()), row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// printJSONBinlog prints the binlog as a json object in one line, the binlog is skipped if all the events are filtered
+func (i *Inspector) printJSONBinlog(w io.Writer, binlog *pb.Binlog) error {
+	ib := &inspectBinlog{
+		CommitTs: binlog.CommitTs,
+		Datetime: tsToDatetime(binlog.CommitTs),
+		Type:     binlog.Tp.String(),
+	}
+	if binlog.Tp == pb.BinlogType_DDL {
+		if i.skipDDL(binlog) {
+			return nil
+		}
+		ib.DDLQuery = string(binlog.DdlQuery)
+	} else {
+		for _, ev := range binlog.DmlData.GetEvents() {
+			if i.skipEvent(&ev) {
+				continue
+			}
+			columns, err := formatJSONColumns(ev.GetRow(), ev.GetTp() == pb.EventType_Update)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ib.Events = append(ib.Events, inspectEvent{
+				Schema:  ev.GetSchemaName(),
+				Table:   ev.GetTableName(),
+				Type:    ev.GetTp().String(),
+				Columns: columns,
+			})
+		}
+		if len(ib.Events) == 0 {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(ib)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return errors.Trace(err)
+}
+
+// skipDDL returns true if the ddl should not be printed, the ddl which can't be parsed is always printed,
+// and the ddl changes several tables like `drop table a, b` is skipped only if all the tables are skipped
+func (i *Inspector) skipDDL(binlog *pb.Binlog) bool {
+	if i.eventTypes != nil && !i.eventTypes[eventTypeDDL] {
+		return true
+	}
+	tables, err := ddlTables(string(binlog.DdlQuery))
+	if err != nil {
+		return false
+	}
+	for _, table := range tables {
+		if !i.skipTable(table.Schema, table.Table) {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *Inspector) skipEvent(ev *pb.Event) bool {
+	if i.eventTypes != nil && !i.eventTypes[strings.ToLower(ev.GetTp().String())] {
+		return true
+	}
+	return i.skipTable(ev.GetSchemaName(), ev.GetTableName())
+}
+
+func (i *Inspector) skipTable(schema, table string) bool {
+	if i.filter.SkipSchemaAndTable(schema, table) {
+		return true
+	}
+	return i.tablesFilter != nil && i.tablesFilter.SkipSchemaAndTable(schema, table)
+}
+
+// parseTableNames parses the tables like "db1.table1,db2.*" to a filter, "db.*" means all the tables in db.
+// it returns nil if tables is empty.
+func parseTableNames(tables string) (*filter.Filter, error) {
+	if len(strings.TrimSpace(tables)) == 0 {
+		return nil, nil
+	}
+
+	var (
+		doDBs    []string
+		doTables []filter.TableName
+	)
+	for _, name := range strings.Split(tables, ",") {
+		name = strings.TrimSpace(name)
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, errors.Errorf("invalid table name %s, should be like db.table or db.*", name)
+		}
+		if parts[1] == "*" {
+			doDBs = append(doDBs, parts[0])
+		} else {
+			doTables = append(doTables, filter.TableName{Schema: parts[0], Table: parts[1]})
+		}
+	}
+
+	return filter.NewFilter(nil, nil, doDBs, doTables), nil
+}
+
+// parseEventTypes parses the event types like "insert,ddl" to a set, it returns nil if types is empty.
+func parseEventTypes(types string) (map[string]bool, error) {
+	if len(strings.TrimSpace(types)) == 0 {
+		return nil, nil
+	}
+
+	eventTypes := make(map[string]bool)
+	for _, tp := range strings.Split(types, ",") {
+		tp = strings.ToLower(strings.TrimSpace(tp))
+		switch tp {
+		case eventTypeInsert, eventTypeUpdate, eventTypeDelete, eventTypeDDL:
+			eventTypes[tp] = true
+		default:
+			return nil, errors.Errorf("invalid event type %s, should be one of insert, update, delete and ddl", tp)
+		}
+	}
+	return eventTypes, nil
+}
+
+// tsToDatetime returns the physical time of the tso in local time zone
+func tsToDatetime(ts int64) string {
+	return oracle.GetTimeFromTS(uint64(ts)).Format(timeFormat)
+}
+
+// formatTextRow returns the columns like "a=1, b='x'", the changed values of update are printed after "->"
+func formatTextRow(row [][]byte, update bool) (string, error) {
+	cols := make([]string, 0, len(row))
+	for _, c := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return "", errors.Trace(err)
+		}
+
+		value, err := formatTextValue(col.Value, col.Tp[0])
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if update {
+			changed, err := formatTextValue(col.ChangedValue, col.Tp[0])
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			if changed != value {
+				value += "->" + changed
+			}
+		}
+		cols = append(cols, col.Name+"="+value)
+	}
+	return strings.Join(cols, ", "), nil
+}
+
+// formatTextValue decodes the value, the strings are quoted, the binary is printed in hex and null is printed as NULL
+func formatTextValue(data []byte, tp byte) (string, error) {
+	val, err := decodeInspectValue(data, tp)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	switch v := val.(type) {
+	case nil:
+		return "NULL", nil
+	case hexString:
+		return string(v), nil
+	case string:
+		return strconv.Quote(v), nil
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
+
+// formatJSONColumns decodes the columns in row, the changed values are only decoded for update
+func formatJSONColumns(row [][]byte, update bool) ([]inspectColumn, error) {
+	columns := make([]inspectColumn, 0, len(row))
+	for _, c := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ic := inspectColumn{Name: col.Name, MysqlType: col.MysqlType}
+		if len(ic.MysqlType) == 0 {
+			ic.MysqlType = parsertypes.TypeStr(col.Tp[0])
+		}
+		var err error
+		if ic.Value, err = decodeInspectValue(col.Value, col.Tp[0]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if update {
+			if ic.ChangedValue, err = decodeInspectValue(col.ChangedValue, col.Tp[0]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		columns = append(columns, ic)
+	}
+	return columns, nil
+}
+
+// hexString is the binary value printed in hex, it's not quoted in text format
+type hexString string
+
+// decodeInspectValue decodes the value, the bytes are converted to string, or hex like "0x0102" if it's not valid utf8
+func decodeInspectValue(data []byte, tp byte) (interface{}, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	val = formatValue(val, tp)
+
+	v := val.GetValue()
+	if b, ok := v.([]byte); ok {
+		if utf8.Valid(b) {
+			return string(b), nil
+		}
+		return hexString("0x" + hex.EncodeToString(b)), nil
+	}
+	return v, nil
+}
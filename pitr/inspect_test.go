@@ -0,0 +1,114 @@
+package pitr
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"gotest.tools/assert"
+)
+
+func TestInspect(t *testing.T) {
+	dir := "./inspecttest"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	update := &pb.Binlog{Tp: pb.BinlogType_DML, CommitTs: 300, DmlData: &pb.DMLData{Events: []pb.Event{{
+		Tp: pb.EventType_Update, SchemaName: strPtr("test"), TableName: strPtr("tb1"), Row: generateRow(1, 1, 1, 5),
+	}}}}
+	// the binlogs are saved like the output of compact
+	for _, sub := range []struct {
+		dir  string
+		bins []*pb.Binlog
+	}{
+		{"test_", []*pb.Binlog{genTestDDL("test", "", "create database test", 100)}},
+		{"test_tb1", []*pb.Binlog{
+			genTestDDL("test", "tb1", "use test;create table tb1 (a int primary key, b int, c int)", 101),
+			genTestRowDML("test", "tb1", pb.EventType_Insert, []int64{1}, 200),
+			update,
+		}},
+		{"test_tb2", []*pb.Binlog{
+			genTestRowDML("test", "tb2", pb.EventType_Delete, []int64{2}, 201),
+			genTestDDL("test", "tb2", "use test;drop table tb3, tb2", 400),
+		}},
+	} {
+		b, err := OpenMyBinlogger(dir + "/" + sub.dir)
+		assert.Assert(t, err == nil)
+		for _, bin := range sub.bins {
+			data, _ := bin.Marshal()
+			_, err = b.WriteTail(&tb.Entity{Payload: data})
+			assert.Assert(t, err == nil)
+		}
+		b.Close()
+	}
+
+	cfg := NewConfig()
+	cfg.Dir = dir
+	inspector, err := NewInspector(cfg)
+	assert.Assert(t, err == nil)
+	var out bytes.Buffer
+	inspector.out = &out
+	err = inspector.Process()
+	assert.Assert(t, err == nil, err)
+	dt := tsToDatetime(0)
+	assert.Equal(t, out.String(), `100 `+dt+` DDL create database test
+101 `+dt+` DDL use test;create table tb1 (a int primary key, b int, c int)
+200 `+dt+` Insert `+"`test`.`tb1`"+` a=1, b=1, c=1
+300 `+dt+` Update `+"`test`.`tb1`"+` a=1, b=1, c=1->5
+201 `+dt+` Delete `+"`test`.`tb2`"+` a=2, b=2, c=2
+400 `+dt+` DDL use test;drop table tb3, tb2
+`)
+
+	// the ddl is printed if any table changed by it is given
+	cfg.Tables = "test.tb2"
+	inspector, err = NewInspector(cfg)
+	assert.Assert(t, err == nil)
+	inspector.out = &out
+	out.Reset()
+	err = inspector.Process()
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, out.String(), `201 `+dt+` Delete `+"`test`.`tb2`"+` a=2, b=2, c=2
+400 `+dt+` DDL use test;drop table tb3, tb2
+`)
+
+	// only the update and delete events of the given tables are printed in json
+	cfg.InspectConfig.Format = "json"
+	cfg.Tables = "test.tb1,other.*"
+	cfg.EventTypes = "update,delete"
+	inspector, err = NewInspector(cfg)
+	assert.Assert(t, err == nil)
+	inspector.out = &out
+	out.Reset()
+	err = inspector.Process()
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, out.String(), `{"commit-ts":300,"datetime":"`+dt+`","type":"DML","events":[{"schema":"test","table":"tb1","type":"Update","columns":[`+
+		`{"name":"a","mysql-type":"int","value":1,"changed-value":1},`+
+		`{"name":"b","mysql-type":"int","value":1,"changed-value":1},`+
+		`{"name":"c","mysql-type":"int","value":1,"changed-value":5}]}]}
+`)
+
+	// the binlogs are filtered by commit ts and table
+	cfg.InspectConfig.Format = "text"
+	cfg.Tables, cfg.EventTypes = "", ""
+	cfg.StartTSO, cfg.StopTSO = 200, 250
+	inspector, err = NewInspector(cfg)
+	assert.Assert(t, err == nil)
+	inspector.out = &out
+	inspector.filter = filter.NewFilter(nil, []filter.TableName{{Schema: "test", Table: "tb2"}}, nil, nil)
+	out.Reset()
+	err = inspector.Process()
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, out.String(), "200 "+dt+" Insert `test`.`tb1` a=1, b=1, c=1\n")
+
+	_, err = parseTableNames("test")
+	assert.ErrorContains(t, err, "invalid table name")
+	_, err = parseEventTypes("insert,replace")
+	assert.ErrorContains(t, err, "invalid event type")
+}
+
+func strPtr(s string) *string {
+	return &s
+}
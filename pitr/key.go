@@ -122,12 +122,15 @@ func formatValue(value types.Datum, tp byte) types.Datum {
 	return value
 }
 
-func getHashKey(schema, table string, ev pb.Event, ddlHandle *DDLHandle) (string, error) {
-	tableInfo, err := ddlHandle.GetTableInfo(schema, table)
+// getHashKey returns the key used to hash the event into bucket, it's the first key of the row,
+// so the events of one row are always in the same bucket even if the row's key is changed by update.
+// the key is computed with the table info in effect at the event's commit ts
+func getHashKey(schema, table string, ev pb.Event, commitTS int64, ddlHandle *DDLHandle, aliases *keyAliases) (string, error) {
+	tableInfo, err := ddlHandle.GetTableInfoAt(schema, table, commitTS)
 	if err != nil {
 		return "", err
 	}
-	var key string
+	var key, cKey string
 	switch ev.GetTp() {
 	case pb.EventType_Insert, pb.EventType_Delete:
 		key, _, err = getInsertAndDeleteRowKey(ev.GetRow(), tableInfo)
@@ -135,41 +138,33 @@ func getHashKey(schema, table string, ev pb.Event, ddlHandle *DDLHandle) (string
 			return "", err
 		}
 	case pb.EventType_Update:
-		var cKey string
-		var sKey string
 		key, cKey, _, err = getUpdateRowKey(ev.GetRow(), tableInfo)
 		if err != nil {
 			return "", err
 		}
+	default:
+		panic("unreachable")
+	}
 
-		if len(tableInfo.uniqueKeys) == 0 {
-			break
-		}
+	// only the primary key or unique key is tracked, otherwise the key is changed by every update
+	if len(tableInfo.uniqueKeys) == 0 {
+		return key, nil
+	}
 
-		sKey, err = ddlHandle.fetchMapKeyFromDB(key)
-		if err != nil {
-			return "", nil
-		}
-		if sKey != "" {
-			key = sKey
-		}
+	r, err := aliases.root(key)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if r == "" {
+		r = key
+	}
 
-		if cKey != key {
-			sKey, err = ddlHandle.fetchMapKeyFromDB(cKey)
-			if err != nil {
-				return "", err
-			}
-
-			if sKey == "" {
-				err = ddlHandle.insertMapKeyFromDB(cKey, key)
-				if err != nil {
-					return "", err
-				}
-			}
+	// the changed key always points to the row's first key, even if it's used by a deleted row before
+	if len(cKey) != 0 && cKey != key {
+		if err := aliases.add(cKey, r); err != nil {
+			return "", errors.Trace(err)
 		}
-	default:
-		panic("unreachable")
 	}
 
-	return key, nil
+	return r, nil
 }
@@ -0,0 +1,109 @@
+package pitr
+
+import (
+	"os"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/goleveldb/leveldb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// keyAliasDir is the directory in temp dir to save the key aliases on disk,
+// it starts with "." so it's not treated as a table's temp dir
+const keyAliasDir = ".key_alias"
+
+// keyAliases records the key changes caused by update, every changed key is mapped to the
+// first key of the row, so all the events of one row are hashed into the same bucket.
+// the aliases are saved in memory, and moved to a leveldb in dir if they use more memory than maxMemory.
+type keyAliases struct {
+	mem       map[string]string
+	bytes     int64
+	maxMemory int64
+
+	dir string
+	// db is not nil after the aliases are moved to disk
+	db *leveldb.DB
+}
+
+func newKeyAliases(maxMemory int64, dir string) *keyAliases {
+	return &keyAliases{
+		mem:       make(map[string]string),
+		maxMemory: maxMemory,
+		dir:       dir,
+	}
+}
+
+// root returns the first key of the row which has the key now, returns empty string if the key is never changed
+func (a *keyAliases) root(key string) (string, error) {
+	if a.db == nil {
+		return a.mem[key], nil
+	}
+
+	value, err := a.db.Get([]byte(key), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return "", nil
+		}
+		return "", errors.Trace(err)
+	}
+	return string(value), nil
+}
+
+// add records the row whose first key is root has newKey now. newKey may be taken by another row before,
+// its alias is replaced, so the following events of newKey are hashed with the row which has it now
+func (a *keyAliases) add(newKey, root string) error {
+	if a.db != nil {
+		return errors.Trace(a.db.Put([]byte(newKey), []byte(root), nil))
+	}
+
+	if old, ok := a.mem[newKey]; ok {
+		a.bytes -= int64(len(newKey) + len(old))
+	}
+	a.mem[newKey] = root
+	a.bytes += int64(len(newKey) + len(root))
+	if a.bytes > a.maxMemory {
+		return errors.Trace(a.spill())
+	}
+	return nil
+}
+
+// spill moves the aliases in memory to the leveldb in dir
+func (a *keyAliases) spill() error {
+	log.Info("key aliases use too much memory, move them to disk", zap.Int("aliases", len(a.mem)), zap.Int64("size", a.bytes), zap.String("dir", a.dir))
+	if err := os.RemoveAll(a.dir); err != nil {
+		return errors.Trace(err)
+	}
+	db, err := leveldb.OpenFile(a.dir, nil)
+	if err != nil {
+		return errors.Annotatef(err, "open leveldb %s failed", a.dir)
+	}
+
+	batch := new(leveldb.Batch)
+	for key, r := range a.mem {
+		batch.Put([]byte(key), []byte(r))
+	}
+	if err := db.Write(batch, nil); err != nil {
+		db.Close()
+		return errors.Trace(err)
+	}
+
+	a.db = db
+	a.mem = nil
+	a.bytes = 0
+	return nil
+}
+
+// close releases the aliases, the data on disk is removed
+func (a *keyAliases) close() error {
+	a.mem = nil
+	if a.db == nil {
+		return nil
+	}
+
+	if err := a.db.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	a.db = nil
+	return errors.Trace(os.RemoveAll(a.dir))
+}
@@ -0,0 +1,123 @@
+package pitr
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestKeyAliases(t *testing.T) {
+	dir := "./test_key_alias"
+	os.RemoveAll(dir)
+
+	longKey := "test|tb1|" + strings.Repeat("a", 200) + "|"
+	// the aliases are moved to disk after the first add if maxMemory is 1
+	for _, maxMemory := range []int64{defaultMaxMemory, 1} {
+		aliases := newKeyAliases(maxMemory, dir)
+
+		key, err := aliases.root("mt")
+		assert.Assert(t, err == nil)
+		assert.Equal(t, key, "")
+
+		err = aliases.add("mt", "mt_src")
+		assert.Assert(t, err == nil)
+		assert.Equal(t, aliases.db != nil, maxMemory == 1)
+		key, err = aliases.root("mt")
+		assert.Assert(t, err == nil)
+		assert.Equal(t, key, "mt_src")
+
+		// the key already has a root is replaced, it's taken by another row
+		err = aliases.add("mt", "other")
+		assert.Assert(t, err == nil)
+		key, err = aliases.root("mt")
+		assert.Assert(t, err == nil)
+		assert.Equal(t, key, "other")
+
+		// the key can contain quotes and be longer than 128
+		err = aliases.add(longKey, "test|tb1|'a'|")
+		assert.Assert(t, err == nil)
+		key, err = aliases.root(longKey)
+		assert.Assert(t, err == nil)
+		assert.Equal(t, key, "test|tb1|'a'|")
+
+		err = aliases.close()
+		assert.Assert(t, err == nil)
+		_, err = os.Stat(dir)
+		assert.Assert(t, os.IsNotExist(err))
+	}
+}
+
+func benchmarkKeyAliases(b *testing.B, root func(key string) (string, error), add func(newKey, oldKey string) error) {
+	for i := 0; i < b.N; i++ {
+		oldKey := fmt.Sprintf("test|tb1|%d|", i)
+		newKey := fmt.Sprintf("test|tb1|%d|", i+b.N)
+		if _, err := root(oldKey); err != nil {
+			b.Fatal(err)
+		}
+		if err := add(newKey, oldKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyAliases(b *testing.B) {
+	aliases := newKeyAliases(defaultMaxMemory, "")
+	defer aliases.close()
+
+	benchmarkKeyAliases(b, aliases.root, aliases.add)
+}
+
+func BenchmarkKeyAliasesOnDisk(b *testing.B) {
+	aliases := newKeyAliases(0, "./bench_key_alias")
+	defer aliases.close()
+
+	benchmarkKeyAliases(b, aliases.root, aliases.add)
+}
+
+// BenchmarkSQLKeyAliases saves the aliases in the mock tidb like the previous implementation,
+// the mock tidb can't be restarted after closed, so run it without the other tests, like:
+// go test -run ^$ -bench KeyAliases
+func BenchmarkSQLKeyAliases(b *testing.B) {
+	os.RemoveAll(testTiDBDir)
+	ddl, err := NewDDLHandle(nil, testTiDBDir, 0)
+	if err != nil {
+		b.Skip("mock tidb is not available", err)
+	}
+	defer ddl.ResetDB()
+
+	for _, query := range []string{
+		"CREATE DATABASE _interval_map_",
+		"CREATE TABLE _interval_map_._inter_map_ (curKey varchar(128) unique, srcKey varchar(128))",
+	} {
+		if _, err := ddl.db.Exec(query); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	root := func(key string) (string, error) {
+		var r string
+		err := ddl.db.QueryRow("SELECT srcKey FROM _interval_map_._inter_map_ WHERE curKey = ?", key).Scan(&r)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		return r, nil
+	}
+	add := func(newKey, oldKey string) error {
+		r, err := root(oldKey)
+		if err != nil {
+			return err
+		}
+		if r == "" {
+			r = oldKey
+		}
+		_, err = ddl.db.Exec("INSERT INTO _interval_map_._inter_map_ VALUES (?, ?)", newKey, r)
+		return err
+	}
+
+	b.ResetTimer()
+	benchmarkKeyAliases(b, root, add)
+}
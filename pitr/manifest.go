@@ -0,0 +1,222 @@
+package pitr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/version"
+	"go.uber.org/zap"
+)
+
+const (
+	// manifestFileName is the file saved in the output dir of compact, it's ignored when read the binlog files in the dir
+	manifestFileName = "manifest.json"
+	// manifestVersion is the version of the manifest format, the manifest with a newer version can't be read
+	manifestVersion = 1
+)
+
+// manifest describes the output of compact, it records the inputs, the range of commit ts, the schema
+// and the checksums of the output files, so the output can be validated and used as the base of the next compact
+type manifest struct {
+	Version        int    `json:"version"`
+	ReleaseVersion string `json:"release-version"`
+	GitHash        string `json:"git-hash"`
+
+	// Config is the configuration of the compact run
+	Config *Config `json:"config"`
+	// Inputs are the binlog files merged, the base is not included
+	Inputs []*manifestFile `json:"inputs"`
+
+	// FirstTS and LastTS are the commit ts of the first and the last binlogs merged
+	FirstTS int64 `json:"first-ts"`
+	LastTS  int64 `json:"last-ts"`
+	// StartTS and StopTS are the range of commit ts covered by the output
+	StartTS int64 `json:"start-ts"`
+	StopTS  int64 `json:"stop-ts"`
+
+	OutputFormat string `json:"output-format"`
+
+	// BaseDir is the previous output merged into this output, it's empty if the output is not incremental
+	BaseDir     string `json:"base-dir,omitempty"`
+	BaseStartTS int64  `json:"base-start-ts,omitempty"`
+	BaseStopTS  int64  `json:"base-stop-ts,omitempty"`
+
+	// Tables are the events of every table before merge and the keys after merge,
+	// it's empty if some binlogs are merged by the previous run
+	Tables []*tableStat `json:"tables,omitempty"`
+
+	// BootstrapDDLs create the databases and tables before start ts, the ddls in the output are executed after them
+	BootstrapDDLs []string `json:"bootstrap-ddls"`
+	// Schema is the ddls to create the databases and tables at stop ts
+	Schema []string `json:"schema"`
+
+	// Files are the output files with their sizes and checksums, the paths are relative to the output dir
+	Files []*manifestFile `json:"files"`
+}
+
+// manifestFile is a file with its size and sha256 checksum
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func newManifest(cfg *Config) *manifest {
+	return &manifest{
+		Version:        manifestVersion,
+		ReleaseVersion: version.ReleaseVersion,
+		GitHash:        version.GitHash,
+		Config:         cfg,
+	}
+}
+
+// loadManifest reads the manifest in the output dir of compact
+func loadManifest(dir string) (*manifest, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("%s is not found in %s, it's not the output of compact", manifestFileName, dir)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.Annotatef(err, "unmarshal %s failed", path.Join(dir, manifestFileName))
+	}
+	if m.Version > manifestVersion {
+		return nil, errors.Errorf("the version of %s is %d, only version %d or earlier is supported", path.Join(dir, manifestFileName), m.Version, manifestVersion)
+	}
+	return m, nil
+}
+
+// save computes the checksums of the output files in dir, and writes the manifest to a temp file and then renames it
+func (m *manifest) save(dir string) error {
+	files, err := readManifestFiles(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	m.Files = files
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmpPath := path.Join(dir, manifestFileName+".tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmpPath, path.Join(dir, manifestFileName)))
+}
+
+// validate checks the files in dir are the same as the files in the manifest
+func (m *manifest) validate(dir string) error {
+	files, err := readManifestFiles(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expected := make(map[string]*manifestFile, len(m.Files))
+	for _, f := range m.Files {
+		expected[f.Path] = f
+	}
+	for _, f := range files {
+		e, ok := expected[f.Path]
+		if !ok {
+			return errors.Errorf("file %s is not in the manifest of %s", f.Path, dir)
+		}
+		if e.Size != f.Size || e.SHA256 != f.SHA256 {
+			return errors.Errorf("file %s in %s is changed, the size is %d and the checksum is %s, but %d and %s in the manifest",
+				f.Path, dir, f.Size, f.SHA256, e.Size, e.SHA256)
+		}
+		delete(expected, f.Path)
+	}
+	for p := range expected {
+		return errors.Errorf("file %s in the manifest is not found in %s", p, dir)
+	}
+	return nil
+}
+
+// checkBase checks the output can be used as the base of the compact with stop ts
+func (m *manifest) checkBase(dir string, stopTS int64) error {
+	if m.OutputFormat != outputFormatBinlog {
+		return errors.Errorf("the output format of base %s is %s, only %s can be used as base", dir, m.OutputFormat, outputFormatBinlog)
+	}
+	if stopTS != 0 && stopTS <= m.StopTS {
+		return errors.Errorf("stop ts %d is covered by base %s with ts range [%d, %d]", stopTS, dir, m.StartTS, m.StopTS)
+	}
+	return nil
+}
+
+// checkManifest validates the files in dir if it has a manifest, the directory without manifest is not the output of compact
+func checkManifest(dir string) error {
+	if _, err := os.Stat(path.Join(dir, manifestFileName)); os.IsNotExist(err) {
+		log.Info("no manifest in dir, skip the validation", zap.String("dir", dir))
+		return nil
+	}
+
+	m, err := loadManifest(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := m.validate(dir); err != nil {
+		return errors.Annotate(err, "validate manifest failed")
+	}
+	log.Info("validate manifest success", zap.String("dir", dir), zap.Int("files", len(m.Files)), zap.Int64("start ts", m.StartTS), zap.Int64("stop ts", m.StopTS))
+	return nil
+}
+
+// readManifestFiles returns the sorted files in dir with their checksums, the manifest itself and the mark of pitr are not included
+func readManifestFiles(dir string) ([]*manifestFile, error) {
+	var files []*manifestFile
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if rel == manifestFileName || rel == manifestFileName+".tmp" || rel == pitrDirMark {
+			return nil
+		}
+
+		checksum, err := fileSHA256(p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		files = append(files, &manifestFile{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: checksum})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Trace(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
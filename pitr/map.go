@@ -1,7 +1,9 @@
 package pitr
 
 import (
+	"fmt"
 	"hash/crc32"
+	"path"
 
 	"github.com/cznic/mathutil"
 	"github.com/pingcap/errors"
@@ -11,38 +13,77 @@ import (
 
 const (
 	Max_Event_Num = 1024
+
+	// ddlPartition is the sub directory to save the ddls of the table
+	ddlPartition = "ddl"
+	// dmlPartitionPrefix is the prefix of the sub directories to save the dmls of every hash bucket
+	dmlPartitionPrefix = "dml_"
 )
 
+// dmlPartition returns the sub directory name of the hash bucket n
+func dmlPartition(n int) string {
+	return fmt.Sprintf("%s%d", dmlPartitionPrefix, n)
+}
+
+// PBFile splits one table's binlogs into the temp files, the dmls are saved
+// into num hash buckets by key, every bucket and the ddls has its own sub directory:
+// - schema_table
+//   - ddl
+//   - dml_0
+//   - dml_1
 type PBFile struct {
-	schema    string
-	table     string
-	num       int
-	binlogger *myBinlogger
-	dml       map[int]*pb.Binlog
-	ddl       []*pb.Binlog
+	schema string
+	table  string
+	num    int
+	dir    string
+
+	// dmlBinloggers are created when the bucket's first dml is written
+	dmlBinloggers map[int]*myBinlogger
+	ddlBinlogger  *myBinlogger
+
+	dml map[int]*pb.Binlog
+	ddl []*pb.Binlog
 }
 
 func NewPbFile(dir, schema, table string, num int) (*PBFile, error) {
-	b, err := OpenMyBinlogger(dir + "/" + schema + "_" + table)
+	dir = path.Join(dir, schema+"_"+table)
+	b, err := OpenMyBinlogger(path.Join(dir, ddlPartition))
 	if err != nil {
 		return nil, err
 	}
 	return &PBFile{
-		schema:    schema,
-		table:     table,
-		num:       num,
-		binlogger: b,
-		ddl:       nil,
-		dml:       make(map[int]*pb.Binlog, num),
+		schema:        schema,
+		table:         table,
+		num:           num,
+		dir:           dir,
+		dmlBinloggers: make(map[int]*myBinlogger, num),
+		ddlBinlogger:  b,
+		ddl:           nil,
+		dml:           make(map[int]*pb.Binlog, num),
 	}, nil
 }
 
+func (f *PBFile) getDMLBinlogger(n int) (*myBinlogger, error) {
+	if b, ok := f.dmlBinloggers[n]; ok {
+		return b, nil
+	}
+
+	b, err := OpenMyBinlogger(path.Join(f.dir, dmlPartition(n)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	f.dmlBinloggers[n] = b
+	return b, nil
+}
+
 func (f *PBFile) getHashCode(key string) int {
 	return int(crc32.ChecksumIEEE([]byte(key))) % f.num
 }
 
 func (f *PBFile) AddDMLEvent(ev pb.Event, commitTS int64, key string) error {
-	f.flushDDL(true)
+	if err := f.flushDDL(true); err != nil {
+		return errors.Trace(err)
+	}
 	h := f.getHashCode(key)
 	if f.dml[h] == nil {
 		f.dml[h] = &pb.Binlog{
@@ -63,7 +104,9 @@ func (f *PBFile) AddDMLEvent(ev pb.Event, commitTS int64, key string) error {
 func (f *PBFile) AddDDLEvent(binlog *pb.Binlog) error {
 	dml := f.dml
 	for n := range dml {
-		f.flushDML(n, true)
+		if err := f.flushDML(n, true); err != nil {
+			return errors.Trace(err)
+		}
 	}
 	f.ddl = append(f.ddl, binlog)
 	if len(f.ddl) >= Max_Event_Num {
@@ -80,7 +123,11 @@ func (f *PBFile) flushDML(n int, b bool) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	sum, err = f.binlogger.WriteTail(&tb.Entity{Payload: data})
+	binlogger, err := f.getDMLBinlogger(n)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	sum, err = binlogger.WriteTail(&tb.Entity{Payload: data})
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -91,7 +138,7 @@ func (f *PBFile) flushDML(n int, b bool) error {
 			Events: make([]pb.Event, 0, Max_Event_Num),
 		}}
 	if sum > 0 && b {
-		f.binlogger.ManualRotate()
+		binlogger.ManualRotate()
 	}
 	return nil
 }
@@ -107,18 +154,38 @@ func (f *PBFile) flushDDL(b bool) error {
 		if err != nil {
 			return errors.Trace(err)
 		}
-		n, err = f.binlogger.WriteTail(&tb.Entity{Payload: data})
+		n, err = f.ddlBinlogger.WriteTail(&tb.Entity{Payload: data})
+		if err != nil {
+			return errors.Trace(err)
+		}
 		sum += n
 	}
 	f.ddl = nil
 	if sum > 0 && b {
-		f.binlogger.ManualRotate()
+		f.ddlBinlogger.ManualRotate()
 	}
 	return nil
 }
 
+// Flush writes all the cached binlogs to file
+func (f *PBFile) Flush() error {
+	for n, v := range f.dml {
+		if v != nil && len(v.DmlData.Events) > 0 {
+			if err := f.flushDML(n, false); err != nil {
+				return err
+			}
+		}
+	}
+	return f.flushDDL(false)
+}
+
 func (f *PBFile) Roate() error {
-	return f.binlogger.ManualRotate()
+	for _, b := range f.dmlBinloggers {
+		if err := b.ManualRotate(); err != nil {
+			return err
+		}
+	}
+	return f.ddlBinlogger.ManualRotate()
 }
 
 func (f *PBFile) Close() {
@@ -129,7 +196,10 @@ func (f *PBFile) Close() {
 	}
 	f.flushDDL(false)
 
-	if f.binlogger != nil {
-		f.binlogger.Close()
+	for _, b := range f.dmlBinloggers {
+		b.Close()
+	}
+	if f.ddlBinlogger != nil {
+		f.ddlBinlogger.Close()
 	}
 }
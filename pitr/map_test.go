@@ -1,6 +1,7 @@
 package pitr
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -44,13 +45,17 @@ func TestPbFile(t *testing.T) {
 
 	f.Close()
 
-	files, err := searchFiles(dirPath + "/" + "db1_tb1")
-	assert.Assert(t, err == nil)
-
+	files := searchTableFiles(t, dirPath+"/"+"db1_tb1")
 	files, _, err = filterFiles(files, 0, 1000000000)
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(files) == 3)
 
+	// the events are saved in the buckets by the hash of key
+	_, err = os.Stat(dirPath + "/db1_tb1/" + dmlPartition(f.getHashCode(string(cols[0]))))
+	assert.Assert(t, err == nil)
+	_, err = os.Stat(dirPath + "/db1_tb1/" + dmlPartition(f.getHashCode(string(cols[1]))))
+	assert.Assert(t, err == nil)
+
 	os.RemoveAll(dirPath + "/")
 
 }
@@ -73,12 +78,55 @@ func TestPbFileDDL(t *testing.T) {
 
 	f.Close()
 
-	files, err := searchFiles(dirPath + "/" + "db1_tb1")
-	assert.Assert(t, err == nil)
-
+	files := searchTableFiles(t, dirPath+"/"+"db1_tb1")
 	files, _, err = filterFiles(files, 0, 40)
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(files) == 1)
 
 	os.RemoveAll(dirPath + "/")
 }
+
+func TestPbFileWriteError(t *testing.T) {
+	dirPath := "./test_pbfile_error"
+	os.RemoveAll(dirPath + "/")
+	defer os.RemoveAll(dirPath + "/")
+
+	schema := "db1"
+	table := "tb1"
+
+	f, err := NewPbFile(dirPath, schema, table, 1)
+	assert.Assert(t, err == nil)
+	defer f.Close()
+	// the bucket's binlogger can't be opened, because its directory is a file
+	assert.Assert(t, ioutil.WriteFile(dirPath+"/db1_tb1/"+dmlPartition(0), nil, 0644) == nil)
+
+	cols := generateColumns()
+	ev := pb.Event{
+		Tp:         pb.EventType_Insert,
+		SchemaName: &schema,
+		TableName:  &table,
+		Row:        [][]byte{cols[0], cols[1]},
+	}
+	assert.Assert(t, f.AddDMLEvent(ev, 35, string(cols[0])) == nil)
+	// the dmls are flushed before the ddl, and the error is returned
+	err = f.AddDDLEvent(&pb.Binlog{
+		Tp:       pb.BinlogType_DDL,
+		DdlQuery: []byte("create table tx (a int)"),
+		CommitTs: 36,
+	})
+	assert.Assert(t, err != nil)
+}
+
+// searchTableFiles returns the binlog files in all the partitions of the table's temp dir
+func searchTableFiles(t *testing.T, dir string) []string {
+	subDirs, err := readSubDirs(dir)
+	assert.Assert(t, err == nil)
+
+	var files []string
+	for _, subDir := range subDirs {
+		subFiles, err := searchFiles(dir + "/" + subDir)
+		assert.Assert(t, err == nil)
+		files = append(files, subFiles...)
+	}
+	return files
+}
@@ -1,31 +1,30 @@
 package pitr
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
-	"github.com/pingcap/parser"
 	"github.com/pingcap/parser/ast"
 	"github.com/pingcap/parser/format"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
-	tb "github.com/pingcap/tipb/go-binlog"
 	"go.uber.org/zap"
 )
 
-const maxMemorySize int64 = 2 * 1024 * 1024 * 1024 // 2G
+// maxSplitNum limits the number of hash buckets, every bucket holds a opened file when map
+const maxSplitNum = 256
 
-var (
-	defaultTempDir   string = "./temp"
-	defaultOutputDir string = "./new_binlog"
-)
+// reducedDir is the directory in temp dir to save the reduced tables, which are merged into one stream in output dir
+const reducedDir = ".reduced"
 
 // Merge used to merge same keys binlog into one
 type Merge struct {
@@ -35,446 +34,841 @@ type Merge struct {
 	// outputDir used to save merged binlog file
 	outputDir string
 
+	// outputFormat is the format of the output files, binlog, sql, csv or columnar
+	outputFormat string
+	// outputFileSize is the max size of a sql file
+	outputFileSize int64
+	// singleOutput merges all the tables into one binlog directory in the order of commit ts
+	singleOutput bool
+	// barriers are the sorted commit ts of all the ddls and windows, the dmls are not merged across them
+	barriers []int64
+
+	// windowTxns and windowTS limit the transactions and the range of commit ts in a window, 0 means no limit
+	windowTxns int
+	windowTS   int64
+	// windows are the barriers of the windows, every barrier is the commit ts of the window's last transaction + 1,
+	// so the window is flushed with the real commit ts of its last transaction
+	windows []int64
+	// windowStartTS, windowLastTS and windowCount are the commit ts of the first and the last binlogs
+	// and the number of binlogs in the current window
+	windowStartTS int64
+	windowLastTS  int64
+	windowCount   int
+
 	// which binlog file need merge
 	binlogFiles []string
 
+	// baseDir is the output of the previous compact, it's merged with the binlogs after its stop ts in binlogFiles
+	baseDir string
+	base    *manifest
+	// schemaDDLs create the schema before the binlogs, they're read from schema dir or schema file
+	schemaDDLs []string
+
+	// firstTS and lastTS are the commit ts of the first and the last binlogs merged
+	firstTS int64
+	lastTS  int64
+	// bootstrapDDLs create the schema at start ts, and schema creates the schema at stop ts, they're saved in the manifest.
+	// bootstrapped is true after bootstrapDDLs are dumped
+	bootstrapDDLs []string
+	bootstrapped  bool
+	schema        []string
+
+	// only binlogs with commit ts in [startTS, stopTS] are merged, stopTS = 0 means no limit
+	startTS int64
+	stopTS  int64
+
 	// memory maybe not enough, need split all binlog files into multiple temp files
 	splitNum int
 
-	keyEvent map[string]*Event
+	// reduceWorkers is the number of temp sub directories reduced concurrently
+	reduceWorkers int
 
-	// used for handle ddl, and update table info
+	// maxMemory is the memory can be used by one reduce worker, the events are spilled to disk if exceed
+	maxMemory int64
+
+	// used for handle ddl, and update table info.
+	// all the ddls are executed when map, and the versions of the table info are used when reduce
 	ddlHandle *DDLHandle
 
-	maxCommitTS int64
+	// cp records the progress of Map and Reduce
+	cp *checkpoint
+
+	// aliases records the key changes of rows when map, used to get the hash key
+	aliases *keyAliases
+
+	// filter used to skip the schemas and tables which don't need to be merged
+	filter *filter.Filter
+
+	// skippedDMLs and skippedDDLs record how many events are skipped by filter,
+	// the key is the quoted schema and table name
+	skippedDMLs map[string]int64
+	skippedDDLs map[string]int64
+
+	// stats collects the summaries of the tables, it's nil if some files are mapped or reduced by the previous run
+	stats *statCollector
+	// dirTables is the table of every temp sub directory
+	dirTables map[string]filter.TableName
 }
 
 // NewMerge returns a new Merge
-func NewMerge(historyDDLs []*model.Job, binlogFiles []string, allFileSize int64) (*Merge, error) {
-	if err := os.Mkdir(defaultTempDir, 0700); err != nil {
-		return nil, err
+func NewMerge(cfg *Config, historyDDLs []*model.Job, binlogFiles []string, allFileSize int64, filter *filter.Filter) (*Merge, error) {
+	tempDir, err := prepareDir(cfg.TempDir, "pitr_temp", cfg.Overwrite, cfg.Resume)
+	if err != nil {
+		return nil, errors.Annotate(err, "prepare temp dir failed")
+	}
+
+	outputDir, err := prepareDir(cfg.OutputDir, "pitr_output", cfg.Overwrite, cfg.Resume)
+	if err != nil {
+		return nil, errors.Annotate(err, "prepare output dir failed")
+	}
+
+	// the mock tidb only runs to check the schema tracked in memory,
+	// its data is rebuilt in every run, so it's always cleaned when resume
+	var tidbDir string
+	if cfg.CheckSchema {
+		if tidbDir, err = prepareDir(cfg.TiDBDir, "pitr_tidb", cfg.Overwrite || cfg.Resume, false); err != nil {
+			return nil, errors.Annotate(err, "prepare tidb dir failed")
+		}
+	}
+
+	log.Info("prepare dirs success", zap.String("temp dir", tempDir), zap.String("output dir", outputDir), zap.String("tidb dir", tidbDir))
+
+	// the binlogs in base are all merged, and the binlogs in files before its stop ts are skipped
+	startTS := cfg.StartTSO
+	var base *manifest
+	if cfg.BaseDir != "" {
+		if base, err = loadManifest(cfg.BaseDir); err != nil {
+			return nil, errors.Annotate(err, "load base manifest failed")
+		}
+		if err := base.validate(cfg.BaseDir); err != nil {
+			return nil, errors.Annotate(err, "validate base manifest failed")
+		}
+		if err := base.checkBase(cfg.BaseDir, cfg.StopTSO); err != nil {
+			return nil, errors.Trace(err)
+		}
+		startTS = base.StartTS
+		log.Info("merge with base", zap.String("base dir", cfg.BaseDir), zap.Int64("start ts", base.StartTS), zap.Int64("stop ts", base.StopTS))
+	}
+
+	windowTS, err := cfg.windowTS()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cp, err := loadCheckpoint(tempDir, cfg.StartTSO, cfg.StopTSO, cfg.WindowTxns, windowTS)
+	if err != nil {
+		return nil, errors.Annotate(err, "load checkpoint failed")
 	}
 
-	ddlHandle, err := NewDDLHandle(historyDDLs)
+	ddlHandle, err := NewDDLHandle(historyDDLs, tidbDir, cfg.TiDBPort)
 	if err != nil {
 		return nil, err
 	}
 
-	var snum int
-	if allFileSize <= maxMemorySize {
-		snum = 1
-	} else {
-		snum = int(allFileSize / maxMemorySize)
+	// the schema of base includes the schema ddls, so they're only loaded without base.
+	// the ddl jobs finished after the first binlog are in the binlogs, so they're ignored
+	var schemaDDLs []string
+	if base == nil {
+		var beginTS int64
+		if cfg.SchemaFile != "" && len(binlogFiles) != 0 {
+			if beginTS, _, err = getFirstBinlogCommitTSAndFileSize(binlogFiles[0]); err != nil {
+				return nil, errors.Annotate(err, "get first binlog commit ts failed")
+			}
+		}
+		if schemaDDLs, err = loadSchemaDDLs(cfg.SchemaDir, cfg.SchemaFile, beginTS); err != nil {
+			return nil, errors.Annotate(err, "load schema ddls failed")
+		}
 	}
+
+	// the split num is saved in checkpoint, the temp files are split by it when resume
+	snum := cp.SplitNum
+	if snum == 0 {
+		snum = getSplitNum(allFileSize, cfg.MaxMemory)
+		cp.SplitNum = snum
+	}
+
+	log.Info("split binlogs into hash buckets", zap.Int("split num", snum))
 	return &Merge{
-		tempDir:     defaultTempDir,
-		outputDir:   defaultOutputDir,
-		binlogFiles: binlogFiles,
-		splitNum:    snum,
-		ddlHandle:   ddlHandle,
-		keyEvent:    make(map[string]*Event),
+		tempDir:        tempDir,
+		outputDir:      outputDir,
+		outputFormat:   cfg.OutputFormat,
+		outputFileSize: cfg.OutputFileSize,
+		singleOutput:   cfg.SingleOutput,
+		windowTxns:     cfg.WindowTxns,
+		windowTS:       windowTS,
+		binlogFiles:    binlogFiles,
+		baseDir:        cfg.BaseDir,
+		base:           base,
+		schemaDDLs:     schemaDDLs,
+		startTS:        startTS,
+		stopTS:         cfg.StopTSO,
+		splitNum:       snum,
+		reduceWorkers:  cfg.ReduceWorkers,
+		maxMemory:      cfg.MaxMemory,
+		ddlHandle:      ddlHandle,
+		cp:             cp,
+		filter:         filter,
+		skippedDMLs:    make(map[string]int64),
+		skippedDDLs:    make(map[string]int64),
+		stats:          newStatCollector(false),
 	}, nil
 }
 
+// getSplitNum returns how many hash buckets the binlogs should be split into, so every bucket can be reduced in maxMemory
+func getSplitNum(allFileSize, maxMemory int64) int {
+	if allFileSize <= maxMemory {
+		return 1
+	}
+
+	snum := (allFileSize + maxMemory - 1) / maxMemory
+	if snum > maxSplitNum {
+		log.Warn("too many hash buckets, the memory may exceed max-memory", zap.Int64("split num", snum), zap.Int("max split num", maxSplitNum))
+		return maxSplitNum
+	}
+	return int(snum)
+}
+
 // Map split binlog into multiple files
 func (m *Merge) Map() error {
-	fileMap := make(map[string]*PBFile)
-	log.Info("map", zap.Strings("files", m.binlogFiles))
+	if m.cp.MapFinished {
+		log.Info("all files are mapped, skip map")
+		m.stats = nil
+		m.windows = m.cp.Windows
+		m.firstTS, m.lastTS = m.cp.FirstTS, m.cp.LastTS
+		m.bootstrapDDLs, m.schema = m.cp.BootstrapDDLs, m.cp.Schema
+		m.ddlHandle.versions.load(m.cp.SchemaVersions)
+		return nil
+	}
 
-	for _, bFile := range m.binlogFiles {
-		f, err := os.OpenFile(bFile, os.O_RDONLY, 0600)
-		if err != nil {
-			return errors.Annotatef(err, "open file %s error", bFile)
+	// the base is mapped before the binlog files
+	inputs := m.binlogFiles
+	if m.base != nil {
+		inputs = append([]string{m.baseDir}, inputs...)
+	}
+	if err := m.cp.checkFiles(inputs); err != nil {
+		return errors.Trace(err)
+	}
+	// the temp files written after the last checkpoint are incomplete, remove them
+	if err := m.cp.cleanTempFiles(m.tempDir); err != nil {
+		return errors.Trace(err)
+	}
+
+	m.dirTables = make(map[string]filter.TableName)
+	// the aliases are rebuilt by replaying the mapped files when resume
+	m.aliases = newKeyAliases(m.maxMemory, path.Join(m.tempDir, keyAliasDir))
+	fileMap := make(map[string]*PBFile)
+	defer func() {
+		for _, v := range fileMap {
+			v.Close()
 		}
-		reader := bufio.NewReader(f)
-		for {
-			var key, schema, table string
-			var pf *PBFile
-			binlog, _, err := Decode(reader)
-			if err != nil {
-				if errors.Cause(err) == io.EOF {
-					break
-				} else {
-					return err
-				}
-			}
+		if err := m.aliases.close(); err != nil {
+			log.Warn("close key aliases failed", zap.Error(err))
+		}
+	}()
+	log.Info("map", zap.Strings("files", inputs))
 
-			switch binlog.Tp {
+	// the mock tidb is cleaned in every run, so the schema before the binlogs is always created
+	if err := m.executeSchemaDDLs(); err != nil {
+		return errors.Trace(err)
+	}
 
-			case pb.BinlogType_DML:
-				dml := binlog.DmlData
-				if dml == nil {
-					return errors.New("dml binlog's data can't be empty")
-				}
-				for _, event := range dml.Events {
-					schema = event.GetSchemaName()
-					table = event.GetTableName()
-					key = fmt.Sprintf("%s_%s", schema, table)
-					if fileMap[key] == nil {
-						pf, err = NewPbFile(m.tempDir, schema, table, m.splitNum)
-						if err != nil {
-							return errors.Trace(err)
-						}
-						fileMap[key] = pf
-					} else {
-						pf = fileMap[key]
-					}
-
-					var hk string
-					hk, err = getHashKey(schema, table, event, m.ddlHandle)
-					if err != nil {
-						return err
-					}
-					pf.AddDMLEvent(event, binlog.CommitTs, hk)
-				}
-			case pb.BinlogType_DDL:
-				schema, table, err = parserSchemaTableFromDDL(string(binlog.DdlQuery))
-				if err != nil {
-					return errors.Trace(err)
-				}
-				if len(schema) == 0 {
-					return errors.New("DDL has no schema info.")
-				}
-				key = fmt.Sprintf("%s_%s", schema, table)
-				if fileMap[key] == nil {
-					pf, err = NewPbFile(m.tempDir, schema, table, m.splitNum)
-					if err != nil {
-						return errors.Trace(err)
-					}
-					fileMap[key] = pf
-				} else {
-					pf = fileMap[key]
-				}
-				var rebin *pb.Binlog
-				rebin, err = rewriteDDL(binlog, m.ddlHandle)
-				if err != nil {
-					return err
-				}
-				err = m.ddlHandle.ExecuteDDL(string(binlog.GetDdlQuery()))
-				if err != nil {
-					return err
-				}
-				pf.AddDDLEvent(rebin)
-			default:
-				panic("unreachable")
+	for _, bFile := range inputs {
+		// the mapped file only need to be replayed, to rebuild the table info
+		replay := m.cp.isMapped(bFile)
+		if replay {
+			m.stats = nil
+		}
+		if err := m.mapFile(bFile, fileMap, replay); err != nil {
+			return errors.Annotatef(err, "map file %s failed", bFile)
+		}
+		if replay {
+			continue
+		}
 
+		for _, pf := range fileMap {
+			if err := pf.Flush(); err != nil {
+				return errors.Trace(err)
 			}
 		}
+		m.cp.Windows = m.windows
+		m.cp.FirstTS, m.cp.LastTS = m.firstTS, m.lastTS
+		if err := m.cp.addMappedFile(bFile, m.tempDir); err != nil {
+			return errors.Annotate(err, "save checkpoint failed")
+		}
+	}
+
+	if len(m.skippedDMLs) != 0 || len(m.skippedDDLs) != 0 {
+		log.Info("skip binlogs by filter", zap.Reflect("dml events", m.skippedDMLs), zap.Reflect("ddls", m.skippedDDLs))
+	}
 
+	// the last window ends at the last binlog
+	if err := m.closeWindow(fileMap, false); err != nil {
+		return errors.Trace(err)
+	}
+	if err := m.dumpBootstrapSchema(); err != nil {
+		return errors.Trace(err)
+	}
+	schema, err := m.ddlHandle.dumpSchema()
+	if err != nil {
+		return errors.Annotate(err, "dump schema failed")
 	}
-	for _, v := range fileMap {
-		v.Close()
+	m.schema = schema
+
+	// the schema is saved, so reduce can run without executing the ddls again when resume
+	m.cp.Windows = m.windows
+	m.cp.FirstTS, m.cp.LastTS = m.firstTS, m.lastTS
+	m.cp.BootstrapDDLs, m.cp.Schema = m.bootstrapDDLs, m.schema
+	m.cp.SchemaVersions = m.ddlHandle.versions.all()
+	if err := m.cp.finishMap(); err != nil {
+		return errors.Annotate(err, "save checkpoint failed")
 	}
+	return nil
+}
 
-	m.ddlHandle.ResetDB()
+// dumpBootstrapSchema saves the schema before the first binlog merged as bootstrapDDLs, it's the schema at start ts
+func (m *Merge) dumpBootstrapSchema() error {
+	if m.bootstrapped {
+		return nil
+	}
+	m.bootstrapped = true
+	if m.base != nil {
+		m.bootstrapDDLs = m.base.BootstrapDDLs
+		return nil
+	}
+
+	ddls, err := m.ddlHandle.dumpSchema()
+	if err != nil {
+		return errors.Annotate(err, "dump schema failed")
+	}
+	m.bootstrapDDLs = ddls
 	return nil
 }
 
-// Reduce merge same keys binlog into one, and output to file
-// every file only contain one table's binlog, just like:
-// - output
-//   - schema1_table1
-//   _ schema1_table2
-//   - schema2_table1
-//   - schema2_table2
-func (m *Merge) Reduce() error {
-	subDirs, err := binlogfile.ReadDir(m.tempDir)
+// mapFile splits the binlogs in file into the temp files, the file is the base dir or a binlog file,
+// if replay is true, only the ddls are executed and nothing will be written.
+func (m *Merge) mapFile(file string, fileMap map[string]*PBFile, replay bool) error {
+	reader, err := m.openInput(file)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	defer reader.close()
+	isBase := m.base != nil && file == m.baseDir
 
-	log.Info("", zap.Strings("sub dirs", subDirs))
-	for _, dir := range subDirs {
-
-		binlogger, err := binlogfile.OpenBinlogger(path.Join(defaultOutputDir, dir))
+	for {
+		binlog, err := reader.read()
 		if err != nil {
-			return errors.Trace(err)
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return err
 		}
 
-		dirPath := path.Join(m.tempDir, dir)
-		fNames, err := binlogfile.ReadDir(dirPath)
-		if err != nil {
-			return errors.Trace(err)
+		// the binlogs before the stop ts of base are already merged into it, and so are their ddls
+		if m.base != nil && !isBase && binlog.CommitTs <= m.base.StopTS {
+			continue
 		}
-		log.Info("reduce", zap.Strings("files", fNames))
-
-		for _, fName := range fNames {
-			binlogCh, errCh := m.read(path.Join(dirPath, fName))
-
-		Loop:
-			for {
-				select {
-				case binlog, ok := <-binlogCh:
-					if ok {
-						err := m.analyzeBinlog(binlogger, binlog)
-						if err != nil {
-							return err
-						}
-						m.maxCommitTS = binlog.CommitTs
-					} else {
-						break Loop
-					}
-				case err := <-errCh:
+		if !isAcceptableBinlog(binlog, m.startTS, m.stopTS) {
+			if binlog.Tp == pb.BinlogType_DDL {
+				err = m.ddlHandle.ExecuteDDLAt(string(binlog.GetDdlQuery()), binlog.CommitTs)
+				if err != nil {
 					return err
 				}
 			}
+			continue
+		}
+		if err := m.dumpBootstrapSchema(); err != nil {
+			return errors.Trace(err)
 		}
 
-		err = m.FlushDMLBinlog(binlogger, m.maxCommitTS)
-		if err != nil {
+		if m.firstTS == 0 {
+			m.firstTS = binlog.CommitTs
+		}
+		if binlog.CommitTs > m.lastTS {
+			m.lastTS = binlog.CommitTs
+		}
+		if err := m.splitWindow(binlog, fileMap, replay); err != nil {
+			return errors.Trace(err)
+		}
+		if err := m.mapBinlog(binlog, fileMap, replay); err != nil {
 			return err
 		}
 	}
-
-	return err
 }
 
-// FlushDMLBinlog merge some events to one binlog, and then write to file
-func (m *Merge) FlushDMLBinlog(binlogger binlogfile.Binlogger, commitTS int64) error {
-	binlog := m.newDMLBinlog(commitTS)
-	i := 0
-	for _, row := range m.keyEvent {
-		i++
-		r := make([][]byte, 0, 10)
-		for _, c := range row.cols {
-			data, err := c.Marshal()
-			if err != nil {
-				return err
-			}
-			r = append(r, data)
-		}
-
-		log.Info("generate new event", zap.String("event", fmt.Sprintf("%v", row)))
-		newEvent := pb.Event{
-			SchemaName: &row.schema,
-			TableName:  &row.table,
-			Tp:         row.eventType,
-			Row:        r,
+// openInput opens the base dir as one stream in the order of commit ts, or opens the binlog file,
+// binlogs before start ts in the file are read too, the ddls in them are needed to build the table info
+func (m *Merge) openInput(file string) (pbReadCloser, error) {
+	if m.base != nil && file == m.baseDir {
+		dirs, err := searchBinlogDirs(file)
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
-		binlog.DmlData.Events = append(binlog.DmlData.Events, newEvent)
+		return newStreamPbReader(dirs, 0, 0)
+	}
+	return newFilesPbReader([]string{file}, 0, m.stopTS)
+}
 
-		// every binlog contain 1000 rows as default
-		if i%1000 == 0 {
-			err := m.writeBinlog(binlogger, binlog)
-			if err != nil {
-				return err
+// executeSchemaDDLs creates the schema before the binlogs, it's the schema at the start ts of base,
+// or the schema read from schema dir or schema file
+func (m *Merge) executeSchemaDDLs() error {
+	if m.base != nil {
+		for _, ddl := range m.base.BootstrapDDLs {
+			if err := m.ddlHandle.ExecuteDDLAt(ddl, 0); err != nil {
+				return errors.Annotatef(err, "execute ddl %s of base failed", ddl)
 			}
-			binlog = m.newDMLBinlog(commitTS)
 		}
+		return nil
 	}
-
-	if len(binlog.DmlData.Events) != 0 {
-		err := m.writeBinlog(binlogger, binlog)
-		if err != nil {
-			return err
+	for _, ddl := range m.schemaDDLs {
+		if err := m.ddlHandle.ExecuteDDLAt(ddl, 0); err != nil {
+			return errors.Annotatef(err, "execute schema ddl %s failed", ddl)
 		}
 	}
-
-	// all event have already flush to file, clean these event
-	m.keyEvent = make(map[string]*Event)
-
 	return nil
 }
 
-func (m *Merge) newDMLBinlog(commitTS int64) *pb.Binlog {
-	return &pb.Binlog{
-		Tp:       pb.BinlogType_DML,
-		CommitTs: commitTS,
-		DmlData: &pb.DMLData{
-			Events: make([]pb.Event, 0, 1000),
-		},
+// splitWindow closes the current window before the binlog if the window is full or the binlog is a ddl
+func (m *Merge) splitWindow(binlog *pb.Binlog, fileMap map[string]*PBFile, replay bool) error {
+	if m.windowTxns == 0 && m.windowTS == 0 {
+		return nil
 	}
-}
 
-func (m *Merge) writeBinlog(binlogger binlogfile.Binlogger, binlog *pb.Binlog) error {
-	data, err := binlog.Marshal()
-	if err != nil {
-		return errors.Trace(err)
+	if binlog.Tp == pb.BinlogType_DDL ||
+		(m.windowTxns != 0 && m.windowCount >= m.windowTxns) ||
+		(m.windowTS != 0 && m.windowCount != 0 && binlog.CommitTs-m.windowStartTS >= m.windowTS) {
+		if err := m.closeWindow(fileMap, replay); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if binlog.Tp == pb.BinlogType_DDL {
+		return nil
 	}
 
-	_, err = binlogger.WriteTail(&tb.Entity{Payload: data})
-	return errors.Trace(err)
+	if m.windowCount == 0 {
+		m.windowStartTS = binlog.CommitTs
+	}
+	m.windowLastTS = binlog.CommitTs
+	m.windowCount++
+	return nil
 }
 
-func (m *Merge) Close() {
-	if err := os.RemoveAll(m.tempDir); err != nil {
-		log.Warn("remove temp dir", zap.String("dir", m.tempDir), zap.Error(err))
+// closeWindow adds the barrier of the current window, and flushes the dmls so the binlogs in temp files don't cross it
+func (m *Merge) closeWindow(fileMap map[string]*PBFile, replay bool) error {
+	if m.windowCount == 0 {
+		return nil
 	}
-	m.ddlHandle.Close()
-}
 
-// read reads binlog from pb file
-func (m *Merge) read(file string) (chan *pb.Binlog, chan error) {
-	binlogChan := make(chan *pb.Binlog, 10)
-	errChan := make(chan error)
+	m.windows = append(m.windows, m.windowLastTS+1)
+	m.windowCount = 0
+	if replay {
+		return nil
+	}
+	for _, pf := range fileMap {
+		if err := pf.Flush(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
 
-	go func() {
-		f, err := os.OpenFile(file, os.O_RDONLY, 0600)
-		if err != nil {
-			errChan <- errors.Annotatef(err, "open file %s error", file)
-			return
+func (m *Merge) mapBinlog(binlog *pb.Binlog, fileMap map[string]*PBFile, replay bool) error {
+	switch binlog.Tp {
+	case pb.BinlogType_DML:
+		dml := binlog.DmlData
+		if dml == nil {
+			return errors.New("dml binlog's data can't be empty")
 		}
+		for _, event := range dml.Events {
+			schema := event.GetSchemaName()
+			table := event.GetTableName()
+			if m.filter.SkipSchemaAndTable(schema, table) {
+				if !replay {
+					m.skippedDMLs[quoteSchema(schema, table)]++
+				}
+				continue
+			}
 
-		reader := bufio.NewReader(f)
-		for {
-			binlog, _, err := Decode(reader)
+			// the key may be saved when get hash key, so it's also needed in replay
+			hk, err := getHashKey(schema, table, event, binlog.CommitTs, m.ddlHandle, m.aliases)
 			if err != nil {
-				if errors.Cause(err) == io.EOF {
-					log.Info("read file end", zap.String("file", file))
-					close(binlogChan)
-					return
-				} else {
-					errChan <- errors.Trace(err)
-					return
-				}
+				return err
+			}
+			if replay {
+				continue
 			}
 
-			binlogChan <- binlog
+			pf, err := m.getPbFile(fileMap, schema, table)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := pf.AddDMLEvent(event, binlog.CommitTs, hk); err != nil {
+				return errors.Trace(err)
+			}
+			if m.stats != nil {
+				m.stats.addDML(&event, nil)
+			}
 		}
-	}()
-
-	return binlogChan, errChan
-}
-
-func (m *Merge) analyzeBinlog(binlogger binlogfile.Binlogger, binlog *pb.Binlog) error {
-	switch binlog.Tp {
-	case pb.BinlogType_DML:
-		_, err := m.handleDML(binlog)
+	case pb.BinlogType_DDL:
+		// the routes are got before the ddl is executed, the tables of a dropped database are unknown after it
+		routes, err := routeDDL(binlog, m.ddlHandle)
 		if err != nil {
-			return err
+			return errors.Trace(err)
 		}
-	case pb.BinlogType_DDL:
-		err := m.ddlHandle.ExecuteDDL(string(binlog.GetDdlQuery()))
+		for _, route := range routes {
+			if len(route.schema) == 0 {
+				return errors.New("DDL has no schema info.")
+			}
+		}
+		// the skipped ddl still need to be executed, otherwise the table info may be wrong
+		err = m.ddlHandle.ExecuteDDLAt(string(binlog.GetDdlQuery()), binlog.CommitTs)
 		if err != nil {
 			return err
 		}
-		// merge DML events to several binlog and write to file, then write this DDL's binlog
-		m.FlushDMLBinlog(binlogger, binlog.CommitTs-1)
-		m.writeBinlog(binlogger, binlog)
+		if replay {
+			return nil
+		}
+
+		kept := routes[:0]
+		for _, route := range routes {
+			if !m.filter.SkipSchemaAndTable(route.schema, route.table) {
+				kept = append(kept, route)
+			} else if len(route.binlog.DdlQuery) != 0 {
+				m.skippedDDLs[quoteSchema(route.schema, route.table)]++
+			}
+		}
+		if len(kept) == 0 {
+			return nil
+		}
 
+		// the dmls of a bucket are saved in one binlog, split them at the ddl so they are not merged across it
+		if m.singleOutput {
+			for _, pf := range fileMap {
+				if err := pf.Flush(); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
+		size := int64(binlog.Size())
+		for _, route := range kept {
+			pf, err := m.getPbFile(fileMap, route.schema, route.table)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := pf.AddDDLEvent(route.binlog); err != nil {
+				return errors.Trace(err)
+			}
+			if m.stats != nil && len(route.binlog.DdlQuery) != 0 {
+				m.stats.addDDL(route.schema, route.table, size)
+			}
+		}
 	default:
 		panic("unreachable")
 	}
+
 	return nil
 }
 
-// handleDML split DML binlog to multiple Event and handle them
-func (m *Merge) handleDML(binlog *pb.Binlog) ([]*Event, error) {
-	dml := binlog.DmlData
-	if dml == nil {
-		return nil, errors.New("dml binlog's data can't be empty")
+func (m *Merge) getPbFile(fileMap map[string]*PBFile, schema, table string) (*PBFile, error) {
+	key := fmt.Sprintf("%s_%s", schema, table)
+	if pf, ok := fileMap[key]; ok {
+		return pf, nil
 	}
 
-	for _, event := range dml.Events {
-		schema := event.GetSchemaName()
-		table := event.GetTableName()
+	pf, err := NewPbFile(m.tempDir, schema, table, m.splitNum)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	fileMap[key] = pf
+	m.dirTables[key] = filter.TableName{Schema: schema, Table: table}
+	return pf, nil
+}
 
-		e := &event
-		tp := e.GetTp()
-		row := e.GetRow()
+// Reduce merge same keys binlog into one, and output to file
+// every file only contain one table's binlog, just like:
+// - output
+//   - schema1_table1
+//   _ schema1_table2
+//   - schema2_table1
+//   - schema2_table2
+// the tables are reduced concurrently by reduceWorkers workers,
+// the database level ddls (in the directories like schema1_) are handled before them.
+// the ddls are not executed again, every event uses the version of the table info at its commit ts.
+// if singleOutput is true, the tables are reduced to the temp dir, and then merged into output dir by commit ts.
+func (m *Merge) Reduce() error {
+	subDirs, err := readSubDirs(m.tempDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if m.singleOutput {
+		if m.barriers, err = readBarriers(m.tempDir, subDirs); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(m.windows) != 0 {
+		m.barriers = append(m.barriers, m.windows...)
+		sort.Slice(m.barriers, func(i, j int) bool { return m.barriers[i] < m.barriers[j] })
+	}
 
-		var r *Event
+	log.Info("", zap.Strings("sub dirs", subDirs))
+	tableDirs := make([]string, 0, len(subDirs))
+	for _, dir := range subDirs {
+		if m.cp.isReduced(dir) {
+			log.Info("skip reduced dir", zap.String("dir", dir))
+			m.stats = nil
+			continue
+		}
 
-		tableInfo, err := m.ddlHandle.GetTableInfo(schema, table)
-		if err != nil {
-			return nil, err
+		if !strings.HasSuffix(dir, "_") {
+			tableDirs = append(tableDirs, dir)
+			continue
 		}
 
-		switch tp {
-		case pb.EventType_Insert, pb.EventType_Delete:
-			key, cols, err := getInsertAndDeleteRowKey(row, tableInfo)
-			if err != nil {
-				return nil, err
-			}
+		// the database level ddls, like create database, are reduced before the tables'
+		if err := m.reduceDir(dir); err != nil {
+			return err
+		}
+	}
 
-			r = &Event{
-				schema:    schema,
-				table:     table,
-				eventType: tp,
-				oldKey:    key,
-				cols:      cols,
-			}
+	dirCh := make(chan string, len(tableDirs))
+	for _, dir := range tableDirs {
+		dirCh <- dir
+	}
+	close(dirCh)
 
-		case pb.EventType_Update:
-			key, cKey, cols, err := getUpdateRowKey(row, tableInfo)
-			if err != nil {
-				return nil, err
+	workers := m.reduceWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	errCh := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range dirCh {
+				if err := m.reduceDir(dir); err != nil {
+					errCh <- err
+					return
+				}
 			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
 
-			r = &Event{
-				schema:    schema,
-				table:     table,
-				eventType: tp,
-				oldKey:    key,
-				newKey:    cKey,
-				cols:      cols,
-			}
+	// only return the first error, the others are usually caused by it
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if m.singleOutput {
+		return errors.Annotate(m.mergeReducedDirs(subDirs), "merge the reduced tables failed")
+	}
+	return nil
+}
 
-		default:
-			panic("unreachable")
+// readBarriers returns the sorted commit ts of the ddls in all the temp sub directories
+func readBarriers(tempDir string, subDirs []string) ([]int64, error) {
+	var barriers []int64
+	for _, dir := range subDirs {
+		ddls, err := readDDLPartition(path.Join(tempDir, dir))
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
+		for _, ddl := range ddls {
+			barriers = append(barriers, ddl.CommitTs)
+		}
+	}
+	sort.Slice(barriers, func(i, j int) bool { return barriers[i] < barriers[j] })
+	return barriers, nil
+}
+
+// mergeReducedDirs merges the reduced tables in temp dir into one binlog directory in output dir,
+// the binlog files written by the previous run are removed, because the merge is always done again when resume
+func (m *Merge) mergeReducedDirs(subDirs []string) error {
+	names, err := binlogfile.ReadDir(m.outputDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range binlogfile.FilterBinlogNames(names) {
+		if err := os.Remove(path.Join(m.outputDir, name)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	dirs := make([]string, 0, len(subDirs))
+	for _, dir := range sortStreamDirs(subDirs) {
+		dirs = append(dirs, path.Join(m.tempDir, reducedDir, dir))
+	}
+	out, err := newBinlogSink(m.outputDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := mergeStreams(dirs, out); err != nil {
+		out.close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(out.close())
+}
 
-		m.HandleEvent(r)
+// reduceDir reduces the temp sub directory and saves the progress to checkpoint
+func (m *Merge) reduceDir(dir string) error {
+	if err := m.reduceFiles(dir); err != nil {
+		return errors.Annotatef(err, "reduce dir %s failed", dir)
 	}
 
-	return nil, nil
+	if err := m.cp.addReducedDir(dir); err != nil {
+		return errors.Annotate(err, "save checkpoint failed")
+	}
+	return nil
 }
 
-// HandleEvent handles event, if event's key already exist, then merge this event
-// otherwise save this event
-func (m *Merge) HandleEvent(row *Event) {
-	key := row.oldKey
-	tp := row.eventType
-	oldRow, ok := m.keyEvent[key]
-	if ok {
-		oldRow.Merge(row)
-		if oldRow.isDeleted {
-			delete(m.keyEvent, key)
-			return
+// reduceFiles merges the binlogs in the temp sub directory, and output to the same name directory in outputDir
+func (m *Merge) reduceFiles(dir string) error {
+	// the output may be written partly by the previous run, remove it and reduce again
+	outputPath := path.Join(m.outputDir, dir)
+	if m.singleOutput {
+		outputPath = path.Join(m.tempDir, reducedDir, dir)
+	}
+	if err := os.RemoveAll(outputPath); err != nil {
+		return errors.Trace(err)
+	}
+
+	out, err := newSink(m.outputFormat, outputPath, m.outputFileSize, m.ddlHandle.GetTableInfoAt)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	r := newReducer(m.ddlHandle, m.maxMemory, path.Join(m.tempDir, dir, spillPartition))
+	r.barriers = m.barriers
+	defer r.close()
+	if err := r.reduce(out, path.Join(m.tempDir, dir)); err != nil {
+		out.close()
+		return err
+	}
+	if err := out.close(); err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("reduce dir success", zap.String("dir", dir), zap.Int("max cached events", r.maxCachedEvents), zap.Int("spills", r.spills))
+	if name, ok := m.dirTables[dir]; ok && m.stats != nil {
+		m.stats.addOutput(name.Schema, name.Table, r.keys, r.bytes)
+	}
+	return nil
+}
+
+// SaveManifest saves the manifest of the output, which is needed to validate the output
+// and to use the output as the base of the next compact
+func (m *Merge) SaveManifest(cfg *Config) error {
+	mf := newManifest(cfg)
+	for _, file := range m.binlogFiles {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return errors.Trace(err)
 		}
+		mf.Inputs = append(mf.Inputs, &manifestFile{Path: file, Size: fi.Size()})
+	}
 
-		if tp == pb.EventType_Update {
-			// update may change pk/uk value, so key may be changed
-			delete(m.keyEvent, key)
-			m.keyEvent[oldRow.oldKey] = oldRow
+	mf.FirstTS, mf.LastTS = m.firstTS, m.lastTS
+	mf.StartTS, mf.StopTS = m.startTS, m.lastTS
+	if mf.StartTS == 0 {
+		mf.StartTS = m.firstTS
+	}
+	mf.OutputFormat = m.outputFormat
+	if m.base != nil {
+		mf.BaseDir = m.baseDir
+		mf.BaseStartTS = m.base.StartTS
+		mf.BaseStopTS = m.base.StopTS
+		if mf.StopTS < m.base.StopTS {
+			mf.StopTS = m.base.StopTS
+		}
+	}
+
+	if m.stats != nil {
+		mf.Tables = m.stats.stats()
+	}
+	mf.BootstrapDDLs = m.bootstrapDDLs
+	mf.Schema = m.schema
+
+	return errors.Annotate(mf.save(m.outputDir), "save manifest failed")
+}
+
+// Close closes the Merge, the temp dir is kept if removeTemp is false,
+// so the next run can resume from the checkpoint in it
+func (m *Merge) Close(removeTemp bool) {
+	if removeTemp {
+		if err := os.RemoveAll(m.tempDir); err != nil {
+			log.Warn("remove temp dir", zap.String("dir", m.tempDir), zap.Error(err))
 		}
 	} else {
-		m.keyEvent[row.oldKey] = row
+		log.Info("temp dir is kept, use --resume and --temp-dir to resume", zap.String("dir", m.tempDir))
 	}
+	m.ddlHandle.Close()
 }
 
-// parserSchemaTableFromDDL parses ddl query to get schema and table
-// ddl like `use test; create table`
-func rewriteDDL(binlog *pb.Binlog, ddlHandle *DDLHandle) (*pb.Binlog, error) {
-	var ddl []byte
-	stmts, _, err := parser.New().Parse(string(binlog.DdlQuery), "", "")
+// ddlRoute is a ddl binlog written to the partition of a table when map
+type ddlRoute struct {
+	schema string
+	table  string
+	binlog *pb.Binlog
+}
 
-	for _, stmt := range stmts {
-		switch node := stmt.(type) {
-		case *ast.CreateDatabaseStmt:
-			continue
-		case *ast.DropDatabaseStmt:
-			tbs, err := ddlHandle.getAllTableNames(node.Name)
-			if err != nil {
-				return nil, err
-			}
-			for _, v := range tbs {
-				sql := fmt.Sprintf("DROP TABLE %s;", v)
-				ddl = append(ddl, sql...)
-			}
-		default:
-			var sb strings.Builder
-			err = node.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb))
-			if err != nil {
-				return nil, err
-			}
-			ddl = append(ddl, sb.String()...)
-			ddl = append(ddl, ';')
+// routeDDL fans the ddl binlog out to the partitions of all the tables changed by it, so the reduce of every partition
+// sees the ddls affecting it. drop table is split into a drop table for every table, the other ddls like rename are
+// written to the first table, and only split the dmls of the other tables at the ddl with an empty query.
+// the database level ddls are written to the database's partition, which is replayed before the tables' at the same
+// commit ts, and drop database splits the dmls of all the tables in it. it's called before the ddl is executed.
+func routeDDL(binlog *pb.Binlog, ddlHandle *DDLHandle) ([]*ddlRoute, error) {
+	stmt, schema, err := parseDDL(string(binlog.DdlQuery))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	newRoute := func(table TableName, query string) *ddlRoute {
+		return &ddlRoute{
+			schema: table.Schema,
+			table:  table.Table,
+			binlog: &pb.Binlog{Tp: pb.BinlogType_DDL, CommitTs: binlog.CommitTs, DdlQuery: []byte(query)},
+		}
+	}
+
+	tables := stmtTables(schema, stmt)
+	if len(tables) == 0 {
+		return nil, errors.Errorf("unknown ddl type, ddl: %s", binlog.DdlQuery)
+	}
+	var routes []*ddlRoute
+	switch node := stmt.(type) {
+	case *ast.CreateDatabaseStmt:
+		// the database may not exist, so it's not used
+		schema = ""
+	case *ast.DropDatabaseStmt:
+		schema = ""
+		names, err := ddlHandle.getAllTableNames(node.Name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, name := range names {
+			tables = append(tables, TableName{Schema: node.Name, Table: name})
+		}
+	case *ast.DropTableStmt:
+		drop := "DROP TABLE "
+		if node.IfExists {
+			drop += "IF EXISTS "
 		}
+		for _, table := range tables {
+			routes = append(routes, newRoute(table, drop+quoteSchema(table.Schema, table.Table)+";"))
+		}
+		return routes, nil
+	}
+
+	var sb strings.Builder
+	if len(schema) != 0 {
+		fmt.Fprintf(&sb, "USE %s;", quoteName(schema))
+	}
+	if err := stmt.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+		return nil, errors.Trace(err)
 	}
-	if ddl == nil {
-		return nil, nil
+	sb.WriteByte(';')
+	routes = append(routes, newRoute(tables[0], sb.String()))
+	for _, table := range tables[1:] {
+		routes = append(routes, newRoute(table, ""))
 	}
-	binlog.DdlQuery = ddl
-	return binlog, nil
+	return routes, nil
 }
@@ -2,22 +2,1275 @@ package pitr
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
 	"github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/util/codec"
 	tb "github.com/pingcap/tipb/go-binlog"
 	"gotest.tools/assert"
 )
 
+const (
+	testTempDir   = "./temp"
+	testOutputDir = "./new_binlog"
+	testTiDBDir   = "/tmp/pitr_tidb"
+)
+
+func newTestConfig(startTS, stopTS int64) *Config {
+	cfg := NewConfig()
+	cfg.TempDir = testTempDir
+	cfg.OutputDir = testOutputDir
+	cfg.TiDBDir = testTiDBDir
+	cfg.CheckSchema = true
+	cfg.StartTSO = startTS
+	cfg.StopTSO = stopTS
+	cfg.Overwrite = true
+	return cfg
+}
+
+func TestMapFilter(t *testing.T) {
+	srcPath := "./maptest_filter"
+	os.RemoveAll(srcPath + "/")
+	os.RemoveAll(testTiDBDir)
+	os.RemoveAll(testTempDir)
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+
+	bin := genTestDDL("test", "tb1", "use test;create table tb1 (a int primary key, b int, c int)", 100)
+	data, _ := bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDML("test", "tb1", 200)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDDL("test", "tb2", "use test;create table tb2 (a int primary key, b int, c int)", 203)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDML("test", "tb2", 204)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	files, fileSize, err := filterFiles(files, 0, 300)
+	assert.Assert(t, err == nil)
+
+	ignoreTables := []filter.TableName{{Schema: "test", Table: "tb2"}}
+	merge, err := NewMerge(newTestConfig(0, 0), nil, files, fileSize, filter.NewFilter(nil, ignoreTables, nil, nil))
+	assert.Assert(t, err == nil)
+
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+
+	_, err = os.Stat(merge.tempDir + "/" + "test_tb1")
+	assert.Assert(t, err == nil)
+	_, err = os.Stat(merge.tempDir + "/" + "test_tb2")
+	assert.Assert(t, os.IsNotExist(err))
+
+	assert.Assert(t, merge.skippedDMLs[quoteSchema("test", "tb2")] == 3)
+	assert.Assert(t, merge.skippedDDLs[quoteSchema("test", "tb2")] == 1)
+	assert.Assert(t, merge.skippedDMLs[quoteSchema("test", "tb1")] == 0)
+
+	merge.ddlHandle.ResetDB()
+	os.RemoveAll(merge.tempDir)
+	os.RemoveAll(merge.outputDir)
+	os.RemoveAll(srcPath + "/")
+}
+
+// readPartition returns how many dml events and ddls in the partition, and the commit ts of them
+func readPartition(t *testing.T, dir string) (int, int, []int64) {
+	// the table's temp dir is split into several partitions, but the output dir is not
+	files := searchTableFiles(t, dir)
+	if len(files) == 0 {
+		var err error
+		files, err = searchFiles(dir)
+		assert.Assert(t, err == nil)
+	}
+	reader, err := newFilesPbReader(files, 0, 0)
+	assert.Assert(t, err == nil)
+	defer reader.close()
+
+	var dmls, ddls int
+	var commitTSs []int64
+	for {
+		binlog, err := reader.read()
+		if err == io.EOF {
+			break
+		}
+		assert.Assert(t, err == nil)
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			ddls++
+		} else {
+			dmls += len(binlog.DmlData.Events)
+		}
+		commitTSs = append(commitTSs, binlog.CommitTs)
+	}
+	return dmls, ddls, commitTSs
+}
+
+func TestMapTSRange(t *testing.T) {
+	srcPath := "./maptest_ts"
+	os.RemoveAll(srcPath + "/")
+	os.RemoveAll(testTiDBDir)
+	os.RemoveAll(testTempDir)
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	bin := genTestDDL("test", "tb1", "use test;create table tb1 (a int primary key, b int, c int)", 100)
+	data, _ := bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	for _, ts := range []int64{200, 300, 400} {
+		bin = genTestDML("test", "tb1", ts)
+		data, _ = bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	bin = genTestDDL("test", "tb1", "use test;alter table tb1 add column d int", 500)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+
+	cases := []struct {
+		startTS int64
+		stopTS  int64
+		dmls    int
+		ddls    int
+		maxTS   int64
+	}{
+		{0, 0, 9, 2, 500},
+		{200, 300, 6, 0, 300},
+		{201, 399, 3, 0, 300},
+		{300, 0, 6, 1, 500},
+		{100, 100, 0, 1, 100},
+	}
+	for _, cs := range cases {
+		merge, err := NewMerge(newTestConfig(cs.startTS, cs.stopTS), nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+		assert.Assert(t, err == nil)
+		err = merge.Map()
+		assert.Assert(t, err == nil)
+
+		dmls, ddls, commitTSs := readPartition(t, merge.tempDir+"/"+"test_tb1")
+		assert.Equal(t, dmls, cs.dmls)
+		assert.Equal(t, ddls, cs.ddls)
+		var maxTS int64
+		for _, ts := range commitTSs {
+			assert.Assert(t, ts >= cs.startTS)
+			assert.Assert(t, cs.stopTS == 0 || ts <= cs.stopTS)
+			if ts > maxTS {
+				maxTS = ts
+			}
+		}
+		assert.Equal(t, maxTS, cs.maxTS)
+
+		merge.ddlHandle.ResetDB()
+		os.RemoveAll(merge.tempDir)
+		os.RemoveAll(merge.outputDir)
+		os.RemoveAll(testTiDBDir)
+	}
+
+	os.RemoveAll(srcPath + "/")
+}
+
+func TestResume(t *testing.T) {
+	srcPath := "./resumetest"
+	os.RemoveAll(srcPath + "/")
+
+	// the first file is fine, and the second file is corrupted at the end
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	bin := genTestDDL("test", "tb1", "use test;create table tb1 (a int primary key, b int, c int)", 100)
+	data, _ := bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDML("test", "tb1", 200)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	b.ManualRotate()
+	bin = genTestDML("test", "tb1", 300)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDDL("test", "tb2", "use test;create table tb2 (a int primary key, b int, c int)", 400)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDML("test", "tb2", 500)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(files) == 2)
+	fi, err := os.Stat(files[1])
+	assert.Assert(t, err == nil)
+	f, err := os.OpenFile(files[1], os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Assert(t, err == nil)
+	f.Write([]byte("corrupted binlog"))
+	f.Close()
+
+	cfg := newTestConfig(0, 0)
+	cfg.TempDir = "./resumetest_temp"
+	cfg.OutputDir = "./resumetest_output"
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err != nil)
+	assert.DeepEqual(t, merge.cp.MappedFiles, files[:1])
+	assert.Assert(t, !merge.cp.MapFinished)
+	merge.ddlHandle.ResetDB()
+
+	// fix the file and resume
+	err = os.Truncate(files[1], fi.Size())
+	assert.Assert(t, err == nil)
+	cfg.Overwrite = false
+	cfg.Resume = true
+	merge, err = NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, merge.cp.MappedFiles, files[:1])
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	// the events written by the failed map are removed
+	dmls, _, _ := readPartition(t, cfg.TempDir+"/"+"test_tb1")
+	assert.Equal(t, dmls, 6)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, merge.cp.MappedFiles, files)
+	assert.DeepEqual(t, merge.cp.ReducedDirs, []string{"test_tb1", "test_tb2"})
+	merge.ddlHandle.ResetDB()
+
+	// the windows can't be changed when resume
+	cfg.WindowTxns = 1
+	_, err = NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.ErrorContains(t, err, "window txns 0 and window ts 0 are different from 1 and 0")
+	cfg.WindowTxns = 0
+
+	// all the dirs are reduced, resume again will not change the output
+	merge, err = NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil)
+	merge.ddlHandle.ResetDB()
+
+	// the output should be same with the run without failure
+	expectCfg := newTestConfig(0, 0)
+	expectCfg.TempDir = "./resumetest_expect_temp"
+	expectCfg.OutputDir = "./resumetest_expect_output"
+	expect, err := NewMerge(expectCfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = expect.Map()
+	assert.Assert(t, err == nil)
+	err = expect.Reduce()
+	assert.Assert(t, err == nil)
+	expect.ddlHandle.ResetDB()
+
+	for _, dir := range []string{"test_tb1", "test_tb2"} {
+		dmls, ddls, commitTSs := readPartition(t, cfg.OutputDir+"/"+dir)
+		expectDMLs, expectDDLs, expectCommitTSs := readPartition(t, expectCfg.OutputDir+"/"+dir)
+		assert.Equal(t, dmls, expectDMLs)
+		assert.Equal(t, ddls, expectDDLs)
+		assert.DeepEqual(t, commitTSs, expectCommitTSs)
+	}
+
+	for _, dir := range []string{srcPath, cfg.TempDir, cfg.OutputDir, expectCfg.TempDir, expectCfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+// readOutput returns the content of all the binlog files in the output sub directory
+func readOutput(t *testing.T, dir string) []byte {
+	files, err := searchFiles(dir)
+	assert.Assert(t, err == nil)
+
+	var content []byte
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		assert.Assert(t, err == nil)
+		content = append(content, data...)
+	}
+	return content
+}
+
+func TestReduceWorkers(t *testing.T) {
+	srcPath := "./reducetest"
+	os.RemoveAll(srcPath + "/")
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	tables := []string{"tb1", "tb2", "tb3", "tb4"}
+	for i, table := range tables {
+		ts := int64(100 * (i + 1))
+		bin := genTestDDL("test", table, fmt.Sprintf("use test;create table %s (a int primary key, b int, c int)", table), ts)
+		data, _ := bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+		for j := int64(1); j <= 3; j++ {
+			bin = genTestDML("test", table, ts+j)
+			data, _ = bin.Marshal()
+			b.WriteTail(&tb.Entity{Payload: data})
+		}
+	}
+	bin := genTestDDL("test", "tb1", "use test;alter table tb1 add column d int", 1000)
+	data, _ := bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestDML("test", "tb1", 1001)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+
+	cfg := newTestConfig(0, 0)
+	cfg.ReduceWorkers = 1
+	cfg.OutputDir = "./reducetest_serial"
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil)
+	merge.ddlHandle.ResetDB()
+
+	// reduce the same temp files again with multiple workers
+	merge.cp.ReducedDirs = nil
+	merge.reduceWorkers = len(tables)
+	merge.outputDir = "./reducetest_parallel"
+	err = os.MkdirAll(merge.outputDir, os.ModePerm)
+	assert.Assert(t, err == nil)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil)
+	merge.ddlHandle.ResetDB()
+
+	for _, table := range tables {
+		serial := readOutput(t, cfg.OutputDir+"/test_"+table)
+		parallel := readOutput(t, merge.outputDir+"/test_"+table)
+		assert.Assert(t, len(serial) != 0)
+		assert.DeepEqual(t, serial, parallel)
+	}
+
+	for _, dir := range []string{srcPath, merge.tempDir, cfg.OutputDir, merge.outputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+// genTestRowDML generates a dml binlog, every row's columns are all set to the key
+func genTestRowDML(schema, table string, tp pb_binlog.EventType, keys []int64, ts int64) *pb_binlog.Binlog {
+	events := make([]pb_binlog.Event, 0, len(keys))
+	for _, key := range keys {
+		var row [][]byte
+		for _, name := range []string{"a", "b", "c"} {
+			col := &pb_binlog.Column{
+				Name:      name,
+				Tp:        []byte{mysql.TypeInt24},
+				MysqlType: "int",
+				Value:     encodeIntValue(key),
+			}
+			data, _ := col.Marshal()
+			row = append(row, data)
+		}
+		events = append(events, pb_binlog.Event{
+			Tp:         tp,
+			SchemaName: &schema,
+			TableName:  &table,
+			Row:        row,
+		})
+	}
+
+	return &pb_binlog.Binlog{
+		Tp:       pb_binlog.BinlogType_DML,
+		DmlData:  &pb_binlog.DMLData{Events: events},
+		CommitTs: ts,
+	}
+}
+
+// genTestKeyUpdateDML generates an update which changes all the columns of the row genTestRowDML generates from key to changedKey
+func genTestKeyUpdateDML(schema, table string, key, changedKey, ts int64) *pb_binlog.Binlog {
+	var row [][]byte
+	for _, name := range []string{"a", "b", "c"} {
+		col := &pb_binlog.Column{
+			Name:         name,
+			Tp:           []byte{mysql.TypeInt24},
+			MysqlType:    "int",
+			Value:        encodeIntValue(key),
+			ChangedValue: encodeIntValue(changedKey),
+		}
+		data, _ := col.Marshal()
+		row = append(row, data)
+	}
+
+	return &pb_binlog.Binlog{
+		Tp: pb_binlog.BinlogType_DML,
+		DmlData: &pb_binlog.DMLData{Events: []pb_binlog.Event{{
+			Tp:         pb_binlog.EventType_Update,
+			SchemaName: &schema,
+			TableName:  &table,
+			Row:        row,
+		}}},
+		CommitTs: ts,
+	}
+}
+
+// readOutputEvents returns the ddls and the sorted dml events between them in the output dir
+func readOutputEvents(t *testing.T, dir string) []string {
+	files, err := searchFiles(dir)
+	assert.Assert(t, err == nil)
+	reader, err := newFilesPbReader(files, 0, 0)
+	assert.Assert(t, err == nil)
+	defer reader.close()
+
+	var events, dmls []string
+	for {
+		binlog, err := reader.read()
+		if err == io.EOF {
+			break
+		}
+		assert.Assert(t, err == nil)
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			sort.Strings(dmls)
+			events = append(append(events, dmls...), string(binlog.DdlQuery))
+			dmls = nil
+			continue
+		}
+		for _, ev := range binlog.DmlData.Events {
+			data, err := ev.Marshal()
+			assert.Assert(t, err == nil)
+			dmls = append(dmls, string(data))
+		}
+	}
+	sort.Strings(dmls)
+	return append(events, dmls...)
+}
+
+func TestReduceMaxMemory(t *testing.T) {
+	srcPath := "./memorytest"
+	for _, dir := range []string{srcPath, "./memorytest_expect", "./memorytest_output", "./memorytest_spill"} {
+		os.RemoveAll(dir + "/")
+	}
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	bin := genTestDDL("test", "tbm", "use test;create table tbm (a int primary key, b int, c int)", 100)
+	data, _ := bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	var keys []int64
+	for i := int64(0); i < 10; i++ {
+		var batch []int64
+		for j := int64(0); j < 10; j++ {
+			batch = append(batch, i*10+j)
+		}
+		keys = append(keys, batch...)
+		bin = genTestRowDML("test", "tbm", pb_binlog.EventType_Insert, batch, 200+i)
+		data, _ = bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	bin = genTestDDL("test", "tbm", "use test;alter table tbm add index idx_b(b)", 300)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	bin = genTestRowDML("test", "tbm", pb_binlog.EventType_Delete, keys[:50], 400)
+	data, _ = bin.Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	fileSize, err := getTotalFileSize(files)
+	assert.Assert(t, err == nil)
+
+	reduce := func(splitMemory, reduceMemory int64, outputDir string) (*Merge, *reducer) {
+		cfg := newTestConfig(0, 0)
+		cfg.MaxMemory = splitMemory
+		merge, err := NewMerge(cfg, nil, files, fileSize, filter.NewFilter(nil, nil, nil, nil))
+		assert.Assert(t, err == nil)
+		err = merge.Map()
+		assert.Assert(t, err == nil)
+
+		out, err := newBinlogSink(outputDir)
+		assert.Assert(t, err == nil)
+		defer out.close()
+		r := newReducer(merge.ddlHandle, reduceMemory, merge.tempDir+"/test_tbm/"+spillPartition)
+		defer r.close()
+		err = r.reduce(out, merge.tempDir+"/test_tbm")
+		assert.Assert(t, err == nil)
+		merge.ddlHandle.ResetDB()
+		return merge, r
+	}
+
+	// all the binlogs can be reduced in memory
+	merge, r := reduce(fileSize, defaultMaxMemory, "./memorytest_expect")
+	assert.Equal(t, merge.splitNum, 1)
+	assert.Equal(t, r.maxCachedEvents, len(keys))
+	assert.Equal(t, r.spills, 0)
+
+	// the binlogs are split into 4 buckets, and only one bucket is cached in memory
+	merge, r = reduce((fileSize+3)/4, defaultMaxMemory, "./memorytest_output")
+	assert.Equal(t, merge.splitNum, 4)
+	subDirs, err := readSubDirs(merge.tempDir + "/test_tbm")
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, subDirs, []string{ddlPartition, dmlPartition(0), dmlPartition(1), dmlPartition(2), dmlPartition(3)})
+	assert.Assert(t, r.maxCachedEvents < len(keys))
+
+	expect := readOutputEvents(t, "./memorytest_expect")
+	// create table, 100 inserts, alter table and 50 deletes
+	assert.Equal(t, len(expect), 152)
+	assert.DeepEqual(t, readOutputEvents(t, "./memorytest_output"), expect)
+
+	// the events are spilled to disk, and the output is same with the one reduced in memory
+	merge, r = reduce(fileSize, 1024, "./memorytest_spill")
+	assert.Equal(t, merge.splitNum, 1)
+	assert.Assert(t, r.spills > 0)
+	_, err = os.Stat(merge.tempDir + "/test_tbm/" + spillPartition)
+	assert.Assert(t, os.IsNotExist(err))
+	assert.DeepEqual(t, readOutput(t, "./memorytest_spill"), readOutput(t, "./memorytest_expect"))
+
+	for _, dir := range []string{srcPath, merge.tempDir, "./memorytest_expect", "./memorytest_output", "./memorytest_spill"} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestMapKeyReuse(t *testing.T) {
+	srcPath := "./keyreusetest"
+	schema, table := "test", "tbr"
+	// the row 1 takes the key 2 and is deleted, then the row x takes the key 2 and is deleted,
+	// the events of the row x must be in the same bucket even if the alias of key 2 is the row 1 before
+	for x := int64(3); x <= 12; x++ {
+		os.RemoveAll(srcPath + "/")
+		b, err := OpenMyBinlogger(srcPath)
+		assert.Assert(t, err == nil)
+		for _, bin := range []*pb_binlog.Binlog{
+			genTestDDL(schema, table, "use test;create table tbr (a int primary key, b int, c int)", 100),
+			genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{1}, 110),
+			genTestKeyUpdateDML(schema, table, 1, 2, 120),
+			genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{2}, 130),
+			genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{x}, 140),
+			genTestKeyUpdateDML(schema, table, x, 2, 150),
+			genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{2}, 160),
+		} {
+			data, _ := bin.Marshal()
+			b.WriteTail(&tb.Entity{Payload: data})
+		}
+		b.Close()
+
+		files, err := searchFiles(srcPath)
+		assert.Assert(t, err == nil)
+		fileSize, err := getTotalFileSize(files)
+		assert.Assert(t, err == nil)
+		cfg := newTestConfig(0, 0)
+		cfg.CheckSchema = false
+		cfg.MaxMemory = (fileSize + 1) / 2
+		merge, err := NewMerge(cfg, nil, files, fileSize, filter.NewFilter(nil, nil, nil, nil))
+		assert.Assert(t, err == nil)
+		assert.Assert(t, merge.splitNum >= 2)
+		err = merge.Map()
+		assert.Assert(t, err == nil, err)
+		err = merge.Reduce()
+		assert.Assert(t, err == nil, err)
+
+		// the rows are inserted and deleted, nothing is left
+		dmls, _, _ := readPartition(t, cfg.OutputDir+"/test_tbr")
+		assert.Equal(t, dmls, 0)
+	}
+
+	for _, dir := range []string{srcPath, testTempDir, testOutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestReduceKeyChange(t *testing.T) {
+	srcPath := "./keychangetest"
+	os.RemoveAll(srcPath + "/")
+
+	schema, table := "test", "tbk"
+	// the row with key 1 is deleted, and then the key of the row 2 is changed to 1, and then to 3 and deleted.
+	// the key 3 is taken by the rows 4 to 9 one after another, the rows 4 to 8 are deleted with it
+	binlogs := []*pb_binlog.Binlog{
+		genTestDDL(schema, table, "use test;create table tbk (a int primary key, b int, c int)", 100),
+		genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{1}, 200),
+		genTestKeyUpdateDML(schema, table, 2, 1, 300),
+		genTestKeyUpdateDML(schema, table, 1, 3, 310),
+		genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{3}, 320),
+	}
+	for x := int64(4); x <= 9; x++ {
+		ts := 400 + x*10
+		binlogs = append(binlogs,
+			genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{x}, ts),
+			genTestKeyUpdateDML(schema, table, x, 3, ts+1))
+		if x != 9 {
+			binlogs = append(binlogs, genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{3}, ts+2))
+		}
+	}
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	for _, bin := range binlogs {
+		data, _ := bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	fileSize, err := getTotalFileSize(files)
+	assert.Assert(t, err == nil)
+	cfg := newTestConfig(0, 0)
+	cfg.MaxMemory = (fileSize + 1) / 2
+	merge, err := NewMerge(cfg, nil, files, fileSize, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil, err)
+	// the delete of key 1 and the update of key 2 are in different buckets
+	subDirs, err := readSubDirs(merge.tempDir + "/test_tbk")
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, subDirs, []string{ddlPartition, dmlPartition(0), dmlPartition(1)})
+	err = merge.Reduce()
+	assert.Assert(t, err == nil, err)
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+
+	// the deletes of all the buckets are before the insert of key 3, so the row 9 is not deleted after it takes the key
+	var events []string
+	err = readBinlogDirs([]string{cfg.OutputDir + "/test_tbk"}, 0, 0, func(binlog *pb_binlog.Binlog) error {
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			return nil
+		}
+		for _, ev := range binlog.DmlData.Events {
+			col := &pb_binlog.Column{}
+			assert.Assert(t, col.Unmarshal(ev.GetRow()[0]) == nil)
+			_, v, err := codec.DecodeOne(col.Value)
+			assert.Assert(t, err == nil)
+			events = append(events, fmt.Sprintf("%s %v", ev.GetTp(), v.GetValue()))
+		}
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	assert.Equal(t, len(events), 3)
+	assert.Equal(t, events[2], "Insert 3")
+	sort.Strings(events[:2])
+	assert.DeepEqual(t, events[:2], []string{"Delete 1", "Delete 2"})
+	_, err = os.Stat(merge.tempDir + "/test_tbk/" + deferredPartition)
+	assert.Assert(t, os.IsNotExist(err))
+
+	for _, dir := range []string{srcPath, merge.tempDir, merge.outputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srcPath := "./verifytest"
+	cfg := newTestConfig(150, 0)
+	cfg.OutputDir = "./verifytest_output"
+	cfg.MergedDir = cfg.OutputDir
+	for _, dir := range []string{srcPath, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+
+	// the table is created before start ts, so it's not in the merged binlogs
+	err := writeTestBinlogs(srcPath,
+		genTestDDL("test", "tbv", "use test;create table tbv (a int primary key, b int, c int)", 100),
+		genTestRowDML("test", "tbv", pb_binlog.EventType_Insert, []int64{1, 2, 3, 4}, 200),
+		genTestUpdateDML("test", "tbv", 1, 1, 5, 210),
+		genTestRowDML("test", "tbv", pb_binlog.EventType_Delete, []int64{2, 3}, 220),
+		genTestDDL("test", "tbw", "use test;create table tbw (a int, b int, c int)", 230),
+		genTestRowDML("test", "tbw", pb_binlog.EventType_Insert, []int64{1, 2, 3}, 240),
+		genTestRowDML("test", "tbw", pb_binlog.EventType_Delete, []int64{2}, 250),
+		genTestDDL("test", "tbv", "use test;alter table tbv add column d int", 300),
+		genTestRowDML("test", "tbv", pb_binlog.EventType_Insert, []int64{20, 21}, 310),
+		genTestUpdateDML("test", "tbv", 1, 5, 6, 320),
+		genTestRowDML("test", "tbv", pb_binlog.EventType_Delete, []int64{4}, 330),
+		// the tables are renamed and created like the tables whose directories sort after them
+		genTestDDL("test", "z", "use test;create table z (a int primary key, b int, c int)", 340),
+		genTestRowDML("test", "z", pb_binlog.EventType_Insert, []int64{1, 2}, 350),
+		genTestDDL("test", "b", "use test;rename table z to b", 360),
+		genTestRowDML("test", "b", pb_binlog.EventType_Insert, []int64{3}, 370),
+		genTestDDL("test", "a", "use test;create table a like b", 380),
+		genTestRowDML("test", "a", pb_binlog.EventType_Insert, []int64{4}, 390),
+	)
+	assert.Assert(t, err == nil, err)
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil)
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+
+	v, err := NewVerifier(cfg)
+	assert.Assert(t, err == nil)
+	v.ddlHandle = merge.ddlHandle
+	diffs, err := v.verify(files, nil)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(diffs), 0)
+
+	// the row inserted into the merged binlogs is found
+	binlogger, err := binlogfile.OpenBinlogger(cfg.OutputDir + "/test_tbv")
+	assert.Assert(t, err == nil)
+	bin := genTestRowDML("test", "tbv", pb_binlog.EventType_Insert, []int64{99}, 400)
+	data, _ := bin.Marshal()
+	_, err = binlogger.WriteTail(&tb.Entity{Payload: data})
+	assert.Assert(t, err == nil)
+	binlogger.Close()
+
+	diffs, err = v.verify(files, nil)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(diffs), 1)
+	assert.Equal(t, diffs[0].Table, "tbv")
+	assert.Equal(t, diffs[0].OriginalRows, 3)
+	assert.Equal(t, diffs[0].MergedRows, 4)
+	assert.DeepEqual(t, diffs[0].Keys, []KeyDiff{{Key: "test|tbv|99|", Reason: "not exists in original"}})
+
+	for _, dir := range []string{srcPath, merge.tempDir, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestStat(t *testing.T) {
+	srcPath := "./stattest"
+	cfg := newTestConfig(0, 0)
+	cfg.OutputDir = "./stattest_output"
+	for _, dir := range []string{srcPath, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+
+	schema, table := "test", "tbs"
+	ddl := genTestDDL(schema, table, "use test;create table tbs (a int primary key, b int, c int)", 100)
+	insert := genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{1, 2, 3}, 200)
+	update := &pb_binlog.Binlog{Tp: pb_binlog.BinlogType_DML, CommitTs: 210, DmlData: &pb_binlog.DMLData{Events: []pb_binlog.Event{{
+		Tp: pb_binlog.EventType_Update, SchemaName: &schema, TableName: &table, Row: generateRow(1, 1, 1, 5),
+	}}}}
+	del := genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{2}, 220)
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	for _, bin := range []*pb_binlog.Binlog{ddl, insert, update, del} {
+		data, _ := bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil)
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+
+	// key 2 is inserted and deleted, only the insert of key 1 and 3 are output
+	var bytes int64
+	for _, bin := range []*pb_binlog.Binlog{insert, update, del} {
+		for _, ev := range bin.DmlData.Events {
+			bytes += int64(ev.Size())
+		}
+	}
+	expected := tableStat{Schema: schema, Table: table, Inserts: 3, Updates: 1, Deletes: 1, DDLs: 1, Keys: 3}
+	expected.Bytes = bytes + int64(ddl.Size())
+	expected.OutputBytes = int64(ddl.Size() + update.DmlData.Events[0].Size() + insert.DmlData.Events[2].Size())
+
+	// the output bytes of compact is the real size of the output binlogs
+	compactStats := merge.stats.stats()
+	assert.Equal(t, len(compactStats), 1)
+	assert.Assert(t, compactStats[0].OutputBytes > 0)
+	compactStats[0].OutputBytes = expected.OutputBytes
+	assert.Assert(t, reflect.DeepEqual(*compactStats[0], expected), "%+v", compactStats[0])
+
+	s, err := NewStat(cfg)
+	assert.Assert(t, err == nil)
+	s.ddlHandle = merge.ddlHandle
+	stats, err := s.stat([]string{srcPath})
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(stats), 1)
+	assert.Assert(t, reflect.DeepEqual(*stats[0], expected), "%+v", stats[0])
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+
+	var out strings.Builder
+	err = printJSONTableStats(&out, stats)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, strings.Contains(out.String(), `"keys": 3`), out.String())
+	assert.Assert(t, strings.Contains(out.String(), fmt.Sprintf(`"ratio": %v`, expected.Ratio())), out.String())
+
+	for _, dir := range []string{srcPath, merge.tempDir, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestSingleOutput(t *testing.T) {
+	srcPath := "./singletest"
+	cfg := newTestConfig(0, 0)
+	cfg.OutputDir = "./singletest_output"
+	cfg.SingleOutput = true
+	for _, dir := range []string{srcPath, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	for _, bin := range []*pb_binlog.Binlog{
+		genTestDDL("test", "tbp", "use test;create table tbp (a int primary key, b int, c int)", 100),
+		genTestDDL("test", "tbr", "use test;create table tbr (a int primary key, b int, c int)", 110),
+		genTestRowDML("test", "tbp", pb_binlog.EventType_Insert, []int64{1, 2}, 200),
+		genTestDDL("test", "tbr", "use test;alter table tbr add column d int", 300),
+		genTestRowDML("test", "tbp", pb_binlog.EventType_Insert, []int64{3}, 310),
+		genTestRowDML("test", "tbr", pb_binlog.EventType_Insert, []int64{1}, 320),
+	} {
+		data, _ := bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil, err)
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+
+	// the binlogs are in one directory, and the inserts of tbp are not merged across the ddl of tbr
+	dirs, err := searchBinlogDirs(cfg.OutputDir)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dirs, []string{cfg.OutputDir})
+	var binlogs []string
+	err = readBinlogDirs(dirs, 0, 0, func(binlog *pb_binlog.Binlog) error {
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			binlogs = append(binlogs, fmt.Sprintf("%d DDL %s", binlog.CommitTs, binlog.DdlQuery))
+			return nil
+		}
+		ev := binlog.DmlData.Events[0]
+		binlogs = append(binlogs, fmt.Sprintf("%d DML %s %d", binlog.CommitTs, ev.GetTableName(), len(binlog.DmlData.Events)))
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, binlogs, []string{
+		"100 DDL USE `test`;CREATE TABLE `tbp` (`a` INT PRIMARY KEY,`b` INT,`c` INT);",
+		"110 DDL USE `test`;CREATE TABLE `tbr` (`a` INT PRIMARY KEY,`b` INT,`c` INT);",
+		"299 DML tbp 2",
+		"300 DDL USE `test`;ALTER TABLE `tbr` ADD COLUMN `d` INT;",
+		"310 DML tbp 1",
+		"320 DML tbr 1",
+	})
+
+	for _, dir := range []string{srcPath, merge.tempDir, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestSingleOutputDatabase(t *testing.T) {
+	srcPath := "./singledbtest"
+	cfg := newTestConfig(0, 0)
+	cfg.OutputDir = "./singledbtest_output"
+	cfg.SingleOutput = true
+	cfg.CheckSchema = false
+	for _, dir := range []string{srcPath, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+
+	createTable := "use d;create table t (a int primary key, b int, c int)"
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	for _, bin := range []*pb_binlog.Binlog{
+		genTestDDL("d", "", "create database d", 100),
+		genTestDDL("d", "t", createTable, 110),
+		genTestRowDML("d", "t", pb_binlog.EventType_Insert, []int64{1}, 120),
+		genTestDDL("d", "", "drop database d", 130),
+		genTestDDL("d", "", "create database d", 140),
+		genTestDDL("d", "t", createTable, 150),
+		genTestRowDML("d", "t", pb_binlog.EventType_Insert, []int64{2}, 160),
+	} {
+		data, _ := bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil, err)
+	err = merge.Reduce()
+	assert.Assert(t, err == nil, err)
+
+	// the database is dropped and created again in the output, before the table in it is created
+	var binlogs []string
+	err = readBinlogDirs([]string{cfg.OutputDir}, 0, 0, func(binlog *pb_binlog.Binlog) error {
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			binlogs = append(binlogs, fmt.Sprintf("%d DDL %s", binlog.CommitTs, binlog.DdlQuery))
+			return nil
+		}
+		binlogs = append(binlogs, fmt.Sprintf("%d DML %s %d", binlog.CommitTs, binlog.DmlData.Events[0].GetTableName(), len(binlog.DmlData.Events)))
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	createT := "USE `d`;CREATE TABLE `t` (`a` INT PRIMARY KEY,`b` INT,`c` INT);"
+	assert.DeepEqual(t, binlogs, []string{
+		"100 DDL CREATE DATABASE `d`;",
+		"110 DDL " + createT,
+		"129 DML t 1",
+		"130 DDL DROP DATABASE `d`;",
+		"140 DDL CREATE DATABASE `d`;",
+		"150 DDL " + createT,
+		"160 DML t 1",
+	})
+
+	for _, dir := range []string{srcPath, merge.tempDir, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestMergeWindows(t *testing.T) {
+	srcPath := "./windowtest"
+	cfg := newTestConfig(0, 0)
+	cfg.OutputDir = "./windowtest_output"
+	cfg.WindowTxns = 2
+	for _, dir := range []string{srcPath, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+
+	schema, table := "test", "tbt"
+	err := writeTestBinlogs(srcPath,
+		genTestDDL(schema, table, "use test;create table tbt (a int primary key, b int, c int)", 100),
+		genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{1}, 200),
+		genTestUpdateDML(schema, table, 1, 1, 5, 210),
+		genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{2}, 220),
+		genTestUpdateDML(schema, table, 2, 2, 6, 230),
+		genTestUpdateDML(schema, table, 1, 5, 7, 240),
+	)
+	assert.Assert(t, err == nil, err)
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil)
+	err = merge.Map()
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, merge.cp.Windows, []int64{211, 231, 241})
+	err = merge.Reduce()
+	assert.Assert(t, err == nil, err)
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+
+	// every window of 2 transactions is merged, and output with the commit ts of its last transaction
+	var binlogs []string
+	err = readBinlogDirs([]string{cfg.OutputDir + "/test_tbt"}, 0, 0, func(binlog *pb_binlog.Binlog) error {
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			binlogs = append(binlogs, fmt.Sprintf("%d DDL", binlog.CommitTs))
+			return nil
+		}
+		for _, ev := range binlog.DmlData.Events {
+			col := &pb_binlog.Column{}
+			assert.Assert(t, col.Unmarshal(ev.GetRow()[2]) == nil)
+			data := col.Value
+			if ev.GetTp() == pb_binlog.EventType_Update {
+				data = col.ChangedValue
+			}
+			_, c, err := codec.DecodeOne(data)
+			assert.Assert(t, err == nil)
+			binlogs = append(binlogs, fmt.Sprintf("%d %s c=%v", binlog.CommitTs, ev.GetTp(), c.GetValue()))
+		}
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, binlogs, []string{
+		"100 DDL",
+		"210 Insert c=5",
+		"230 Insert c=6",
+		"240 Update c=7",
+	})
+
+	for _, dir := range []string{srcPath, merge.tempDir, cfg.OutputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestIncrementalMerge(t *testing.T) {
+	srcPath := "./incrtest"
+	baseDir, outputDir := "./incrtest_base", "./incrtest_output"
+	for _, dir := range []string{srcPath, baseDir, outputDir} {
+		os.RemoveAll(dir + "/")
+	}
+
+	schema, table := "test", "tbi"
+	compact := func(cfg *Config) *Merge {
+		files, err := searchFiles(srcPath)
+		assert.Assert(t, err == nil)
+		merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+		assert.Assert(t, err == nil, err)
+		err = merge.Map()
+		assert.Assert(t, err == nil, err)
+		err = merge.Reduce()
+		assert.Assert(t, err == nil, err)
+		err = merge.SaveManifest(cfg)
+		assert.Assert(t, err == nil, err)
+		err = merge.ddlHandle.ResetDB()
+		assert.Assert(t, err == nil)
+		return merge
+	}
+
+	// the table is created before start ts, it's saved in the manifest of base
+	err := writeTestBinlogs(srcPath,
+		genTestDDL(schema, table, "use test;create table tbi (a int primary key, b int, c int)", 100),
+		genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{1, 2}, 200),
+		genTestUpdateDML(schema, table, 1, 1, 5, 220),
+	)
+	assert.Assert(t, err == nil, err)
+	cfg := newTestConfig(150, 0)
+	cfg.OutputDir = baseDir
+	merge := compact(cfg)
+	os.RemoveAll(merge.tempDir)
+	base, err := loadManifest(baseDir)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, base.StartTS, int64(150))
+	assert.Equal(t, base.StopTS, int64(220))
+	assert.Equal(t, len(base.BootstrapDDLs), 2)
+	assert.Assert(t, strings.Contains(base.BootstrapDDLs[1], "CREATE TABLE `tbi`"), base.BootstrapDDLs[1])
+
+	// the binlogs in the same dir before the stop ts of base are skipped
+	err = writeTestBinlogs(srcPath,
+		genTestUpdateDML(schema, table, 1, 5, 6, 300),
+		genTestRowDML(schema, table, pb_binlog.EventType_Delete, []int64{2}, 310),
+		genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{3}, 320),
+	)
+	assert.Assert(t, err == nil, err)
+	cfg = newTestConfig(0, 0)
+	cfg.OutputDir = outputDir
+	cfg.BaseDir = baseDir
+	merge = compact(cfg)
+
+	var rows []string
+	err = readBinlogDirs([]string{outputDir + "/test_tbi"}, 0, 0, func(binlog *pb_binlog.Binlog) error {
+		for _, ev := range binlog.DmlData.Events {
+			var values []string
+			for _, data := range ev.GetRow() {
+				col := &pb_binlog.Column{}
+				assert.Assert(t, col.Unmarshal(data) == nil)
+				_, v, err := codec.DecodeOne(col.Value)
+				assert.Assert(t, err == nil)
+				values = append(values, fmt.Sprintf("%v", v.GetValue()))
+			}
+			rows = append(rows, fmt.Sprintf("%s %s", ev.GetTp(), strings.Join(values, ",")))
+		}
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, rows, []string{"Insert 1,1,6", "Insert 3,3,3"})
+
+	mf, err := loadManifest(outputDir)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, mf.StartTS, int64(150))
+	assert.Equal(t, mf.StopTS, int64(320))
+	assert.Equal(t, mf.FirstTS, int64(220))
+	assert.Equal(t, mf.LastTS, int64(320))
+	assert.Equal(t, mf.BaseStopTS, int64(220))
+	assert.DeepEqual(t, mf.BootstrapDDLs, base.BootstrapDDLs)
+	assert.DeepEqual(t, mf.Schema, base.BootstrapDDLs)
+	assert.Equal(t, len(mf.Inputs), 1)
+	assert.Equal(t, mf.Config.BaseDir, baseDir)
+	assert.Assert(t, len(mf.Files) != 0)
+	assert.Assert(t, checkManifest(outputDir) == nil)
+
+	// the changed output file is found by the checksum
+	f, err := os.OpenFile(path.Join(outputDir, mf.Files[0].Path), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Assert(t, err == nil, err)
+	_, err = f.Write([]byte("x"))
+	assert.Assert(t, err == nil)
+	f.Close()
+	assert.ErrorContains(t, checkManifest(outputDir), "is changed")
+
+	// the base can't be used if the stop ts is covered by it
+	cfg.StopTSO = 200
+	_, err = NewMerge(cfg, nil, nil, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.ErrorContains(t, err, "stop ts 200 is covered by base")
+
+	for _, dir := range []string{srcPath, merge.tempDir, baseDir, outputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	srcPath := "./versiontest"
+	os.RemoveAll(srcPath + "/")
+
+	schema, table := "test", "tbv"
+	err := writeTestBinlogs(srcPath,
+		// without unique key, the key of the row is all the columns
+		genTestDDL(schema, table, "use test;create table tbv (a int, b int, c int)", 100),
+		genTestRowDML(schema, table, pb_binlog.EventType_Insert, []int64{1, 2}, 200),
+		genTestUpdateDML(schema, table, 1, 1, 5, 210),
+		genTestDDL(schema, table, "alter table test.tbv add unique index uk(a)", 300),
+		genTestUpdateDML(schema, table, 2, 2, 6, 400),
+		genTestUpdateDML(schema, table, 2, 6, 7, 410),
+	)
+	assert.Assert(t, err == nil, err)
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	cfg := newTestConfig(0, 0)
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil, err)
+	err = merge.Map()
+	assert.Assert(t, err == nil, err)
+	// reduce uses the versions of the table info saved when map, the ddls are not executed again
+	err = merge.ddlHandle.ResetDB()
+	assert.Assert(t, err == nil)
+	info, err := merge.ddlHandle.GetTableInfoAt(schema, table, 210)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(info.uniqueKeys), 0)
+	info, err = merge.ddlHandle.GetTableInfoAt(schema, table, 400)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, info.uniqueKeys[0].name, "uk")
+	err = merge.Reduce()
+	assert.Assert(t, err == nil, err)
+
+	var events []string
+	err = readBinlogDirs([]string{cfg.OutputDir + "/test_tbv"}, 0, 0, func(binlog *pb_binlog.Binlog) error {
+		if binlog.Tp == pb_binlog.BinlogType_DDL {
+			events = append(events, fmt.Sprintf("%d DDL", binlog.CommitTs))
+			return nil
+		}
+		for _, ev := range binlog.DmlData.Events {
+			var values []string
+			for _, data := range ev.GetRow() {
+				col := &pb_binlog.Column{}
+				assert.Assert(t, col.Unmarshal(data) == nil)
+				value := col.Value
+				if ev.GetTp() == pb_binlog.EventType_Update {
+					value = col.ChangedValue
+				}
+				_, v, err := codec.DecodeOne(value)
+				assert.Assert(t, err == nil)
+				values = append(values, fmt.Sprintf("%v", v.GetValue()))
+			}
+			events = append(events, fmt.Sprintf("%d %s %s", binlog.CommitTs, ev.GetTp(), strings.Join(values, ",")))
+		}
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, events, []string{"100 DDL", "299 Insert 1,1,5", "299 Insert 2,2,2", "300 DDL", "410 Update 2,2,7"})
+
+	for _, dir := range []string{srcPath, merge.tempDir, merge.outputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
+func TestMultiTableDDL(t *testing.T) {
+	srcPath := "./multitabletest"
+	os.RemoveAll(srcPath + "/")
+
+	b, err := OpenMyBinlogger(srcPath)
+	assert.Assert(t, err == nil)
+	for _, bin := range []*pb_binlog.Binlog{
+		genTestDDL("test", "a", "use test;create table a (a int primary key, b int, c int)", 100),
+		genTestDDL("test", "b", "use test;create table b (a int primary key, b int, c int)", 110),
+		genTestDDL("test", "c", "use test;create table c like a", 120),
+		genTestDDL("test1", "", "create database test1", 130),
+		genTestRowDML("test", "a", pb_binlog.EventType_Insert, []int64{1}, 140),
+		genTestRowDML("test", "c", pb_binlog.EventType_Insert, []int64{1}, 140),
+		genTestDDL("test", "b", "use test;drop table b, c", 150),
+		genTestDDL("test", "d", "use test;create table d like a", 160),
+		genTestDDL("test", "e", "use test;rename table a to e, d to test1.f", 170),
+		genTestRowDML("test1", "f", pb_binlog.EventType_Insert, []int64{2}, 180),
+		genTestDDL("test", "a", "use test;create table a (a int primary key, b int, c int)", 190),
+		genTestRowDML("test", "a", pb_binlog.EventType_Insert, []int64{1}, 200),
+		genTestDDL("test1", "", "use test;drop database test1", 210),
+	} {
+		data, _ := bin.Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.Assert(t, err == nil)
+	cfg := newTestConfig(0, 0)
+	// the mock tidb can't rename more than one table in a ddl
+	cfg.CheckSchema = false
+	merge, err := NewMerge(cfg, nil, files, 0, filter.NewFilter(nil, nil, nil, nil))
+	assert.Assert(t, err == nil, err)
+	err = merge.Map()
+	assert.Assert(t, err == nil, err)
+
+	// every partition has the ddls changing its table, the renamed tables except the first one have the ddl without query
+	readDDLs := func(dir string) []string {
+		files, err := searchFiles(path.Join(merge.tempDir, dir, ddlPartition))
+		assert.Assert(t, err == nil)
+		reader, err := newFilesPbReader(files, 0, 0)
+		assert.Assert(t, err == nil)
+		defer reader.close()
+
+		var ddls []string
+		err = readAll(reader, func(binlog *pb_binlog.Binlog) error {
+			ddls = append(ddls, fmt.Sprintf("%d %s", binlog.CommitTs, binlog.DdlQuery))
+			return nil
+		})
+		assert.Assert(t, err == nil, err)
+		return ddls
+	}
+	createA := "USE `test`;CREATE TABLE `a` (`a` INT PRIMARY KEY,`b` INT,`c` INT);"
+	assert.DeepEqual(t, readDDLs("test_a"), []string{"100 " + createA, "170 ", "190 " + createA})
+	assert.DeepEqual(t, readDDLs("test_b"), []string{"110 USE `test`;CREATE TABLE `b` (`a` INT PRIMARY KEY,`b` INT,`c` INT);", "150 DROP TABLE `test`.`b`;"})
+	assert.DeepEqual(t, readDDLs("test_c"), []string{"120 USE `test`;CREATE TABLE `c` LIKE `a`;", "150 DROP TABLE `test`.`c`;"})
+	assert.DeepEqual(t, readDDLs("test_d"), []string{"160 USE `test`;CREATE TABLE `d` LIKE `a`;", "170 "})
+	assert.DeepEqual(t, readDDLs("test_e"), []string{"170 USE `test`;RENAME TABLE `a` TO `e`, `d` TO `test1`.`f`;"})
+	assert.DeepEqual(t, readDDLs("test1_f"), []string{"170 ", "210 "})
+	// the database level ddls are in the database's partition
+	assert.DeepEqual(t, readDDLs("test1_"), []string{"130 CREATE DATABASE `test1`;", "210 DROP DATABASE `test1`;"})
+
+	// the versions of all the tables changed by the ddls are saved
+	for _, c := range []struct {
+		schema, table string
+		ts            int64
+		exist         bool
+	}{
+		{"test", "c", 140, true}, {"test", "b", 150, false}, {"test", "c", 150, false},
+		{"test", "a", 170, false}, {"test", "d", 170, false}, {"test", "e", 170, true}, {"test1", "f", 170, true},
+		{"test1", "f", 210, false},
+	} {
+		info, err := merge.ddlHandle.GetTableInfoAt(c.schema, c.table, c.ts)
+		assert.Equal(t, err == nil, c.exist, "%s at %d", quoteSchema(c.schema, c.table), c.ts)
+		if c.exist {
+			assert.DeepEqual(t, info.columns, []string{"a", "b", "c"})
+		}
+	}
+
+	// the dmls of the old table a are output before the rename, not merged with the ones of the new table a
+	err = merge.Reduce()
+	assert.Assert(t, err == nil, err)
+	_, _, commitTSs := readPartition(t, path.Join(merge.outputDir, "test_a"))
+	assert.DeepEqual(t, commitTSs[:3], []int64{100, 169, 190})
+
+	for _, dir := range []string{srcPath, merge.tempDir, merge.outputDir} {
+		os.RemoveAll(dir + "/")
+	}
+}
+
 func TestMapFunc1(t *testing.T) {
 	dstPath := "./test_map"
 	srcPath := "./maptest"
 	os.RemoveAll(dstPath + "/")
 	os.RemoveAll(srcPath + "/")
-	os.RemoveAll(defaultTiDBDir)
-	os.RemoveAll(defaultTempDir)
+	os.RemoveAll(testTiDBDir)
+	os.RemoveAll(testTempDir)
 
 	//generate files
 
@@ -55,20 +1308,20 @@ func TestMapFunc1(t *testing.T) {
 	files, fileSize, err := filterFiles(files, 0, 300)
 	assert.Assert(t, err == nil)
 
-	merge, err := NewMerge(nil, files, fileSize)
+	cfg := newTestConfig(0, 0)
+	cfg.OutputDir = dstPath
+	merge, err := NewMerge(cfg, nil, files, fileSize, filter.NewFilter(nil, nil, nil, nil))
 	assert.Assert(t, err == nil)
 
 	err = merge.Map()
 	assert.Assert(t, err == nil)
 
-	tb1, err := searchFiles(merge.tempDir + "/" + "test_tb1")
-	assert.Assert(t, err == nil)
+	tb1 := searchTableFiles(t, merge.tempDir+"/"+"test_tb1")
 	tb1f, _, err := filterFiles(tb1, 0, 300)
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(tb1f) == 3)
 
-	tb2, err := searchFiles(merge.tempDir + "/" + "test_tb2")
-	assert.Assert(t, err == nil)
+	tb2 := searchTableFiles(t, merge.tempDir+"/"+"test_tb2")
 	tb2f, _, err := filterFiles(tb2, 0, 300)
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(tb2f) == 2)
@@ -76,32 +1329,7 @@ func TestMapFunc1(t *testing.T) {
 	err = merge.Reduce()
 	assert.Assert(t, err == nil)
 
-	merge.ddlHandle.ResetDB()
-	sql := "create database test1; use test1; create table tb1 (a int);"
-	mybin := &pb_binlog.Binlog{
-		Tp:       pb_binlog.BinlogType_DDL,
-		CommitTs: 100,
-		DdlQuery: []byte(sql),
-	}
-	log, err := rewriteDDL(mybin, merge.ddlHandle)
-	assert.Assert(t, err == nil)
-	assert.Assert(t, strings.EqualFold(string(log.DdlQuery), "USE `test1`;CREATE TABLE `tb1` (`a` INT);"))
-	merge.ddlHandle.ExecuteDDL(sql)
-
-	sql = "drop database test1; create database test2; use test; show tables;"
-	mybin = &pb_binlog.Binlog{
-		Tp:       pb_binlog.BinlogType_DDL,
-		CommitTs: 100,
-		DdlQuery: []byte(sql),
-	}
-	log, err = rewriteDDL(mybin, merge.ddlHandle)
-	fmt.Printf("%v\n", err)
-	fmt.Printf("## %s\n", string(log.String()))
-	assert.Assert(t, err == nil)
-	assert.Assert(t, strings.EqualFold(string(log.DdlQuery), "DROP TABLE tb1;USE `test`;SHOW TABLES;"))
-	merge.ddlHandle.ExecuteDDL(sql)
-
-	merge.Close()
+	merge.Close(true)
 	merge.ddlHandle.Close()
 	os.RemoveAll(dstPath + "/")
 	os.RemoveAll(srcPath + "/")
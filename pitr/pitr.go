@@ -2,7 +2,8 @@ package pitr
 
 import (
 	"fmt"
-	"sort"
+	"io"
+	"os"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
@@ -17,11 +18,40 @@ import (
 	"go.uber.org/zap"
 )
 
-// PITR is the main part of the merge binlog tool.
+// Processor runs the procedure of a command.
+type Processor interface {
+	Process() error
+	Close() error
+}
+
+// NewProcessor creates the Processor of the command in cfg.
+func NewProcessor(cfg *Config) (Processor, error) {
+	switch cfg.Command {
+	case CommandCompact:
+		return New(cfg)
+	case CommandInspect:
+		return NewInspector(cfg)
+	case CommandStat:
+		return NewStat(cfg)
+	case CommandVerify:
+		return NewVerifier(cfg)
+	case CommandApply:
+		return NewApplier(cfg)
+	case CommandSchemaDump:
+		return NewSchemaDumper(cfg)
+	default:
+		return nil, errors.Errorf("unknown command %s", cfg.Command)
+	}
+}
+
+// PITR is the main part of the merge binlog tool, it runs the compact command.
 type PITR struct {
 	cfg *Config
 
 	filter *filter.Filter
+
+	// out is where the summary is printed after compact
+	out io.Writer
 }
 
 // New creates a PITR object.
@@ -33,37 +63,57 @@ func New(cfg *Config) (*PITR, error) {
 	return &PITR{
 		cfg:    cfg,
 		filter: filter,
+		out:    os.Stdout,
 	}, nil
 }
 
 // Process runs the main procedure.
-func (r *PITR) Process() error {
+func (r *PITR) Process() (err error) {
 	files, err := searchFiles(r.cfg.Dir)
 	if err != nil {
 		return errors.Annotate(err, "searchFiles failed")
 	}
 
-	files, fileSize, err := filterFiles(files, r.cfg.StartTSO, r.cfg.StopTSO)
+	// the files before the stop ts of base are skipped, and the history ddls are loaded at the start ts of base
+	startTS := r.cfg.StartTSO
+	var base *manifest
+	if r.cfg.BaseDir != "" {
+		if base, err = loadManifest(r.cfg.BaseDir); err != nil {
+			return errors.Annotate(err, "load base manifest failed")
+		}
+		startTS = base.StopTS + 1
+	}
+
+	files, fileSize, err := filterFiles(files, startTS, r.cfg.StopTSO)
 	if err != nil {
 		return errors.Annotate(err, "filterFiles failed")
 	}
+	if len(files) == 0 {
+		return errors.Errorf("no binlog file in %s after ts %d", r.cfg.Dir, startTS)
+	}
 
 	firstBinlogTs, _, err := getFirstBinlogCommitTSAndFileSize(files[0])
 	if err != nil {
 		return errors.Annotate(err, "get first binlog commit ts failed")
 	}
+	if base != nil {
+		firstBinlogTs = base.StartTS
+	}
 
-	ddls, err := r.loadHistoryDDLJobs(firstBinlogTs)
+	ddls, err := loadHistoryDDLJobs(r.cfg, firstBinlogTs)
 	if err != nil {
 		return errors.Annotate(err, "load history ddls")
 	}
 
-	merge, err := NewMerge(ddls, files, fileSize)
+	merge, err := NewMerge(r.cfg, ddls, files, fileSize, r.filter)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	defer merge.Close()
+	defer func() {
+		// keep the temp data if failed, so we can resume from the checkpoint
+		merge.Close(err == nil)
+	}()
 
 	if err := merge.Map(); err != nil {
 		return errors.Trace(err)
@@ -73,7 +123,15 @@ func (r *PITR) Process() error {
 		return errors.Trace(err)
 	}
 
-	return nil
+	if err := merge.SaveManifest(r.cfg); err != nil {
+		return errors.Trace(err)
+	}
+
+	if merge.stats == nil {
+		log.Info("some binlogs are merged by the previous run, skip the summary")
+		return nil
+	}
+	return errors.Trace(printTableStats(r.out, merge.stats.stats()))
 }
 
 // Close closes the PITR object.
@@ -85,12 +143,27 @@ func isAcceptableBinlog(binlog *pb.Binlog, startTs, endTs int64) bool {
 	return binlog.CommitTs >= startTs && (endTs == 0 || binlog.CommitTs <= endTs)
 }
 
-func (r *PITR) loadHistoryDDLJobs(beginTS int64) ([]*model.Job, error) {
+// loadHistoryDDLJobs returns the history ddl jobs finished before beginTS, sorted by schema version,
+// they're read from the history ddl file if it's set, otherwise got from PD
+func loadHistoryDDLJobs(cfg *Config, beginTS int64) ([]*model.Job, error) {
+	if cfg.HistoryDDLFile != "" {
+		return loadHistoryDDLFile(cfg.HistoryDDLFile, beginTS)
+	}
+
 	// if PDURLs is empty, don't get history ddls
-	if len(r.cfg.PDURLs) == 0 {
+	if len(cfg.PDURLs) == 0 {
 		return nil, nil
 	}
-	tiStore, err := createTiStore(r.cfg.PDURLs)
+	allJobs, err := getAllHistoryDDLJobs(cfg.PDURLs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return filterHistoryDDLJobs(allJobs, beginTS), nil
+}
+
+// getAllHistoryDDLJobs returns all the history ddl jobs in the TiKV of PD
+func getAllHistoryDDLJobs(pdURLs string) ([]*model.Job, error) {
+	tiStore, err := createTiStore(pdURLs)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -104,26 +177,7 @@ func (r *PITR) loadHistoryDDLJobs(beginTS int64) ([]*model.Job, error) {
 		return nil, errors.Trace(err)
 	}
 	allJobs, err := snapMeta.GetAllHistoryDDLJobs()
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	// jobs from GetAllHistoryDDLJobs are sorted by job id, need sorted by schema version
-	sort.Slice(allJobs, func(i, j int) bool {
-		return allJobs[i].BinlogInfo.SchemaVersion < allJobs[j].BinlogInfo.SchemaVersion
-	})
-
-	// only get ddl job which finished ts is less than begin ts
-	jobs := make([]*model.Job, 0, 10)
-	for _, job := range allJobs {
-		if int64(job.BinlogInfo.FinishedTS) < beginTS {
-			jobs = append(jobs, job)
-		} else {
-			log.Info("ignore history ddl job", zap.Reflect("job", job))
-		}
-	}
-
-	return jobs, nil
+	return allJobs, errors.Trace(err)
 }
 
 func createTiStore(urls string) (kv.Storage, error) {
@@ -17,6 +17,12 @@ type PbReader interface {
 	read() (binlog *pb.Binlog, err error)
 }
 
+// pbReadCloser is a PbReader which holds the opened files, they're closed by close
+type pbReadCloser interface {
+	PbReader
+	close()
+}
+
 // dirPbReader is a reader which read pb binlog from dir
 type dirPbReader struct {
 	dir   string
@@ -46,10 +52,20 @@ func newDirPbReader(dir string, startTS int64, endTS int64) (r *dirPbReader, err
 
 	log.Info("newDirPbReader", zap.Strings("files", files), zap.Int64("file size", fileSize))
 
+	r, err = newFilesPbReader(files, startTS, endTS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	r.dir = dir
+
+	return
+}
+
+// newFilesPbReader return a Reader to read binlogs with commit ts in [startTS, endTS] from the sorted files
+func newFilesPbReader(files []string, startTS int64, endTS int64) (r *dirPbReader, err error) {
 	r = &dirPbReader{
 		startTS: startTS,
 		endTS:   endTS,
-		dir:     dir,
 		files:   files,
 		idx:     0,
 	}
@@ -121,3 +137,35 @@ func (r *dirPbReader) read() (binlog *pb.Binlog, err error) {
 		return nil, errors.Annotate(err, "decode failed")
 	}
 }
+
+// readBinlogDirs calls fn for every binlog with commit ts in [startTS, endTS] in the directories one by one
+func readBinlogDirs(dirs []string, startTS int64, endTS int64, fn func(binlog *pb.Binlog) error) error {
+	for _, dir := range dirs {
+		reader, err := newDirPbReader(dir, startTS, endTS)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = readAll(reader, fn)
+		reader.close()
+		if err != nil {
+			return errors.Annotatef(err, "read dir %s failed", dir)
+		}
+	}
+	return nil
+}
+
+// readAll calls fn for every binlog in reader
+func readAll(reader PbReader, fn func(binlog *pb.Binlog) error) error {
+	for {
+		binlog, err := reader.read()
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		if err := fn(binlog); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package pitr
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// spillPartition is the sub directory in the table's temp dir to save the events spilled to disk
+	spillPartition = "spill"
+	// deferredPartition is the sub directory in the table's temp dir to save the inserts and updates of the buckets,
+	// they're written after the deletes of all the buckets
+	deferredPartition = "deferred"
+)
+
+// reducer merges the binlogs of one temp sub directory,
+// every reduce worker uses its own reducer, so they can run concurrently
+type reducer struct {
+	// keyEvent saves the events not flushed, it's in memory at first,
+	// and switched to disk when the events use more memory than maxMemory
+	keyEvent  keyEventStore
+	maxMemory int64
+	spillDir  string
+
+	// used to get the table info at the commit ts of the binlogs, it's shared by all the reducers
+	ddlHandle *DDLHandle
+
+	maxCommitTS int64
+
+	// barriers are the sorted commit ts of the other tables' ddls, the dmls are flushed before every barrier,
+	// so the dmls never cross the ddls when the tables are merged into one stream
+	barriers []int64
+
+	// deferred saves the inserts and updates flushed when the table has more than one bucket, see reduceBuckets.
+	// it's opened in deferDir when the first one is flushed
+	deferring bool
+	deferDir  string
+	deferred  *binlogSink
+
+	// maxCachedEvents is the max number of events in keyEvent, used to know the memory usage
+	maxCachedEvents int
+	// spills is how many times the events are spilled to disk
+	spills int
+
+	// keys is the number of keys flushed, and bytes is the size of the binlogs written
+	keys  int64
+	bytes int64
+}
+
+func newReducer(ddlHandle *DDLHandle, maxMemory int64, spillDir string) *reducer {
+	return &reducer{
+		keyEvent:  newMemKeyEventStore(),
+		maxMemory: maxMemory,
+		spillDir:  spillDir,
+		ddlHandle: ddlHandle,
+	}
+}
+
+// close releases the key event store and the deferred events, the data spilled to disk is removed
+func (r *reducer) close() error {
+	if r.deferred != nil {
+		r.deferred.close()
+		r.deferred = nil
+	}
+	return errors.Trace(r.keyEvent.close())
+}
+
+// spillIfNeeded moves the events in memory to disk if they use more memory than maxMemory
+func (r *reducer) spillIfNeeded() error {
+	mem, ok := r.keyEvent.(*memKeyEventStore)
+	if !ok || mem.size() <= r.maxMemory {
+		return nil
+	}
+
+	log.Info("events use too much memory, spill them to disk", zap.Int("events", mem.len()), zap.Int64("size", mem.size()), zap.String("dir", r.spillDir))
+	disk, err := newDiskKeyEventStore(r.spillDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = mem.iterate(func(key string, ev *Event) error {
+		return disk.put(key, ev)
+	})
+	if err != nil {
+		disk.close()
+		return errors.Trace(err)
+	}
+
+	mem.close()
+	r.keyEvent = disk
+	r.spills++
+	return nil
+}
+
+// reduce merges the binlogs in the table's temp dir and writes them to out,
+// the ddls split the dmls into several parts, every part of the hash buckets is reduced and flushed one by one,
+// so only one bucket's events are cached in memory.
+func (r *reducer) reduce(out sink, dirPath string) error {
+	ddls, err := readDDLPartition(dirPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	subDirs, err := readSubDirs(dirPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var buckets []*bucketReader
+	defer func() {
+		for _, b := range buckets {
+			b.reader.close()
+		}
+	}()
+	for _, subDir := range subDirs {
+		if !strings.HasPrefix(subDir, dmlPartitionPrefix) {
+			continue
+		}
+		b, err := newBucketReader(path.Join(dirPath, subDir))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		buckets = append(buckets, b)
+	}
+	log.Info("reduce", zap.String("dir", dirPath), zap.Int("ddls", len(ddls)), zap.Strings("sub dirs", subDirs))
+	r.deferring = len(buckets) > 1
+	r.deferDir = path.Join(dirPath, deferredPartition)
+
+	for _, ddl := range ddls {
+		// the dmls before the ddl are handled with the old table info
+		if err := r.reduceBefore(out, buckets, ddl.CommitTs); err != nil {
+			return err
+		}
+		if err := r.analyzeBinlog(out, ddl); err != nil {
+			return err
+		}
+		r.maxCommitTS = ddl.CommitTs
+	}
+
+	return r.reduceBefore(out, buckets, math.MaxInt64)
+}
+
+// reduceBefore reduces the dmls with commit ts less than ts, the dmls are also flushed at every barrier before ts
+func (r *reducer) reduceBefore(out sink, buckets []*bucketReader, ts int64) error {
+	for len(r.barriers) != 0 && r.barriers[0] <= ts {
+		if r.barriers[0] < ts {
+			if err := r.reduceBuckets(out, buckets, r.barriers[0]); err != nil {
+				return err
+			}
+		}
+		r.barriers = r.barriers[1:]
+	}
+	return r.reduceBuckets(out, buckets, ts)
+}
+
+// reduceBuckets reduces the dmls with commit ts less than ts in every bucket, and flush them after every bucket.
+// the events of a key may be in two buckets if it becomes the new key of another row, the ones before the update are
+// hashed by the key itself and the ones after are hashed by the row's first key, so the delete of the key in one bucket
+// must be executed before the insert in the other. the deletes are written after every bucket,
+// but the inserts and updates are deferred until all the buckets are flushed.
+func (r *reducer) reduceBuckets(out sink, buckets []*bucketReader, ts int64) error {
+	for _, b := range buckets {
+		for {
+			binlog, err := b.readBefore(ts)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if binlog == nil {
+				break
+			}
+
+			if err := r.analyzeBinlog(out, binlog); err != nil {
+				return err
+			}
+			if binlog.CommitTs > r.maxCommitTS {
+				r.maxCommitTS = binlog.CommitTs
+			}
+		}
+
+		if r.keyEvent.len() > r.maxCachedEvents {
+			r.maxCachedEvents = r.keyEvent.len()
+		}
+
+		// keep the same commit ts with the ddl which ends these dmls, and the output's commit ts is in order
+		flushTS := r.maxCommitTS
+		if ts != math.MaxInt64 {
+			flushTS = ts - 1
+		}
+		if err := r.FlushDMLBinlog(out, flushTS); err != nil {
+			return err
+		}
+	}
+
+	return errors.Trace(r.writeDeferred(out))
+}
+
+// writeDeferred writes the deferred inserts and updates to out, and removes them on disk
+func (r *reducer) writeDeferred(out sink) error {
+	if r.deferred == nil {
+		return nil
+	}
+	err := r.deferred.close()
+	r.deferred = nil
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	files, err := searchFiles(r.deferDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	reader, err := newFilesPbReader(files, 0, 0)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = readAll(reader, func(binlog *pb.Binlog) error {
+		return r.writeBinlog(out, binlog)
+	})
+	reader.close()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.RemoveAll(r.deferDir))
+}
+
+// deferredSink returns the sink to write the inserts and updates, it's out unless they're deferred
+func (r *reducer) deferredSink(out sink) (sink, error) {
+	if !r.deferring {
+		return out, nil
+	}
+	if r.deferred == nil {
+		// the deferred binlogs may be written partly by the previous run
+		if err := os.RemoveAll(r.deferDir); err != nil {
+			return nil, errors.Trace(err)
+		}
+		deferred, err := newBinlogSink(r.deferDir)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r.deferred = deferred
+	}
+	return r.deferred, nil
+}
+
+// bucketReader reads the dml binlogs of one hash bucket in the order of commit ts
+type bucketReader struct {
+	reader *dirPbReader
+
+	// next is the binlog which is read but not returned yet
+	next *pb.Binlog
+}
+
+func newBucketReader(dirPath string) (*bucketReader, error) {
+	files, err := searchFiles(dirPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	reader, err := newFilesPbReader(files, 0, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &bucketReader{reader: reader}, nil
+}
+
+// readBefore returns the next binlog if its commit ts is less than ts, otherwise returns nil
+func (b *bucketReader) readBefore(ts int64) (*pb.Binlog, error) {
+	if b.next == nil {
+		binlog, err := b.reader.read()
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		b.next = binlog
+	}
+
+	if b.next.CommitTs >= ts {
+		return nil, nil
+	}
+	binlog := b.next
+	b.next = nil
+	return binlog, nil
+}
+
+// readDDLPartition returns all the ddls saved in the table's temp dir
+func readDDLPartition(dirPath string) ([]*pb.Binlog, error) {
+	ddlPath := path.Join(dirPath, ddlPartition)
+	if _, err := os.Stat(ddlPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	files, err := searchFiles(ddlPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	reader, err := newFilesPbReader(files, 0, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader.close()
+
+	var ddls []*pb.Binlog
+	for {
+		binlog, err := reader.read()
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return ddls, nil
+			}
+			return nil, errors.Trace(err)
+		}
+		ddls = append(ddls, binlog)
+	}
+}
+
+// FlushDMLBinlog merge some events to one binlog, and then write to file,
+// the inserts and updates may be deferred, see reduceBuckets
+func (r *reducer) FlushDMLBinlog(out sink, commitTS int64) error {
+	binlog := r.newDMLBinlog(commitTS)
+	w, deletes := out, true
+	flush := func() error {
+		if len(binlog.DmlData.Events) == 0 {
+			return nil
+		}
+		var err error
+		if w == out {
+			err = r.writeBinlog(out, binlog)
+		} else {
+			_, err = w.write(binlog)
+		}
+		binlog = r.newDMLBinlog(commitTS)
+		return errors.Trace(err)
+	}
+
+	err := r.iterateEvents(func(row *Event) error {
+		// the deletes are iterated first
+		if row.eventType != pb.EventType_Delete && deletes {
+			deletes = false
+			others, err := r.deferredSink(out)
+			if err != nil {
+				return err
+			}
+			if others != w {
+				if err := flush(); err != nil {
+					return err
+				}
+				w = others
+			}
+		}
+
+		rowData := make([][]byte, 0, 10)
+		for _, c := range row.cols {
+			data, err := c.Marshal()
+			if err != nil {
+				return err
+			}
+			rowData = append(rowData, data)
+		}
+
+		log.Info("generate new event", zap.String("event", fmt.Sprintf("%v", row)))
+		newEvent := pb.Event{
+			SchemaName: &row.schema,
+			TableName:  &row.table,
+			Tp:         row.eventType,
+			Row:        rowData,
+		}
+		binlog.DmlData.Events = append(binlog.DmlData.Events, newEvent)
+
+		// every binlog contain 1000 rows as default
+		if len(binlog.DmlData.Events) == 1000 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	r.keys += int64(r.keyEvent.len())
+
+	// all event have already flush to file, clean these event
+	if err := r.keyEvent.close(); err != nil {
+		return errors.Trace(err)
+	}
+	r.keyEvent = newMemKeyEventStore()
+
+	return nil
+}
+
+// iterateEvents calls fn for the deletes first, and then the inserts and updates,
+// because the key changed by update is split into a delete and an insert, the delete should be executed first.
+// the events are in the order of key, so the output is always the same, and the inserted then deleted events are skipped
+func (r *reducer) iterateEvents(fn func(row *Event) error) error {
+	err := r.keyEvent.iterate(func(key string, row *Event) error {
+		if row.isDeleted || row.eventType != pb.EventType_Delete {
+			return nil
+		}
+		return fn(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.keyEvent.iterate(func(key string, row *Event) error {
+		if row.isDeleted || row.eventType == pb.EventType_Delete {
+			return nil
+		}
+		return fn(row)
+	})
+}
+
+func (r *reducer) newDMLBinlog(commitTS int64) *pb.Binlog {
+	return &pb.Binlog{
+		Tp:       pb.BinlogType_DML,
+		CommitTs: commitTS,
+		DmlData: &pb.DMLData{
+			Events: make([]pb.Event, 0, 1000),
+		},
+	}
+}
+
+func (r *reducer) writeBinlog(out sink, binlog *pb.Binlog) error {
+	n, err := out.write(binlog)
+	r.bytes += n
+	return errors.Trace(err)
+}
+
+func (r *reducer) analyzeBinlog(out sink, binlog *pb.Binlog) error {
+	switch binlog.Tp {
+	case pb.BinlogType_DML:
+		_, err := r.handleDML(binlog)
+		if err != nil {
+			return err
+		}
+	case pb.BinlogType_DDL:
+		// the ddl is executed when map, the dmls after it use the new version of the table info.
+		// merge DML events to several binlog and write to file, then write this DDL's binlog
+		err := r.FlushDMLBinlog(out, binlog.CommitTs-1)
+		if err != nil {
+			return err
+		}
+		// the ddl without query is written to another table, it only splits the dmls of this table
+		if len(binlog.DdlQuery) == 0 {
+			return nil
+		}
+		err = r.writeBinlog(out, binlog)
+		if err != nil {
+			return err
+		}
+
+	default:
+		panic("unreachable")
+	}
+	return nil
+}
+
+// handleDML split DML binlog to multiple Event and handle them
+func (r *reducer) handleDML(binlog *pb.Binlog) ([]*Event, error) {
+	dml := binlog.DmlData
+	if dml == nil {
+		return nil, errors.New("dml binlog's data can't be empty")
+	}
+
+	for _, event := range dml.Events {
+		schema := event.GetSchemaName()
+		table := event.GetTableName()
+
+		e := &event
+		tp := e.GetTp()
+		row := e.GetRow()
+
+		var ev *Event
+
+		tableInfo, err := r.ddlHandle.GetTableInfoAt(schema, table, binlog.CommitTs)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tp {
+		case pb.EventType_Insert, pb.EventType_Delete:
+			key, cols, err := getInsertAndDeleteRowKey(row, tableInfo)
+			if err != nil {
+				return nil, err
+			}
+
+			ev = &Event{
+				schema:    schema,
+				table:     table,
+				eventType: tp,
+				oldKey:    key,
+				cols:      cols,
+			}
+
+		case pb.EventType_Update:
+			key, cKey, cols, err := getUpdateRowKey(row, tableInfo)
+			if err != nil {
+				return nil, err
+			}
+
+			ev = &Event{
+				schema:    schema,
+				table:     table,
+				eventType: tp,
+				oldKey:    key,
+				newKey:    cKey,
+				cols:      cols,
+			}
+
+		default:
+			panic("unreachable")
+		}
+
+		if err := r.HandleEvent(ev); err != nil {
+			return nil, err
+		}
+		if err := r.spillIfNeeded(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// HandleEvent handles event, if event's key already exist, then merge this event
+// otherwise save this event. the update which changes the key is handled as
+// a delete of the old key and an insert of the new key.
+func (r *reducer) HandleEvent(row *Event) error {
+	if row.eventType == pb.EventType_Update && row.oldKey != row.newKey {
+		del, ins := row.splitKeyChange()
+		if err := r.handleKeyEvent(del); err != nil {
+			return err
+		}
+		return r.handleKeyEvent(ins)
+	}
+
+	return r.handleKeyEvent(row)
+}
+
+// handleKeyEvent merges the event which doesn't change the key into the saved event with the same key
+func (r *reducer) handleKeyEvent(row *Event) error {
+	key := row.oldKey
+	oldRow, ok, err := r.keyEvent.get(key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !ok {
+		return r.keyEvent.put(key, row)
+	}
+
+	// the deleted event is kept, so the next event of the key can be checked
+	if err := oldRow.Merge(row); err != nil {
+		return errors.Trace(err)
+	}
+	return r.keyEvent.put(key, oldRow)
+}
@@ -0,0 +1,73 @@
+package pitr
+
+import (
+	"database/sql"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+// replayer executes the binlogs on a database one by one, the dml events in a binlog are executed in one transaction
+type replayer struct {
+	db *sql.DB
+
+	// filter used to skip the dml events of the schemas and tables which are not needed
+	filter *filter.Filter
+
+	// executeDDL executes the ddl, and updates the table info
+	executeDDL func(ddl string) error
+	// getTableInfo returns the table info used to generate the sql of the dml events
+	getTableInfo func(schema, table string) (*tableInfo, error)
+}
+
+// newDDLHandleReplayer returns a replayer which executes the binlogs on the mock tidb
+func newDDLHandleReplayer(ddlHandle *DDLHandle, filter *filter.Filter) *replayer {
+	return &replayer{
+		db:           ddlHandle.db,
+		filter:       filter,
+		executeDDL:   ddlHandle.ExecuteDDL,
+		getTableInfo: ddlHandle.GetTableInfo,
+	}
+}
+
+// replay executes the ddl, or executes the dml events in one transaction
+func (r *replayer) replay(binlog *pb.Binlog) error {
+	if err := r.execute(binlog); err != nil {
+		return errors.Annotatef(err, "replay binlog with commit ts %d failed", binlog.CommitTs)
+	}
+	return nil
+}
+
+func (r *replayer) execute(binlog *pb.Binlog) error {
+	if binlog.Tp == pb.BinlogType_DDL {
+		return errors.Trace(r.executeDDL(string(binlog.DdlQuery)))
+	}
+
+	txn, err := r.db.Begin()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for i := range binlog.DmlData.GetEvents() {
+		ev := &binlog.DmlData.Events[i]
+		if r.filter.SkipSchemaAndTable(ev.GetSchemaName(), ev.GetTableName()) {
+			continue
+		}
+
+		info, err := r.getTableInfo(ev.GetSchemaName(), ev.GetTableName())
+		if err != nil {
+			txn.Rollback()
+			return errors.Trace(err)
+		}
+		query, args, err := genDMLSQL(ev, info)
+		if err != nil {
+			txn.Rollback()
+			return errors.Trace(err)
+		}
+		if _, err := txn.Exec(query, args...); err != nil {
+			txn.Rollback()
+			return errors.Annotatef(err, "execute %s failed", query)
+		}
+	}
+	return errors.Trace(txn.Commit())
+}
@@ -0,0 +1,122 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-binlog/pkg/version"
+	"go.uber.org/zap"
+)
+
+// historyDDLFileVersion is the version of the history ddl file format, the file with a newer version can't be read
+const historyDDLFileVersion = 1
+
+// historyDDLFile is the file written by schema dump, it's used instead of PD to get the history ddl jobs
+type historyDDLFile struct {
+	Version        int    `json:"version"`
+	ReleaseVersion string `json:"release-version"`
+	GitHash        string `json:"git-hash"`
+
+	// BeginTS is the ts the jobs are finished before, 0 means all the jobs when dumped
+	BeginTS int64 `json:"begin-ts"`
+	// Jobs are sorted by schema version
+	Jobs []*model.Job `json:"jobs"`
+}
+
+// saveHistoryDDLFile writes the jobs finished before beginTS to file, it's written to a temp file and then renamed
+func saveHistoryDDLFile(file string, jobs []*model.Job, beginTS int64) error {
+	data, err := json.MarshalIndent(&historyDDLFile{
+		Version:        historyDDLFileVersion,
+		ReleaseVersion: version.ReleaseVersion,
+		GitHash:        version.GitHash,
+		BeginTS:        beginTS,
+		Jobs:           filterHistoryDDLJobs(jobs, beginTS),
+	}, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmpFile, file))
+}
+
+// loadHistoryDDLFile returns the jobs in file finished before beginTS, sorted by schema version.
+// the file is written by schema dump, or it's a json array of model.Job like the output of TiDB's /ddl/history http api
+func loadHistoryDDLFile(file string, beginTS int64) ([]*model.Job, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	f := &historyDDLFile{}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &f.Jobs)
+	} else {
+		err = json.Unmarshal(data, f)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "unmarshal ddl jobs in %s failed", file)
+	}
+	if f.Version > historyDDLFileVersion {
+		return nil, errors.Errorf("the version of %s is %d, only version %d or earlier is supported", file, f.Version, historyDDLFileVersion)
+	}
+	// the jobs finished in [f.BeginTS, beginTS) are not in the file
+	if f.BeginTS != 0 && (beginTS == 0 || beginTS > f.BeginTS) {
+		return nil, errors.Errorf("the ddl jobs in %s are finished before %d, the jobs before %d may be missing", file, f.BeginTS, beginTS)
+	}
+	for _, job := range f.Jobs {
+		if job.BinlogInfo == nil {
+			return nil, errors.Errorf("ddl job %d in %s has no binlog info", job.ID, file)
+		}
+	}
+	return filterHistoryDDLJobs(f.Jobs, beginTS), nil
+}
+
+// SchemaDumper writes the history ddl jobs got from PD to a file, which can be used instead of PD later.
+type SchemaDumper struct {
+	cfg *Config
+}
+
+// NewSchemaDumper creates a SchemaDumper object.
+func NewSchemaDumper(cfg *Config) (*SchemaDumper, error) {
+	log.Info("New SchemaDumper", zap.Stringer("config", cfg))
+	return &SchemaDumper{cfg: cfg}, nil
+}
+
+// Process writes the jobs finished before the start ts, or before the first binlog in data dir if start ts is not set,
+// all the jobs are written if neither is set
+func (d *SchemaDumper) Process() error {
+	beginTS := d.cfg.StartTSO
+	if beginTS == 0 && d.cfg.Dir != "" {
+		files, err := searchFiles(d.cfg.Dir)
+		if err != nil {
+			return errors.Annotate(err, "searchFiles failed")
+		}
+		if beginTS, _, err = getFirstBinlogCommitTSAndFileSize(files[0]); err != nil {
+			return errors.Annotate(err, "get first binlog commit ts failed")
+		}
+	}
+
+	jobs, err := getAllHistoryDDLJobs(d.cfg.PDURLs)
+	if err != nil {
+		return errors.Annotate(err, "get history ddls failed")
+	}
+	if err := saveHistoryDDLFile(d.cfg.OutputFile, jobs, beginTS); err != nil {
+		return errors.Annotatef(err, "save history ddls to %s failed", d.cfg.OutputFile)
+	}
+	log.Info("dump history ddls success", zap.String("file", d.cfg.OutputFile), zap.Int64("begin ts", beginTS))
+	return nil
+}
+
+// Close closes the SchemaDumper object.
+func (d *SchemaDumper) Close() error {
+	return nil
+}
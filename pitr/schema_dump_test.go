@@ -0,0 +1,65 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/parser/model"
+	"gotest.tools/assert"
+)
+
+func TestHistoryDDLFile(t *testing.T) {
+	file := "./historyddltest.json"
+	defer os.Remove(file)
+
+	db := &model.DBInfo{ID: 1, Name: model.NewCIStr("test")}
+	newJob := func(id int64, tp model.ActionType, query string, table *model.TableInfo, finishedTS uint64) *model.Job {
+		return &model.Job{
+			ID: id, Type: tp, SchemaID: 1, Query: query, State: model.JobStateSynced,
+			BinlogInfo: &model.HistoryInfo{SchemaVersion: id, FinishedTS: finishedTS, DBInfo: db, TableInfo: table},
+		}
+	}
+	newTable := func(columns ...string) *model.TableInfo {
+		table := &model.TableInfo{ID: 2, Name: model.NewCIStr("t1")}
+		for i, name := range columns {
+			table.Columns = append(table.Columns, &model.ColumnInfo{ID: int64(i + 1), Offset: i, Name: model.NewCIStr(name)})
+		}
+		return table
+	}
+	jobs := []*model.Job{
+		newJob(3, model.ActionAddColumn, "alter table t1 add column c int", newTable("a", "b", "c"), 300),
+		newJob(1, model.ActionCreateSchema, "create database test", nil, 100),
+		newJob(2, model.ActionCreateTable, "create table t1 (a int, b int)", newTable("a", "b"), 200),
+	}
+
+	// the jobs finished before 300 are saved, and sorted by schema version
+	err := saveHistoryDDLFile(file, jobs, 300)
+	assert.Assert(t, err == nil, err)
+	loaded, err := loadHistoryDDLFile(file, 250)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(loaded), 2)
+	assert.Equal(t, loaded[0].ID, int64(1))
+
+	// the schema is built from the jobs in the file
+	schema, err := NewSchema(loaded)
+	assert.Assert(t, err == nil)
+	infos, err := schema.AllTableInfos()
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(infos), 1)
+	assert.DeepEqual(t, infos[0].columns, []string{"a", "b"})
+
+	// the jobs finished after the file is dumped are missing
+	_, err = loadHistoryDDLFile(file, 400)
+	assert.ErrorContains(t, err, "may be missing")
+
+	// a json array of jobs can be read too
+	data, err := json.Marshal(jobs)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, ioutil.WriteFile(file, data, 0644) == nil)
+	loaded, err = loadHistoryDDLFile(file, 0)
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, len(loaded), 3)
+	assert.Equal(t, loaded[2].ID, int64(3))
+}
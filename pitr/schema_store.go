@@ -0,0 +1,132 @@
+package pitr
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// schemaStore keeps every version of the tables' info, the version is the commit ts of the ddl which changes the table,
+// and the tables existing before the binlogs are in version 0. the table info of an event is the latest version
+// not after its commit ts, so the keys are always computed with the table definition when the event happens.
+type schemaStore struct {
+	mu sync.RWMutex
+	// versions are sorted by ts for every table, the key is the quoted table name
+	versions map[string][]*tableVersion
+}
+
+// tableVersion is the table info since ts, info is nil if the table is dropped
+type tableVersion struct {
+	Schema string     `json:"schema"`
+	Table  string     `json:"table"`
+	TS     int64      `json:"ts"`
+	Info   *tableInfo `json:"info"`
+}
+
+func newSchemaStore() *schemaStore {
+	return &schemaStore{versions: make(map[string][]*tableVersion)}
+}
+
+// put saves the table info since ts, it replaces the version with the same ts
+func (s *schemaStore) put(schema, table string, ts int64, info *tableInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := quoteSchema(schema, table)
+	versions := s.versions[key]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].TS >= ts })
+	if i < len(versions) && versions[i].TS == ts {
+		versions[i].Info = info
+		return
+	}
+	versions = append(versions, nil)
+	copy(versions[i+1:], versions[i:])
+	versions[i] = &tableVersion{Schema: schema, Table: table, TS: ts, Info: info}
+	s.versions[key] = versions
+}
+
+// dropSchema marks all the tables in the schema dropped since ts
+func (s *schemaStore) dropSchema(schema string, ts int64) {
+	var tables []string
+	s.mu.RLock()
+	for _, versions := range s.versions {
+		last := versions[len(versions)-1]
+		if last.Info != nil && last.Schema == schema {
+			tables = append(tables, last.Table)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, table := range tables {
+		s.put(schema, table, ts, nil)
+	}
+}
+
+// get returns the table info in effect at ts, ok is false if the table has no version before ts
+func (s *schemaStore) get(schema, table string, ts int64) (info *tableInfo, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.versions[quoteSchema(schema, table)]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].TS > ts })
+	if i == 0 {
+		return nil, false
+	}
+	return versions[i-1].Info, true
+}
+
+// all returns all the versions, it's saved in the checkpoint so the versions needn't be built again when resume
+func (s *schemaStore) all() []*tableVersion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var all []*tableVersion
+	for _, versions := range s.versions {
+		all = append(all, versions...)
+	}
+	return all
+}
+
+// load adds the versions returned by all
+func (s *schemaStore) load(versions []*tableVersion) {
+	for _, v := range versions {
+		s.put(v.Schema, v.Table, v.TS, v.Info)
+	}
+}
+
+// tableInfoJSON is the json format of tableInfo, the primary key is the first unique key if it exists
+type tableInfoJSON struct {
+	Schema        string      `json:"schema"`
+	Table         string      `json:"table"`
+	Columns       []string    `json:"columns"`
+	HasPrimaryKey bool        `json:"has-primary-key"`
+	UniqueKeys    []indexJSON `json:"unique-keys"`
+}
+
+type indexJSON struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+func (t *tableInfo) MarshalJSON() ([]byte, error) {
+	v := &tableInfoJSON{Schema: t.schema, Table: t.table, Columns: t.columns, HasPrimaryKey: t.primaryKey != nil}
+	for _, key := range t.uniqueKeys {
+		v.UniqueKeys = append(v.UniqueKeys, indexJSON{Name: key.name, Columns: key.columns})
+	}
+	return json.Marshal(v)
+}
+
+func (t *tableInfo) UnmarshalJSON(data []byte) error {
+	v := &tableInfoJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*t = tableInfo{schema: v.Schema, table: v.Table, columns: v.Columns}
+	for _, key := range v.UniqueKeys {
+		t.uniqueKeys = append(t.uniqueKeys, indexInfo{name: key.Name, columns: key.Columns})
+	}
+	if v.HasPrimaryKey && len(t.uniqueKeys) != 0 {
+		t.primaryKey = &t.uniqueKeys[0]
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package pitr
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSchemaStore(t *testing.T) {
+	s := newSchemaStore()
+	v1 := &tableInfo{schema: "test", table: "t1", columns: []string{"a", "b"}}
+	v2 := &tableInfo{schema: "test", table: "t1", columns: []string{"a", "b"}, uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"a"}}}}
+	v2.primaryKey = &v2.uniqueKeys[0]
+
+	// the versions can be put out of order
+	s.put("test", "t1", 300, v2)
+	s.put("test", "t1", 100, v1)
+	_, ok := s.get("test", "t1", 99)
+	assert.Assert(t, !ok)
+	for ts, expected := range map[int64]*tableInfo{100: v1, 299: v1, 300: v2, 400: v2} {
+		info, ok := s.get("test", "t1", ts)
+		assert.Assert(t, ok)
+		assert.Equal(t, info, expected, "ts %d", ts)
+	}
+
+	s.dropSchema("test", 500)
+	info, ok := s.get("test", "t1", 500)
+	assert.Assert(t, ok && info == nil)
+
+	// the versions are saved in checkpoint as json
+	data, err := json.Marshal(s.all())
+	assert.Assert(t, err == nil)
+	var versions []*tableVersion
+	assert.Assert(t, json.Unmarshal(data, &versions) == nil)
+	loaded := newSchemaStore()
+	loaded.load(versions)
+	info, ok = loaded.get("test", "t1", 300)
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, info.columns, v2.columns)
+	assert.Equal(t, info.uniqueKeys[0].name, "PRIMARY")
+	assert.DeepEqual(t, info.uniqueKeys[0].columns, []string{"a"})
+	assert.Assert(t, info.primaryKey == &info.uniqueKeys[0])
+	info, ok = loaded.get("test", "t1", 500)
+	assert.Assert(t, ok && info == nil)
+}
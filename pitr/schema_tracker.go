@@ -0,0 +1,703 @@
+package pitr
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/parser/types"
+	"github.com/pingcap/tidb/ddl"
+	"github.com/pingcap/tidb/table"
+)
+
+// defaultDatabase exists in a new TiDB without any ddl
+const defaultDatabase = "test"
+
+// schemaTracker applies the ddls to the table infos in memory like TiDB, so the table info is got without running a TiDB.
+// the databases and tables are kept in a Schema, and the names are case insensitive
+type schemaTracker struct {
+	schema *Schema
+	// nextID allocates the ids of the databases and tables
+	nextID int64
+}
+
+func newSchemaTracker() (*schemaTracker, error) {
+	t := &schemaTracker{}
+	if err := t.reset(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+// reset drops all the databases, only the default database is created again
+func (t *schemaTracker) reset() error {
+	schema, err := NewSchema(nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	t.schema, t.nextID = schema, 0
+	return errors.Trace(t.createDatabase(defaultDatabase))
+}
+
+// executeDDL applies the statements in ddl, a USE statement changes the database of the statements after it
+func (t *schemaTracker) executeDDL(ddl string) error {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var current string
+	for _, stmt := range stmts {
+		if node, ok := stmt.(*ast.UseStmt); ok {
+			if t.findDatabase(node.DBName) == nil {
+				return errors.NotFoundf("database %s", node.DBName)
+			}
+			current = node.DBName
+			continue
+		}
+		if err := t.applyStmt(current, stmt); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// tableInfo returns the info of the table, ErrTableNotExist is returned if the table doesn't exist
+func (t *schemaTracker) tableInfo(schema, table string) (*tableInfo, error) {
+	db := t.findDatabase(schema)
+	if db == nil {
+		return nil, ErrTableNotExist
+	}
+	info := findTable(db, table)
+	if info == nil {
+		return nil, ErrTableNotExist
+	}
+	return newTableInfo(schema, table, info), nil
+}
+
+// databases returns the names of all the databases, sorted by name
+func (t *schemaTracker) databases() []string {
+	names := make([]string, 0, len(t.schema.schemas))
+	for _, db := range t.schema.schemas {
+		names = append(names, db.Name.O)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tables returns the names of the tables in schema, sorted by name
+func (t *schemaTracker) tables(schema string) ([]string, error) {
+	db := t.findDatabase(schema)
+	if db == nil {
+		return nil, errors.NotFoundf("database %s", schema)
+	}
+	names := make([]string, 0, len(db.Tables))
+	for _, info := range db.Tables {
+		names = append(names, info.Name.O)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// dumpSchema returns the ddls to create all the databases and tables
+func (t *schemaTracker) dumpSchema() []string {
+	var ddls []string
+	for _, schema := range t.databases() {
+		ddls = append(ddls, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteName(schema)))
+
+		db := t.findDatabase(schema)
+		tables, _ := t.tables(schema)
+		for _, name := range tables {
+			ddls = append(ddls, fmt.Sprintf("USE %s;%s", quoteName(schema), showCreateTable(findTable(db, name))))
+		}
+	}
+	return ddls
+}
+
+func (t *schemaTracker) applyStmt(current string, stmt ast.StmtNode) error {
+	switch node := stmt.(type) {
+	case *ast.CreateDatabaseStmt:
+		if t.findDatabase(node.Name) != nil {
+			if node.IfNotExists {
+				return nil
+			}
+			return errors.AlreadyExistsf("database %s", node.Name)
+		}
+		return errors.Trace(t.createDatabase(node.Name))
+
+	case *ast.DropDatabaseStmt:
+		db := t.findDatabase(node.Name)
+		if db == nil {
+			if node.IfExists {
+				return nil
+			}
+			return errors.NotFoundf("database %s", node.Name)
+		}
+		_, err := t.schema.DropSchema(db.ID)
+		return errors.Trace(err)
+
+	case *ast.CreateTableStmt:
+		return errors.Trace(t.createTable(current, node))
+
+	case *ast.DropTableStmt:
+		for _, name := range node.Tables {
+			db, info, err := t.table(current, name)
+			if err != nil {
+				if node.IfExists && errors.IsNotFound(err) {
+					continue
+				}
+				return errors.Trace(err)
+			}
+			if _, err := t.schema.DropTable(info.ID); err != nil {
+				return errors.Annotatef(err, "drop table %s", quoteSchema(db.Name.O, info.Name.O))
+			}
+		}
+		return nil
+
+	case *ast.TruncateTableStmt:
+		// the columns and the keys are not changed
+		_, _, err := t.table(current, node.Table)
+		return errors.Trace(err)
+
+	case *ast.RenameTableStmt:
+		for _, t2t := range node.TableToTables {
+			if err := t.renameTable(current, t2t.OldTable, t2t.NewTable); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+
+	case *ast.CreateIndexStmt:
+		_, info, err := t.table(current, node.Table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(addIndex(info, node.IndexName, node.IndexColNames, node.Unique, false))
+
+	case *ast.DropIndexStmt:
+		_, info, err := t.table(current, node.Table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if findIndex(info, node.IndexName) == nil && node.IfExists {
+			return nil
+		}
+		return errors.Trace(dropIndex(info, node.IndexName))
+
+	case *ast.AlterTableStmt:
+		return errors.Trace(t.alterTable(current, node))
+
+	default:
+		return errors.NotSupportedf("ddl %s", stmt.Text())
+	}
+}
+
+func (t *schemaTracker) createDatabase(name string) error {
+	t.nextID++
+	return errors.Trace(t.schema.CreateSchema(&model.DBInfo{ID: t.nextID, Name: model.NewCIStr(name), State: model.StatePublic}))
+}
+
+func (t *schemaTracker) createTable(current string, node *ast.CreateTableStmt) error {
+	db, err := t.database(current, node.Table.Schema.O)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if findTable(db, node.Table.Name.O) != nil {
+		if node.IfNotExists {
+			return nil
+		}
+		return errors.AlreadyExistsf("table %s", quoteSchema(db.Name.O, node.Table.Name.O))
+	}
+
+	var info *model.TableInfo
+	if node.ReferTable != nil {
+		_, refer, err := t.table(current, node.ReferTable)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		info = refer.Clone()
+	} else if info, err = ddl.BuildTableInfoFromAST(node); err != nil {
+		return errors.Annotatef(err, "build table info of %s failed", quoteSchema(db.Name.O, node.Table.Name.O))
+	}
+
+	t.nextID++
+	info.ID, info.Name, info.State = t.nextID, node.Table.Name, model.StatePublic
+	return errors.Trace(t.schema.CreateTable(db, info))
+}
+
+func (t *schemaTracker) renameTable(current string, oldName, newName *ast.TableName) error {
+	_, info, err := t.table(current, oldName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	db, err := t.database(current, newName.Schema.O)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if findTable(db, newName.Name.O) != nil {
+		return errors.AlreadyExistsf("table %s", quoteSchema(db.Name.O, newName.Name.O))
+	}
+
+	if _, err := t.schema.DropTable(info.ID); err != nil {
+		return errors.Trace(err)
+	}
+	info.Name = newName.Name
+	return errors.Trace(t.schema.CreateTable(db, info))
+}
+
+func (t *schemaTracker) alterTable(current string, node *ast.AlterTableStmt) error {
+	_, info, err := t.table(current, node.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, spec := range node.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			err = addColumns(info, node.Table, spec.NewColumns, spec.Position)
+		case ast.AlterTableDropColumn:
+			err = dropColumn(info, spec.OldColumnName.Name.O)
+		case ast.AlterTableModifyColumn:
+			err = changeColumn(info, node.Table, spec.NewColumns[0].Name.Name.O, spec.NewColumns[0], spec.Position)
+		case ast.AlterTableChangeColumn:
+			err = changeColumn(info, node.Table, spec.OldColumnName.Name.O, spec.NewColumns[0], spec.Position)
+		case ast.AlterTableAddConstraint:
+			constr := spec.Constraint
+			switch constr.Tp {
+			case ast.ConstraintKey, ast.ConstraintIndex:
+				err = addIndex(info, constr.Name, constr.Keys, false, false)
+			case ast.ConstraintUniq, ast.ConstraintUniqIndex, ast.ConstraintUniqKey:
+				err = addIndex(info, constr.Name, constr.Keys, true, false)
+			case ast.ConstraintPrimaryKey:
+				err = addIndex(info, constr.Name, constr.Keys, true, true)
+			}
+		case ast.AlterTableDropIndex:
+			err = dropIndex(info, spec.Name)
+		case ast.AlterTableDropPrimaryKey:
+			err = dropPrimaryKey(info)
+		case ast.AlterTableRenameIndex:
+			err = renameIndex(info, spec.FromKey.O, spec.ToKey.O)
+		case ast.AlterTableRenameTable:
+			err = t.renameTable(current, node.Table, spec.NewTable)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// database returns the database named schema, or the current database if schema is empty
+func (t *schemaTracker) database(current, schema string) (*model.DBInfo, error) {
+	if schema == "" {
+		schema = current
+	}
+	if schema == "" {
+		return nil, errors.New("no database selected")
+	}
+	db := t.findDatabase(schema)
+	if db == nil {
+		return nil, errors.NotFoundf("database %s", schema)
+	}
+	return db, nil
+}
+
+func (t *schemaTracker) table(current string, name *ast.TableName) (*model.DBInfo, *model.TableInfo, error) {
+	db, err := t.database(current, name.Schema.O)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	info := findTable(db, name.Name.O)
+	if info == nil {
+		return nil, nil, errors.NotFoundf("table %s", quoteSchema(db.Name.O, name.Name.O))
+	}
+	return db, info, nil
+}
+
+func (t *schemaTracker) findDatabase(name string) *model.DBInfo {
+	for _, db := range t.schema.schemas {
+		if db.Name.L == strings.ToLower(name) {
+			return db
+		}
+	}
+	return nil
+}
+
+func findTable(db *model.DBInfo, name string) *model.TableInfo {
+	for _, info := range db.Tables {
+		if info.Name.L == strings.ToLower(name) {
+			return info
+		}
+	}
+	return nil
+}
+
+func findColumn(info *model.TableInfo, name string) int {
+	for i, col := range info.Columns {
+		if col.Name.L == strings.ToLower(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func findIndex(info *model.TableInfo, name string) *model.IndexInfo {
+	for _, index := range info.Indices {
+		if index.Name.L == strings.ToLower(name) {
+			return index
+		}
+	}
+	return nil
+}
+
+// buildColumns builds the column infos of the column definitions like CREATE TABLE, the indices defined
+// in the columns like UNIQUE are built too. the columns of info except skip are defined before them,
+// so the generated columns can refer to them, and they're not returned
+func buildColumns(info *model.TableInfo, name *ast.TableName, defs []*ast.ColumnDef, skip string) (*model.TableInfo, error) {
+	var cols []*ast.ColumnDef
+	for _, col := range info.Columns {
+		if col.Name.L != strings.ToLower(skip) {
+			cols = append(cols, &ast.ColumnDef{Name: &ast.ColumnName{Name: col.Name}, Tp: col.FieldType.Clone()})
+		}
+	}
+	existing := len(cols)
+
+	built, err := ddl.BuildTableInfoFromAST(&ast.CreateTableStmt{Table: name, Cols: append(cols, defs...)})
+	if err != nil {
+		return nil, errors.Annotatef(err, "build columns of %s failed", name.Name.O)
+	}
+	built.Columns = built.Columns[existing:]
+	return built, nil
+}
+
+func addColumns(info *model.TableInfo, name *ast.TableName, defs []*ast.ColumnDef, pos *ast.ColumnPosition) error {
+	built, err := buildColumns(info, name, defs, "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if built.PKIsHandle {
+		return errors.NotSupportedf("add column with primary key to %s", info.Name.O)
+	}
+
+	for _, col := range built.Columns {
+		if findColumn(info, col.Name.O) >= 0 {
+			return errors.AlreadyExistsf("column %s", col.Name.O)
+		}
+		offset, err := columnOffset(info, pos, len(info.Columns))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		info.MaxColumnID++
+		col.ID = info.MaxColumnID
+		insertColumn(info, offset, col)
+	}
+	for _, index := range built.Indices {
+		var keys []*ast.IndexColName
+		for _, col := range index.Columns {
+			keys = append(keys, &ast.IndexColName{Column: &ast.ColumnName{Name: col.Name}, Length: col.Length})
+		}
+		if err := addIndex(info, "", keys, index.Unique, index.Primary); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// changeColumn replaces the column named oldName with the column definition, the column is renamed in the indices too
+func changeColumn(info *model.TableInfo, name *ast.TableName, oldName string, def *ast.ColumnDef, pos *ast.ColumnPosition) error {
+	i := findColumn(info, oldName)
+	if i < 0 {
+		return errors.NotFoundf("column %s", oldName)
+	}
+	old := info.Columns[i]
+	built, err := buildColumns(info, name, []*ast.ColumnDef{def}, oldName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	col := built.Columns[0]
+	if j := findColumn(info, col.Name.O); j >= 0 && j != i {
+		return errors.AlreadyExistsf("column %s", col.Name.O)
+	}
+	col.ID = old.ID
+	if info.PKIsHandle && mysql.HasPriKeyFlag(old.Flag) {
+		col.Flag |= mysql.PriKeyFlag | mysql.NotNullFlag
+	}
+
+	info.Columns = append(info.Columns[:i], info.Columns[i+1:]...)
+	offset, err := columnOffset(info, pos, i)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	insertColumn(info, offset, col)
+	for _, index := range info.Indices {
+		for _, ic := range index.Columns {
+			if ic.Name.L == old.Name.L {
+				ic.Name = col.Name
+			}
+		}
+	}
+	fixOffsets(info)
+	return nil
+}
+
+// dropColumn removes the column, and removes it from the indices like MySQL, the index without columns is dropped
+func dropColumn(info *model.TableInfo, name string) error {
+	i := findColumn(info, name)
+	if i < 0 {
+		return errors.NotFoundf("column %s", name)
+	}
+	col := info.Columns[i]
+	if info.PKIsHandle && mysql.HasPriKeyFlag(col.Flag) {
+		info.PKIsHandle = false
+	}
+	info.Columns = append(info.Columns[:i], info.Columns[i+1:]...)
+
+	indices := info.Indices[:0]
+	for _, index := range info.Indices {
+		columns := index.Columns[:0]
+		for _, ic := range index.Columns {
+			if ic.Name.L != col.Name.L {
+				columns = append(columns, ic)
+			}
+		}
+		if index.Columns = columns; len(columns) != 0 {
+			indices = append(indices, index)
+		}
+	}
+	info.Indices = indices
+	fixOffsets(info)
+	return nil
+}
+
+// columnOffset returns the offset of the column at pos, the column is at offset if pos is not specified
+func columnOffset(info *model.TableInfo, pos *ast.ColumnPosition, offset int) (int, error) {
+	if pos == nil {
+		return offset, nil
+	}
+	switch pos.Tp {
+	case ast.ColumnPositionFirst:
+		return 0, nil
+	case ast.ColumnPositionAfter:
+		i := findColumn(info, pos.RelativeColumn.Name.O)
+		if i < 0 {
+			return 0, errors.NotFoundf("column %s", pos.RelativeColumn.Name.O)
+		}
+		return i + 1, nil
+	}
+	return offset, nil
+}
+
+func insertColumn(info *model.TableInfo, offset int, col *model.ColumnInfo) {
+	col.State = model.StatePublic
+	info.Columns = append(info.Columns, nil)
+	copy(info.Columns[offset+1:], info.Columns[offset:])
+	info.Columns[offset] = col
+	fixOffsets(info)
+}
+
+// fixOffsets sets the offsets of the columns and the index columns after the columns are changed
+func fixOffsets(info *model.TableInfo) {
+	for i, col := range info.Columns {
+		col.Offset = i
+	}
+	for _, index := range info.Indices {
+		for _, ic := range index.Columns {
+			ic.Offset = findColumn(info, ic.Name.O)
+		}
+	}
+}
+
+// addIndex adds an index like TiDB, the index without name is named by its first column
+func addIndex(info *model.TableInfo, name string, keys []*ast.IndexColName, unique, primary bool) error {
+	if primary {
+		if info.PKIsHandle {
+			return errors.AlreadyExistsf("primary key of %s", info.Name.O)
+		}
+		name = mysql.PrimaryKeyName
+	} else if name == "" {
+		name = keys[0].Column.Name.O
+		for i := 2; findIndex(info, name) != nil; i++ {
+			name = fmt.Sprintf("%s_%d", keys[0].Column.Name.O, i)
+		}
+	}
+	if findIndex(info, name) != nil {
+		return errors.AlreadyExistsf("index %s", name)
+	}
+
+	index := &model.IndexInfo{
+		Name:    model.NewCIStr(name),
+		Table:   info.Name,
+		Unique:  unique,
+		Primary: primary,
+		State:   model.StatePublic,
+		Tp:      model.IndexTypeBtree,
+	}
+	for _, key := range keys {
+		i := findColumn(info, key.Column.Name.O)
+		if i < 0 {
+			return errors.NotFoundf("column %s", key.Column.Name.O)
+		}
+		index.Columns = append(index.Columns, &model.IndexColumn{Name: info.Columns[i].Name, Offset: i, Length: key.Length})
+	}
+	info.MaxIndexID++
+	index.ID = info.MaxIndexID
+	info.Indices = append(info.Indices, index)
+	return nil
+}
+
+func dropIndex(info *model.TableInfo, name string) error {
+	for i, index := range info.Indices {
+		if index.Name.L == strings.ToLower(name) {
+			info.Indices = append(info.Indices[:i], info.Indices[i+1:]...)
+			return nil
+		}
+	}
+	return errors.NotFoundf("index %s", name)
+}
+
+// dropPrimaryKey drops the primary key, it's the handle column or an index
+func dropPrimaryKey(info *model.TableInfo) error {
+	if info.PKIsHandle {
+		info.PKIsHandle = false
+		for _, col := range info.Columns {
+			col.Flag &^= mysql.PriKeyFlag
+		}
+		return nil
+	}
+	return errors.Trace(dropIndex(info, mysql.PrimaryKeyName))
+}
+
+func renameIndex(info *model.TableInfo, from, to string) error {
+	index := findIndex(info, from)
+	if index == nil {
+		return errors.NotFoundf("index %s", from)
+	}
+	if other := findIndex(info, to); other != nil && other != index {
+		return errors.AlreadyExistsf("index %s", to)
+	}
+	index.Name = model.NewCIStr(to)
+	return nil
+}
+
+// newTableInfo returns the (non-generated) columns and the unique keys of the table like information_schema,
+// the handle column is the first key like information_schema.statistics, and then the primary key is put at first
+func newTableInfo(schema, table string, info *model.TableInfo) *tableInfo {
+	ti := &tableInfo{schema: schema, table: table}
+	for _, col := range info.Columns {
+		if !col.IsGenerated() {
+			ti.columns = append(ti.columns, col.Name.O)
+		}
+	}
+
+	if info.PKIsHandle {
+		for _, col := range info.Columns {
+			if mysql.HasPriKeyFlag(col.Flag) {
+				ti.uniqueKeys = append(ti.uniqueKeys, indexInfo{name: mysql.PrimaryKeyName, columns: []string{col.Name.O}})
+			}
+		}
+	}
+	for _, index := range info.Indices {
+		if !index.Primary && !index.Unique {
+			continue
+		}
+		columns := make([]string, 0, len(index.Columns))
+		for _, col := range index.Columns {
+			columns = append(columns, col.Name.O)
+		}
+		ti.uniqueKeys = append(ti.uniqueKeys, indexInfo{name: index.Name.O, columns: columns})
+	}
+	ti.setPrimaryKey()
+	return ti
+}
+
+// showCreateTable returns the CREATE TABLE statement of the table like SHOW CREATE TABLE of TiDB
+func showCreateTable(info *model.TableInfo) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CREATE TABLE %s (\n", quoteName(info.Name.O))
+	defs := make([]string, 0, len(info.Columns)+len(info.Indices)+1)
+	for _, col := range info.Columns {
+		defs = append(defs, "  "+showColumn(col))
+	}
+	for _, col := range info.Columns {
+		if info.PKIsHandle && mysql.HasPriKeyFlag(col.Flag) {
+			defs = append(defs, fmt.Sprintf("  PRIMARY KEY (%s)", quoteName(col.Name.O)))
+		}
+	}
+	for _, index := range info.Indices {
+		cols := make([]string, 0, len(index.Columns))
+		for _, ic := range index.Columns {
+			col := quoteName(ic.Name.O)
+			if ic.Length != types.UnspecifiedLength {
+				col = fmt.Sprintf("%s(%d)", col, ic.Length)
+			}
+			cols = append(cols, col)
+		}
+		switch {
+		case index.Primary:
+			defs = append(defs, fmt.Sprintf("  PRIMARY KEY (%s)", strings.Join(cols, ",")))
+		case index.Unique:
+			defs = append(defs, fmt.Sprintf("  UNIQUE KEY %s (%s)", quoteName(index.Name.O), strings.Join(cols, ",")))
+		default:
+			defs = append(defs, fmt.Sprintf("  KEY %s (%s)", quoteName(index.Name.O), strings.Join(cols, ",")))
+		}
+	}
+	buf.WriteString(strings.Join(defs, ",\n"))
+	buf.WriteString("\n) ENGINE=InnoDB")
+	if info.Charset != "" {
+		fmt.Fprintf(&buf, " DEFAULT CHARSET=%s", info.Charset)
+	}
+	if info.Collate != "" {
+		fmt.Fprintf(&buf, " COLLATE=%s", info.Collate)
+	}
+	if info.Comment != "" {
+		fmt.Fprintf(&buf, " COMMENT='%s'", format.OutputFormat(info.Comment))
+	}
+	return buf.String()
+}
+
+// showColumn returns the definition of the column in SHOW CREATE TABLE
+func showColumn(col *model.ColumnInfo) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s", quoteName(col.Name.O), table.ToColumn(col).GetTypeDesc())
+	if col.IsGenerated() {
+		fmt.Fprintf(&buf, " GENERATED ALWAYS AS (%s)", col.GeneratedExprString)
+		if col.GeneratedStored {
+			buf.WriteString(" STORED")
+		} else {
+			buf.WriteString(" VIRTUAL")
+		}
+	}
+	if mysql.HasAutoIncrementFlag(col.Flag) {
+		buf.WriteString(" NOT NULL AUTO_INCREMENT")
+	} else {
+		if mysql.HasNotNullFlag(col.Flag) {
+			buf.WriteString(" NOT NULL")
+		}
+		if !mysql.HasNoDefaultValueFlag(col.Flag) && !col.IsGenerated() {
+			switch value := col.GetDefaultValue(); value {
+			case nil:
+				if !mysql.HasNotNullFlag(col.Flag) {
+					buf.WriteString(" DEFAULT NULL")
+				}
+			case "CURRENT_TIMESTAMP":
+				buf.WriteString(" DEFAULT CURRENT_TIMESTAMP")
+			default:
+				fmt.Fprintf(&buf, " DEFAULT '%s'", format.OutputFormat(fmt.Sprintf("%v", value)))
+			}
+		}
+		if mysql.HasOnUpdateNowFlag(col.Flag) {
+			buf.WriteString(" ON UPDATE CURRENT_TIMESTAMP")
+		}
+	}
+	if col.Comment != "" {
+		fmt.Fprintf(&buf, " COMMENT '%s'", format.OutputFormat(col.Comment))
+	}
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+package pitr
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSchemaTracker(t *testing.T) {
+	tracker, err := newSchemaTracker()
+	assert.Assert(t, err == nil)
+
+	ddls := []string{
+		"create database test1",
+		"use test1; create table t1 (id int primary key, a int, b int as (a + 1), c varchar(10), unique key uk_c (c))",
+		"create table test1.t2 (a int, b int, c int, primary key (a, b), unique key (c))",
+		"use test1; alter table t1 add column d int first, add column e int after a",
+		"use test1; alter table t1 add unique index uk_de (d, e)",
+		"use test1; alter table t1 change column d dd bigint",
+		"use test1; create unique index uk_a on t1 (a)",
+		"use test1; drop index uk_c on t1",
+		"use test1; alter table t2 drop column c",
+		"use test1; rename table t2 to t3",
+		"create table test.t4 like test1.t1",
+	}
+	for _, ddl := range ddls {
+		assert.Assert(t, tracker.executeDDL(ddl) == nil, ddl)
+	}
+
+	info, err := tracker.tableInfo("test1", "t1")
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, trackedJSON(t, info), `{"schema":"test1","table":"t1","columns":["dd","id","a","e","c"],"has-primary-key":true,`+
+		`"unique-keys":[{"name":"PRIMARY","columns":["id"]},{"name":"uk_de","columns":["dd","e"]},{"name":"uk_a","columns":["a"]}]}`)
+
+	_, err = tracker.tableInfo("test1", "t2")
+	assert.Equal(t, err, ErrTableNotExist)
+	info, err = tracker.tableInfo("test1", "T3")
+	assert.Assert(t, err == nil, err)
+	assert.Equal(t, trackedJSON(t, info), `{"schema":"test1","table":"T3","columns":["a","b"],"has-primary-key":true,`+
+		`"unique-keys":[{"name":"PRIMARY","columns":["a","b"]}]}`)
+
+	// the dumped schema creates the same tables
+	dumped, err := newSchemaTracker()
+	assert.Assert(t, err == nil)
+	for _, ddl := range tracker.dumpSchema() {
+		assert.Assert(t, dumped.executeDDL(ddl) == nil, ddl)
+	}
+	assert.DeepEqual(t, dumped.databases(), []string{"test", "test1"})
+	for _, name := range []string{"t1", "t3"} {
+		expected, _ := tracker.tableInfo("test1", name)
+		info, err := dumped.tableInfo("test1", name)
+		assert.Assert(t, err == nil, err)
+		assert.Equal(t, trackedJSON(t, info), trackedJSON(t, expected))
+	}
+
+	assert.ErrorContains(t, tracker.executeDDL("create database test1"), "already exists")
+	assert.ErrorContains(t, tracker.executeDDL("create table t5 (a int)"), "no database selected")
+	assert.Assert(t, tracker.executeDDL("drop database test1") == nil)
+	_, err = tracker.tableInfo("test1", "t1")
+	assert.Equal(t, err, ErrTableNotExist)
+	info, err = tracker.tableInfo("test", "t4")
+	assert.Assert(t, err == nil, err)
+	assert.DeepEqual(t, info.columns, []string{"dd", "id", "a", "e", "c"})
+}
+
+func trackedJSON(t *testing.T, info *tableInfo) string {
+	data, err := json.Marshal(info)
+	assert.Assert(t, err == nil)
+	return string(data)
+}
@@ -0,0 +1,68 @@
+package pitr
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tb "github.com/pingcap/tipb/go-binlog"
+)
+
+const (
+	// outputFormatBinlog saves the merged binlogs as binlog files, which can be read by reparo
+	outputFormatBinlog = "binlog"
+	// outputFormatSQL saves the merged binlogs as sql files
+	outputFormatSQL = "sql"
+	// outputFormatCSV saves the final row images as csv files
+	outputFormatCSV = "csv"
+	// outputFormatColumnar saves the final row images as csv files of every column
+	outputFormatColumnar = "columnar"
+)
+
+// sink saves the merged binlogs of a temp sub directory, every reduce worker uses its own sink.
+// the dml binlogs are written after merged, the deletes are before the inserts and updates.
+type sink interface {
+	// write saves the binlog, and returns the size written
+	write(binlog *pb.Binlog) (int64, error)
+	close() error
+}
+
+// newSink creates the sink of the format in dir, getTableInfo returns the table info at the commit ts of the binlog
+func newSink(format, dir string, maxFileSize int64, getTableInfo func(schema, table string, commitTS int64) (*tableInfo, error)) (sink, error) {
+	switch format {
+	case outputFormatBinlog:
+		return newBinlogSink(dir)
+	case outputFormatSQL:
+		return newSQLSink(dir, maxFileSize, getTableInfo)
+	case outputFormatCSV, outputFormatColumnar:
+		return newExportSink(dir, format == outputFormatColumnar, maxFileSize, getTableInfo)
+	default:
+		return nil, errors.Errorf("unknown output format %s", format)
+	}
+}
+
+// binlogSink saves the binlogs as binlog files
+type binlogSink struct {
+	binlogger binlogfile.Binlogger
+}
+
+func newBinlogSink(dir string) (*binlogSink, error) {
+	binlogger, err := binlogfile.OpenBinlogger(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &binlogSink{binlogger: binlogger}, nil
+}
+
+func (s *binlogSink) write(binlog *pb.Binlog) (int64, error) {
+	data, err := binlog.Marshal()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	_, err = s.binlogger.WriteTail(&tb.Entity{Payload: data})
+	return int64(len(data)), errors.Trace(err)
+}
+
+func (s *binlogSink) close() error {
+	return errors.Trace(s.binlogger.Close())
+}
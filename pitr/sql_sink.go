@@ -0,0 +1,370 @@
+package pitr
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// sqlSink saves the binlogs as sql files named like test_t1-000000.sql in dir,
+// a new file is created when the file's size exceeds maxFileSize, and the file is created when it's written.
+// the inserts and updates are saved as INSERT ... ON DUPLICATE KEY UPDATE,
+// and the deletes are saved as DELETE ... WHERE pk IN (...) if the table has primary key or unique key.
+type sqlSink struct {
+	dir         string
+	maxFileSize int64
+
+	getTableInfo func(schema, table string, commitTS int64) (*tableInfo, error)
+
+	seq  int
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newSQLSink(dir string, maxFileSize int64, getTableInfo func(schema, table string, commitTS int64) (*tableInfo, error)) (*sqlSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &sqlSink{
+		dir:          dir,
+		maxFileSize:  maxFileSize,
+		getTableInfo: getTableInfo,
+	}, nil
+}
+
+func (s *sqlSink) openFile() error {
+	name := path.Join(s.dir, fmt.Sprintf("%s-%06d.sql", path.Base(s.dir), s.seq))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.size = 0
+	return nil
+}
+
+func (s *sqlSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	defer func() { s.file = nil }()
+
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return errors.Trace(err)
+	}
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.file.Close())
+}
+
+func (s *sqlSink) write(binlog *pb.Binlog) (int64, error) {
+	var stmts []string
+	if binlog.Tp == pb.BinlogType_DDL {
+		stmts = []string{strings.TrimRight(string(binlog.DdlQuery), "; \t\n") + ";"}
+	} else {
+		var err error
+		stmts, err = s.genDMLStmts(binlog.DmlData.GetEvents(), binlog.CommitTs)
+		if err != nil {
+			return 0, errors.Annotatef(err, "generate sqls of binlog with commit ts %d failed", binlog.CommitTs)
+		}
+	}
+	if len(stmts) == 0 {
+		return 0, nil
+	}
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	var size int64
+	n, err := fmt.Fprintf(s.w, "-- commit-ts: %d\n", binlog.CommitTs)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	size += int64(n)
+	for _, stmt := range stmts {
+		n, err := fmt.Fprintln(s.w, stmt)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		size += int64(n)
+	}
+
+	s.size += size
+	if s.size >= s.maxFileSize {
+		if err := s.closeFile(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		s.seq++
+	}
+	return size, nil
+}
+
+func (s *sqlSink) close() error {
+	return errors.Trace(s.closeFile())
+}
+
+// sqlRow is the rendered values of an event
+type sqlRow struct {
+	tp     pb.EventType
+	info   *tableInfo
+	names  []string
+	values []string
+	// null is true if the column's value is NULL
+	null []bool
+}
+
+// genDMLStmts returns the statements of the events, the adjacent events with the same table and type are in one statement
+func (s *sqlSink) genDMLStmts(events []pb.Event, commitTS int64) ([]string, error) {
+	var (
+		stmts []string
+		group []*sqlRow
+	)
+	for i := range events {
+		row, err := s.renderEvent(&events[i], commitTS)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(group) != 0 && !sameSQLGroup(group[0], row) {
+			stmts = append(stmts, genGroupStmts(group)...)
+			group = nil
+		}
+		group = append(group, row)
+	}
+	if len(group) != 0 {
+		stmts = append(stmts, genGroupStmts(group)...)
+	}
+	return stmts, nil
+}
+
+// renderEvent renders the values of the event with the table info at commit ts, the new values are used for update
+func (s *sqlSink) renderEvent(ev *pb.Event, commitTS int64) (*sqlRow, error) {
+	info, err := s.getTableInfo(ev.GetSchemaName(), ev.GetTableName(), commitTS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	row := &sqlRow{tp: ev.GetTp(), info: info}
+	for _, c := range ev.GetRow() {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !containsString(info.columns, col.Name) {
+			continue
+		}
+
+		data := col.Value
+		if ev.GetTp() == pb.EventType_Update {
+			data = col.ChangedValue
+		}
+		value, err := formatSQLValue(col, data)
+		if err != nil {
+			return nil, errors.Annotatef(err, "format value of column %s failed", col.Name)
+		}
+		row.names = append(row.names, col.Name)
+		row.values = append(row.values, value)
+		row.null = append(row.null, value == "NULL")
+	}
+	return row, nil
+}
+
+// sameSQLGroup returns true if the rows can be in one statement
+func sameSQLGroup(a, b *sqlRow) bool {
+	isDelete := func(r *sqlRow) bool { return r.tp == pb.EventType_Delete }
+	if a.info != b.info || isDelete(a) != isDelete(b) {
+		return false
+	}
+	return isDelete(a) || strings.Join(a.names, ",") == strings.Join(b.names, ",")
+}
+
+func genGroupStmts(group []*sqlRow) []string {
+	if group[0].tp == pb.EventType_Delete {
+		return genDeleteStmts(group)
+	}
+	return []string{genUpsertStmt(group)}
+}
+
+// genUpsertStmt returns INSERT INTO t (a, b) VALUES (1, 2), (3, 4) ON DUPLICATE KEY UPDATE a = VALUES(a), b = VALUES(b)
+func genUpsertStmt(group []*sqlRow) string {
+	first := group[0]
+	values := make([]string, 0, len(group))
+	for _, row := range group {
+		values = append(values, "("+strings.Join(row.values, ", ")+")")
+	}
+	updates := make([]string, 0, len(first.names))
+	for _, name := range first.names {
+		updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quoteName(name), quoteName(name)))
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE %s;",
+		quoteSchema(first.info.schema, first.info.table), quoteNames(first.names), strings.Join(values, ", "), strings.Join(updates, ", "))
+}
+
+// genDeleteStmts returns DELETE FROM t WHERE pk IN (...) for the rows located by the first unique key,
+// the other rows are deleted one by one, like the rows with null value in the key or the table has no unique key
+func genDeleteStmts(group []*sqlRow) []string {
+	info := group[0].info
+	var keyColumns []string
+	if len(info.uniqueKeys) != 0 {
+		keyColumns = info.uniqueKeys[0].columns
+	}
+
+	var (
+		stmts []string
+		keys  []string
+	)
+	for _, row := range group {
+		valueOf := make(map[string]string, len(row.names))
+		nullOf := make(map[string]bool, len(row.names))
+		for i, name := range row.names {
+			valueOf[name] = row.values[i]
+			nullOf[name] = row.null[i]
+		}
+
+		hasNull := len(keyColumns) == 0
+		keyValues := make([]string, 0, len(keyColumns))
+		for _, col := range keyColumns {
+			if nullOf[col] {
+				hasNull = true
+				break
+			}
+			keyValues = append(keyValues, valueOf[col])
+		}
+		if !hasNull {
+			if len(keyValues) == 1 {
+				keys = append(keys, keyValues[0])
+			} else {
+				keys = append(keys, "("+strings.Join(keyValues, ", ")+")")
+			}
+			continue
+		}
+
+		conds := make([]string, 0, len(row.names))
+		for _, name := range row.names {
+			if nullOf[name] {
+				conds = append(conds, quoteName(name)+" IS NULL")
+			} else {
+				conds = append(conds, quoteName(name)+" = "+valueOf[name])
+			}
+		}
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1;", quoteSchema(info.schema, info.table), strings.Join(conds, " AND ")))
+	}
+
+	if len(keys) != 0 {
+		keyNames := quoteNames(keyColumns)
+		if len(keyColumns) > 1 {
+			keyNames = "(" + keyNames + ")"
+		}
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s);", quoteSchema(info.schema, info.table), keyNames, strings.Join(keys, ", ")))
+	}
+	return stmts
+}
+
+// formatSQLValue renders the encoded value of the column as a sql literal:
+// the decimals and numbers are not quoted, the enums and sets are their index numbers,
+// the bits are like b'101', the binary strings and blobs are in hex like X'0102',
+// and the time and json are quoted strings.
+func formatSQLValue(col *pb.Column, data []byte) (string, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if val.IsNull() {
+		return "NULL", nil
+	}
+
+	tp := col.Tp[0]
+	switch tp {
+	case mysql.TypeEnum, mysql.TypeSet:
+		val = formatValue(val, tp)
+	case mysql.TypeBit:
+		switch v := val.GetValue().(type) {
+		case uint64:
+			return fmt.Sprintf("b'%b'", v), nil
+		case int64:
+			return fmt.Sprintf("b'%b'", uint64(v)), nil
+		}
+	}
+
+	switch v := val.GetValue().(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case *types.MyDecimal:
+		return v.String(), nil
+	case types.BinaryLiteral:
+		return "X'" + hex.EncodeToString(v) + "'", nil
+	case string:
+		if tp == mysql.TypeDecimal || tp == mysql.TypeNewDecimal {
+			return v, nil
+		}
+		return quoteSQLString(v), nil
+	case []byte:
+		if isBinaryType(col.MysqlType) || !utf8.Valid(v) {
+			return "X'" + hex.EncodeToString(v) + "'", nil
+		}
+		if tp == mysql.TypeDecimal || tp == mysql.TypeNewDecimal {
+			return string(v), nil
+		}
+		return quoteSQLString(string(v)), nil
+	default:
+		return quoteSQLString(fmt.Sprintf("%v", v)), nil
+	}
+}
+
+// isBinaryType returns true if the mysql type is binary string or blob, like varbinary(10) and mediumblob
+func isBinaryType(mysqlType string) bool {
+	return strings.Contains(mysqlType, "binary") || strings.Contains(mysqlType, "blob")
+}
+
+// quoteSQLString quotes the string with single quotes, and escapes the special characters like mysql_real_escape_string
+func quoteSQLString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\x1a':
+			b.WriteString(`\Z`)
+		case '\'':
+			b.WriteString(`\'`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+func encodeDatum(t *testing.T, v interface{}) []byte {
+	data, err := codec.EncodeValue(&stmtctx.StatementContext{}, nil, types.NewDatum(v))
+	assert.Assert(t, err == nil)
+	return data
+}
+
+func TestFormatSQLValue(t *testing.T) {
+	for _, c := range []struct {
+		tp        byte
+		mysqlType string
+		value     interface{}
+		expected  string
+	}{
+		{mysql.TypeLong, "int", nil, "NULL"},
+		{mysql.TypeLong, "int", int64(-1), "-1"},
+		{mysql.TypeLonglong, "bigint", uint64(18446744073709551615), "18446744073709551615"},
+		{mysql.TypeDouble, "double", 1.5, "1.5"},
+		{mysql.TypeNewDecimal, "decimal", "12.340", "12.340"},
+		{mysql.TypeDatetime, "datetime", "2019-10-01 12:00:00.123", "'2019-10-01 12:00:00.123'"},
+		{mysql.TypeDuration, "time", "-12:00:00", "'-12:00:00'"},
+		{mysql.TypeEnum, "enum", uint64(2), "2"},
+		{mysql.TypeSet, "set", uint64(5), "5"},
+		{mysql.TypeBit, "bit", uint64(5), "b'101'"},
+		{mysql.TypeJSON, "json", `{"a": "it's"}`, `'{\"a\": \"it\'s\"}'`},
+		{mysql.TypeVarchar, "varchar", []byte("a'b\nc\\"), `'a\'b\nc\\'`},
+		{mysql.TypeVarchar, "varbinary", []byte("ab"), "X'6162'"},
+		{mysql.TypeBlob, "blob", []byte{0, 0xff}, "X'00ff'"},
+		{mysql.TypeString, "char", []byte{0xff}, "X'ff'"},
+	} {
+		col := &pb.Column{Tp: []byte{c.tp}, MysqlType: c.mysqlType}
+		value, err := formatSQLValue(col, encodeDatum(t, c.value))
+		assert.Assert(t, err == nil, err)
+		assert.Equal(t, value, c.expected, "type %s", c.mysqlType)
+	}
+}
+
+func TestSQLSink(t *testing.T) {
+	dir := "./sqlsinktest/test_tbq"
+	os.RemoveAll("./sqlsinktest")
+	defer os.RemoveAll("./sqlsinktest")
+
+	info := &tableInfo{
+		schema:     "test",
+		table:      "tbq",
+		columns:    []string{"a", "b", "c"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"a"}}},
+	}
+	noKeyInfo := &tableInfo{schema: "test", table: "tbn", columns: []string{"a", "b", "c"}}
+	s, err := newSQLSink(dir, 200, func(schema, table string, commitTS int64) (*tableInfo, error) {
+		if table == "tbn" {
+			return noKeyInfo, nil
+		}
+		return info, nil
+	})
+	assert.Assert(t, err == nil)
+
+	// the deletes are before the inserts and updates after merged
+	dml := genTestRowDML("test", "tbq", pb.EventType_Delete, []int64{1, 2}, 200)
+	dml.DmlData.Events = append(dml.DmlData.Events, genTestRowDML("test", "tbq", pb.EventType_Insert, []int64{3}, 200).DmlData.Events...)
+	schema, table := "test", "tbq"
+	dml.DmlData.Events = append(dml.DmlData.Events, pb.Event{
+		Tp: pb.EventType_Update, SchemaName: &schema, TableName: &table, Row: generateRow(4, 4, 4, 5),
+	})
+	dml.DmlData.Events = append(dml.DmlData.Events, genTestRowDML("test", "tbn", pb.EventType_Delete, []int64{6}, 200).DmlData.Events...)
+	for _, bin := range []*pb.Binlog{
+		genTestDDL("test", "tbq", "use test;create table tbq (a int primary key, b int, c int);", 100),
+		dml,
+		genTestDDL("test", "tbq", "alter table test.tbq add column d int", 300),
+	} {
+		_, err = s.write(bin)
+		assert.Assert(t, err == nil, err)
+	}
+	err = s.close()
+	assert.Assert(t, err == nil)
+
+	// the file is rotated after the dml binlog
+	data, err := ioutil.ReadFile(dir + "/test_tbq-000000.sql")
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(data), "-- commit-ts: 100\n"+
+		"use test;create table tbq (a int primary key, b int, c int);\n"+
+		"-- commit-ts: 200\n"+
+		"DELETE FROM `test`.`tbq` WHERE `a` IN (1, 2);\n"+
+		"INSERT INTO `test`.`tbq` (`a`, `b`, `c`) VALUES (3, 3, 3), (4, 4, 5) ON DUPLICATE KEY UPDATE `a` = VALUES(`a`), `b` = VALUES(`b`), `c` = VALUES(`c`);\n"+
+		"DELETE FROM `test`.`tbn` WHERE `a` = 6 AND `b` = 6 AND `c` = 6 LIMIT 1;\n")
+	data, err = ioutil.ReadFile(dir + "/test_tbq-000001.sql")
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(data), "-- commit-ts: 300\nalter table test.tbq add column d int;\n")
+}
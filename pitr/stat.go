@@ -0,0 +1,363 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// Stat prints the summaries of every table in the binlogs, and estimates the size after compact.
+// the keys of the rows are got from the table info in the mock tidb, and all of them are kept in memory.
+type Stat struct {
+	cfg *Config
+
+	filter *filter.Filter
+
+	ddlHandle *DDLHandle
+
+	out io.Writer
+}
+
+// tableStat is the summary of a table, the database level ddls are counted in the table with empty name
+type tableStat struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+
+	Inserts int64 `json:"inserts"`
+	Updates int64 `json:"updates"`
+	Deletes int64 `json:"deletes"`
+	DDLs    int64 `json:"ddls"`
+
+	// Keys is the number of distinct primary keys or unique keys changed by the events
+	Keys int64 `json:"keys"`
+	// Bytes is the size of the events and ddls in the binlogs
+	Bytes int64 `json:"bytes"`
+	// OutputBytes is the estimated size after merge, it's the real size in the summary of compact
+	OutputBytes int64 `json:"output-bytes"`
+
+	// keys is the state of every key after the events, it's nil if the keys are not tracked
+	keys map[string]*keyStat
+}
+
+// keyStat is the state of a key, used to estimate the event after merge
+type keyStat struct {
+	// existed means the key exists before the first event
+	existed bool
+	// exists means the key exists after the last event
+	exists bool
+	// size is the size of the last event of the key
+	size int64
+}
+
+// Ratio returns output bytes / bytes
+func (s *tableStat) Ratio() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return float64(s.OutputBytes) / float64(s.Bytes)
+}
+
+// MarshalJSON adds the ratio to the json
+func (s *tableStat) MarshalJSON() ([]byte, error) {
+	type stat tableStat
+	return json.Marshal(struct {
+		*stat
+		Ratio float64 `json:"ratio"`
+	}{(*stat)(s), s.Ratio()})
+}
+
+// addKey records the event of the key, existed is used only if it's the first event of the key
+func (s *tableStat) addKey(key string, existed, exists bool, size int64) {
+	ks, ok := s.keys[key]
+	if !ok {
+		ks = &keyStat{existed: existed}
+		s.keys[key] = ks
+	}
+	ks.exists = exists
+	ks.size = size
+}
+
+// statCollector collects the summaries of the tables, it's safe to be used concurrently
+type statCollector struct {
+	sync.Mutex
+
+	tables map[string]*tableStat
+
+	// trackKeys means the keys of every event are saved to calculate keys and output bytes
+	trackKeys bool
+}
+
+func newStatCollector(trackKeys bool) *statCollector {
+	return &statCollector{
+		tables:    make(map[string]*tableStat),
+		trackKeys: trackKeys,
+	}
+}
+
+func (c *statCollector) getTable(schema, table string) *tableStat {
+	name := quoteSchema(schema, table)
+	ts, ok := c.tables[name]
+	if !ok {
+		ts = &tableStat{Schema: schema, Table: table}
+		if c.trackKeys {
+			ts.keys = make(map[string]*keyStat)
+		}
+		c.tables[name] = ts
+	}
+	return ts
+}
+
+// addDDL counts the ddl binlog of the table, the ddls are always output after merge
+func (c *statCollector) addDDL(schema, table string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	ts := c.getTable(schema, table)
+	ts.DDLs++
+	ts.Bytes += size
+	if c.trackKeys {
+		ts.OutputBytes += size
+	}
+}
+
+// addDML counts the event of the table, the keys are got like the reduce
+func (c *statCollector) addDML(ev *pb.Event, info *tableInfo) error {
+	c.Lock()
+	defer c.Unlock()
+
+	ts := c.getTable(ev.GetSchemaName(), ev.GetTableName())
+	size := int64(ev.Size())
+	ts.Bytes += size
+	switch ev.GetTp() {
+	case pb.EventType_Insert:
+		ts.Inserts++
+	case pb.EventType_Update:
+		ts.Updates++
+	case pb.EventType_Delete:
+		ts.Deletes++
+	}
+	if !c.trackKeys {
+		return nil
+	}
+
+	switch ev.GetTp() {
+	case pb.EventType_Insert, pb.EventType_Delete:
+		key, _, err := getInsertAndDeleteRowKey(ev.GetRow(), info)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		insert := ev.GetTp() == pb.EventType_Insert
+		ts.addKey(key, !insert, insert, size)
+	case pb.EventType_Update:
+		key, cKey, _, err := getUpdateRowKey(ev.GetRow(), info)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if key == cKey {
+			ts.addKey(key, true, true, size)
+			break
+		}
+		// the update which changes the key is split into a delete and an insert, both have half of the values
+		ts.addKey(key, true, false, size/2)
+		ts.addKey(cKey, false, true, size/2)
+	}
+	return nil
+}
+
+// addOutput adds the real keys and size after merge, used by compact which doesn't track the keys
+func (c *statCollector) addOutput(schema, table string, keys, bytes int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	ts := c.getTable(schema, table)
+	ts.Keys += keys
+	ts.OutputBytes += bytes
+}
+
+// stats returns the summaries sorted by the table name, the keys and output bytes are calculated if the keys are tracked
+func (c *statCollector) stats() []*tableStat {
+	c.Lock()
+	defer c.Unlock()
+
+	names := make([]string, 0, len(c.tables))
+	for name := range c.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats := make([]*tableStat, 0, len(names))
+	for _, name := range names {
+		ts := c.tables[name]
+		if ts.keys != nil {
+			ts.Keys = int64(len(ts.keys))
+			for _, ks := range ts.keys {
+				// the key inserted and then deleted is not output
+				if ks.existed || ks.exists {
+					ts.OutputBytes += ks.size
+				}
+			}
+			ts.keys = nil
+		}
+		stats = append(stats, ts)
+	}
+	return stats
+}
+
+// NewStat creates a Stat object, the summaries are printed to stdout.
+func NewStat(cfg *Config) (*Stat, error) {
+	log.Info("New Stat", zap.Stringer("config", cfg))
+
+	return &Stat{
+		cfg:    cfg,
+		filter: filter.NewFilter(cfg.IgnoreDBs, cfg.IgnoreTables, cfg.DoDBs, cfg.DoTables),
+		out:    os.Stdout,
+	}, nil
+}
+
+// Process counts the events of the binlogs with commit ts in [start ts, stop ts], and prints them
+func (s *Stat) Process() error {
+	if err := checkManifest(s.cfg.Dir); err != nil {
+		return errors.Trace(err)
+	}
+
+	dirs, err := searchBinlogDirs(s.cfg.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	files, err := searchFiles(dirs[0])
+	if err != nil {
+		return errors.Annotate(err, "searchFiles failed")
+	}
+	firstBinlogTs, _, err := getFirstBinlogCommitTSAndFileSize(files[0])
+	if err != nil {
+		return errors.Annotate(err, "get first binlog commit ts failed")
+	}
+
+	ddls, err := loadHistoryDDLJobs(s.cfg, firstBinlogTs)
+	if err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+
+	var tidbDir string
+	if s.cfg.CheckSchema {
+		if tidbDir, err = prepareDir(s.cfg.TiDBDir, "pitr_tidb", true, false); err != nil {
+			return errors.Annotate(err, "prepare tidb dir failed")
+		}
+	}
+	s.ddlHandle, err = NewDDLHandle(ddls, tidbDir, s.cfg.TiDBPort)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	stats, err := s.stat(dirs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if s.cfg.StatConfig.Format == "json" {
+		return errors.Trace(printJSONTableStats(s.out, stats))
+	}
+	return errors.Trace(printTableStats(s.out, stats))
+}
+
+// stat reads the binlogs in dirs and returns the summaries, the ddls before start ts are only executed
+func (s *Stat) stat(dirs []string) ([]*tableStat, error) {
+	collector := newStatCollector(true)
+	err := readBinlogDirs(dirs, 0, s.cfg.StopTSO, func(binlog *pb.Binlog) error {
+		if binlog.Tp == pb.BinlogType_DDL {
+			// the ddl is counted for every table it's written to when compact
+			routes, err := routeDDL(binlog, s.ddlHandle)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := s.ddlHandle.ExecuteDDL(string(binlog.DdlQuery)); err != nil {
+				return errors.Annotatef(err, "execute ddl of commit ts %d failed", binlog.CommitTs)
+			}
+			if binlog.CommitTs < s.cfg.StartTSO {
+				return nil
+			}
+			for _, route := range routes {
+				if len(route.binlog.DdlQuery) != 0 && !s.filter.SkipSchemaAndTable(route.schema, route.table) {
+					collector.addDDL(route.schema, route.table, int64(binlog.Size()))
+				}
+			}
+			return nil
+		}
+
+		if binlog.CommitTs < s.cfg.StartTSO {
+			return nil
+		}
+		for _, ev := range binlog.DmlData.GetEvents() {
+			if s.filter.SkipSchemaAndTable(ev.GetSchemaName(), ev.GetTableName()) {
+				continue
+			}
+			info, err := s.ddlHandle.GetTableInfo(ev.GetSchemaName(), ev.GetTableName())
+			if err != nil {
+				return errors.Annotatef(err, "get table info of %s failed", quoteSchema(ev.GetSchemaName(), ev.GetTableName()))
+			}
+			if err := collector.addDML(&ev, info); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return collector.stats(), nil
+}
+
+// Close closes the Stat object.
+func (s *Stat) Close() error {
+	if s.ddlHandle != nil {
+		s.ddlHandle.Close()
+	}
+	return nil
+}
+
+// printTableStats prints the summaries as a table, with a total line at the end
+func printTableStats(out io.Writer, stats []*tableStat) error {
+	total := &tableStat{}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tINSERT\tUPDATE\tDELETE\tDDL\tKEYS\tBYTES\tOUTPUT BYTES\tRATIO")
+	for _, ts := range stats {
+		name := quoteSchema(ts.Schema, ts.Table)
+		if len(ts.Table) == 0 {
+			name = quoteName(ts.Schema)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.2f\n", name,
+			ts.Inserts, ts.Updates, ts.Deletes, ts.DDLs, ts.Keys, ts.Bytes, ts.OutputBytes, ts.Ratio())
+		total.Inserts += ts.Inserts
+		total.Updates += ts.Updates
+		total.Deletes += ts.Deletes
+		total.DDLs += ts.DDLs
+		total.Keys += ts.Keys
+		total.Bytes += ts.Bytes
+		total.OutputBytes += ts.OutputBytes
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.2f\n",
+		total.Inserts, total.Updates, total.Deletes, total.DDLs, total.Keys, total.Bytes, total.OutputBytes, total.Ratio())
+	return errors.Trace(w.Flush())
+}
+
+// printJSONTableStats prints the summaries as a json array
+func printJSONTableStats(out io.Writer, stats []*tableStat) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return errors.Trace(err)
+}
@@ -0,0 +1,285 @@
+package pitr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/goleveldb/leveldb"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+// keyEventStore saves the events which are not flushed by key, the events with the same key are merged in it
+type keyEventStore interface {
+	// get returns the event saved with key, the returned event should be put again after modified
+	get(key string) (*Event, bool, error)
+	put(key string, ev *Event) error
+	delete(key string) error
+
+	// iterate calls fn for every event in the order of key
+	iterate(fn func(key string, ev *Event) error) error
+
+	// len returns the number of events
+	len() int
+
+	// size returns the approximate memory used by the events
+	size() int64
+
+	close() error
+}
+
+// memKeyEventStore saves the events in memory
+type memKeyEventStore struct {
+	events map[string]*memEntry
+	bytes  int64
+}
+
+type memEntry struct {
+	ev   *Event
+	size int64
+}
+
+var _ keyEventStore = &memKeyEventStore{}
+
+func newMemKeyEventStore() *memKeyEventStore {
+	return &memKeyEventStore{
+		events: make(map[string]*memEntry),
+	}
+}
+
+func (s *memKeyEventStore) get(key string) (*Event, bool, error) {
+	entry, ok := s.events[key]
+	if !ok {
+		return nil, false, nil
+	}
+	return entry.ev, true, nil
+}
+
+func (s *memKeyEventStore) put(key string, ev *Event) error {
+	if entry, ok := s.events[key]; ok {
+		s.bytes -= entry.size
+	}
+	entry := &memEntry{ev: ev, size: eventSize(key, ev)}
+	s.events[key] = entry
+	s.bytes += entry.size
+	return nil
+}
+
+func (s *memKeyEventStore) delete(key string) error {
+	if entry, ok := s.events[key]; ok {
+		s.bytes -= entry.size
+		delete(s.events, key)
+	}
+	return nil
+}
+
+func (s *memKeyEventStore) iterate(fn func(key string, ev *Event) error) error {
+	keys := make([]string, 0, len(s.events))
+	for key := range s.events {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key, s.events[key].ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memKeyEventStore) len() int {
+	return len(s.events)
+}
+
+func (s *memKeyEventStore) size() int64 {
+	return s.bytes
+}
+
+func (s *memKeyEventStore) close() error {
+	s.events = nil
+	s.bytes = 0
+	return nil
+}
+
+// eventSize returns the approximate memory used by the event
+func eventSize(key string, ev *Event) int64 {
+	size := int64(len(key) + len(ev.schema) + len(ev.table) + len(ev.oldKey) + len(ev.newKey))
+	for _, col := range ev.cols {
+		size += int64(col.Size())
+	}
+	return size
+}
+
+// diskKeyEventStore saves the events in a leveldb on disk, used when the events can't be saved in memory
+type diskKeyEventStore struct {
+	dir string
+	db  *leveldb.DB
+
+	count int
+	bytes int64
+}
+
+var _ keyEventStore = &diskKeyEventStore{}
+
+// newDiskKeyEventStore creates a leveldb in dir, the data already in dir is removed
+func newDiskKeyEventStore(dir string) (*diskKeyEventStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "open leveldb %s failed", dir)
+	}
+
+	return &diskKeyEventStore{
+		dir: dir,
+		db:  db,
+	}, nil
+}
+
+func (s *diskKeyEventStore) get(key string) (*Event, bool, error) {
+	data, err := s.db.Get([]byte(key), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil, false, nil
+		}
+		return nil, false, errors.Trace(err)
+	}
+
+	ev, err := decodeEvent(data)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	return ev, true, nil
+}
+
+func (s *diskKeyEventStore) put(key string, ev *Event) error {
+	if err := s.delete(key); err != nil {
+		return errors.Trace(err)
+	}
+
+	data, err := encodeEvent(ev)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := s.db.Put([]byte(key), data, nil); err != nil {
+		return errors.Trace(err)
+	}
+	s.count++
+	s.bytes += int64(len(key) + len(data))
+	return nil
+}
+
+func (s *diskKeyEventStore) delete(key string) error {
+	data, err := s.db.Get([]byte(key), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+
+	if err := s.db.Delete([]byte(key), nil); err != nil {
+		return errors.Trace(err)
+	}
+	s.count--
+	s.bytes -= int64(len(key) + len(data))
+	return nil
+}
+
+func (s *diskKeyEventStore) iterate(fn func(key string, ev *Event) error) error {
+	// the keys in leveldb are sorted by bytes, same as sort.Strings
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		ev, err := decodeEvent(iter.Value())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := fn(string(iter.Key()), ev); err != nil {
+			return err
+		}
+	}
+	return errors.Trace(iter.Error())
+}
+
+func (s *diskKeyEventStore) len() int {
+	return s.count
+}
+
+func (s *diskKeyEventStore) size() int64 {
+	return s.bytes
+}
+
+func (s *diskKeyEventStore) close() error {
+	if err := s.db.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.RemoveAll(s.dir))
+}
+
+// storedEvent is the Event saved on disk
+type storedEvent struct {
+	Schema    string
+	Table     string
+	EventType pb.EventType
+	OldKey    string
+	NewKey    string
+	Cols      [][]byte
+	IsDeleted bool
+}
+
+func encodeEvent(ev *Event) ([]byte, error) {
+	se := &storedEvent{
+		Schema:    ev.schema,
+		Table:     ev.table,
+		EventType: ev.eventType,
+		OldKey:    ev.oldKey,
+		NewKey:    ev.newKey,
+		Cols:      make([][]byte, 0, len(ev.cols)),
+		IsDeleted: ev.isDeleted,
+	}
+	for _, col := range ev.cols {
+		data, err := col.Marshal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		se.Cols = append(se.Cols, data)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(se); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEvent(data []byte) (*Event, error) {
+	se := &storedEvent{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(se); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ev := &Event{
+		schema:    se.Schema,
+		table:     se.Table,
+		eventType: se.EventType,
+		oldKey:    se.OldKey,
+		newKey:    se.NewKey,
+		cols:      make([]*pb.Column, 0, len(se.Cols)),
+		isDeleted: se.IsDeleted,
+	}
+	for _, data := range se.Cols {
+		col := &pb.Column{}
+		if err := col.Unmarshal(data); err != nil {
+			return nil, errors.Trace(err)
+		}
+		ev.cols = append(ev.cols, col)
+	}
+	return ev, nil
+}
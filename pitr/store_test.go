@@ -0,0 +1,65 @@
+package pitr
+
+import (
+	"os"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestKeyEventStore(t *testing.T) {
+	dir := "./test_store"
+	os.RemoveAll(dir)
+
+	disk, err := newDiskKeyEventStore(dir)
+	assert.Assert(t, err == nil)
+	stores := []keyEventStore{newMemKeyEventStore(), disk}
+
+	cols := generateColumns()
+	for _, s := range stores {
+		for _, key := range []string{"c", "a", "b"} {
+			col := &pb.Column{}
+			err := col.Unmarshal(cols[0])
+			assert.Assert(t, err == nil)
+			err = s.put(key, &Event{schema: "test", table: "tb1", eventType: pb.EventType_Insert, oldKey: key, cols: []*pb.Column{col}})
+			assert.Assert(t, err == nil)
+		}
+
+		// the event got should be put again after modified
+		ev, ok, err := s.get("a")
+		assert.Assert(t, err == nil && ok)
+		ev.eventType = pb.EventType_Update
+		ev.cols[0].ChangedValue = encodeIntValue(10)
+		err = s.put("a", ev)
+		assert.Assert(t, err == nil)
+
+		err = s.delete("b")
+		assert.Assert(t, err == nil)
+		_, ok, err = s.get("b")
+		assert.Assert(t, err == nil && !ok)
+		assert.Equal(t, s.len(), 2)
+		assert.Assert(t, s.size() > 0)
+
+		var keys []string
+		err = s.iterate(func(key string, ev *Event) error {
+			keys = append(keys, key)
+			if key == "a" {
+				assert.Equal(t, ev.eventType, pb.EventType_Update)
+				assert.DeepEqual(t, ev.cols[0].ChangedValue, encodeIntValue(10))
+			} else {
+				assert.Equal(t, ev.eventType, pb.EventType_Insert)
+			}
+			assert.Equal(t, ev.oldKey, key)
+			return nil
+		})
+		assert.Assert(t, err == nil)
+		assert.DeepEqual(t, keys, []string{"a", "c"})
+
+		err = s.close()
+		assert.Assert(t, err == nil)
+	}
+
+	_, err = os.Stat(dir)
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,169 @@
+package pitr
+
+import (
+	"container/heap"
+	"io"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// streamReader is one directory in the k-way merge, next is the binlog not returned yet
+type streamReader struct {
+	index  int
+	reader *dirPbReader
+	next   *pb.Binlog
+}
+
+// streamHeap returns the reader with the smallest commit ts, the readers of the database level directories
+// are in front of the tables' with the same commit ts
+type streamHeap []*streamReader
+
+func (h streamHeap) Len() int { return len(h) }
+
+func (h streamHeap) Less(i, j int) bool {
+	if h[i].next.CommitTs != h[j].next.CommitTs {
+		return h[i].next.CommitTs < h[j].next.CommitTs
+	}
+	return h[i].index < h[j].index
+}
+
+func (h streamHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *streamHeap) Push(x interface{}) { *h = append(*h, x.(*streamReader)) }
+
+func (h *streamHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// streamPbReader reads the binlogs in several directories in the order of commit ts,
+// the binlogs in every directory should be in order, like the output directories of compact
+type streamPbReader struct {
+	dirs []string
+	h    streamHeap
+}
+
+var _ PbReader = &streamPbReader{}
+
+// newStreamPbReader opens the directories to read the binlogs with commit ts in [startTS, endTS],
+// the database level directories should be in front of dirs
+func newStreamPbReader(dirs []string, startTS int64, endTS int64) (*streamPbReader, error) {
+	r := &streamPbReader{dirs: dirs, h: make(streamHeap, 0, len(dirs))}
+	for i, dir := range dirs {
+		files, err := searchFiles(dir)
+		if err != nil {
+			r.close()
+			return nil, errors.Trace(err)
+		}
+		reader, err := newFilesPbReader(files, startTS, endTS)
+		if err != nil {
+			r.close()
+			return nil, errors.Trace(err)
+		}
+		s := &streamReader{index: i, reader: reader}
+		ok, err := r.readNext(s)
+		if err != nil {
+			reader.close()
+			r.close()
+			return nil, errors.Trace(err)
+		}
+		if ok {
+			r.h = append(r.h, s)
+		}
+	}
+	heap.Init(&r.h)
+	return r, nil
+}
+
+// readNext reads the next binlog of the directory, returns false if there is no binlog
+func (r *streamPbReader) readNext(s *streamReader) (bool, error) {
+	binlog, err := s.reader.read()
+	if err != nil {
+		if errors.Cause(err) == io.EOF {
+			s.reader.close()
+			return false, nil
+		}
+		return false, errors.Annotatef(err, "read dir %s failed", r.dirs[s.index])
+	}
+	s.next = binlog
+	return true, nil
+}
+
+func (r *streamPbReader) read() (*pb.Binlog, error) {
+	if r.h.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	s := r.h[0]
+	binlog := s.next
+	ok, err := r.readNext(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if ok {
+		heap.Fix(&r.h, 0)
+	} else {
+		heap.Pop(&r.h)
+	}
+	return binlog, nil
+}
+
+func (r *streamPbReader) close() {
+	for _, s := range r.h {
+		s.reader.close()
+	}
+	r.h = nil
+}
+
+// mergeStreams merges the binlogs of the reduced directories into out in the order of commit ts,
+// the database level directories should be in front of dirs.
+func mergeStreams(dirs []string, out sink) (int64, error) {
+	reader, err := newStreamPbReader(dirs, 0, 0)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer reader.close()
+
+	var count int64
+	err = readAll(reader, func(binlog *pb.Binlog) error {
+		_, err := out.write(binlog)
+		count++
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	log.Info("merge streams success", zap.Strings("dirs", dirs), zap.Int64("binlogs", count))
+	return count, nil
+}
+
+// readBinlogStream calls fn for every binlog with commit ts in [startTS, endTS] in the directories in the order of commit ts,
+// so the ddls of a table are replayed before the binlogs of the other tables after them, like a rename to another table
+func readBinlogStream(dirs []string, startTS int64, endTS int64, fn func(binlog *pb.Binlog) error) error {
+	reader, err := newStreamPbReader(sortStreamDirs(dirs), startTS, endTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer reader.close()
+	return errors.Trace(readAll(reader, fn))
+}
+
+// sortStreamDirs puts the database level directories like schema1_ in front of the tables'
+func sortStreamDirs(dirs []string) []string {
+	var dbDirs, tableDirs []string
+	for _, dir := range dirs {
+		if strings.HasSuffix(dir, "_") {
+			dbDirs = append(dbDirs, dir)
+		} else {
+			tableDirs = append(tableDirs, dir)
+		}
+	}
+	return append(dbDirs, tableDirs...)
+}
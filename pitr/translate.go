@@ -0,0 +1,168 @@
+package pitr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// rowValues is the decoded values of a row, the values are formatted to be used as sql args
+type rowValues struct {
+	names   []string
+	values  []interface{}
+	changed []interface{}
+}
+
+// decodeRow decodes the columns in row, the generated columns which are not in the table info are ignored,
+// the changed values are only decoded for update
+func decodeRow(row [][]byte, info *tableInfo, update bool) (*rowValues, error) {
+	rv := &rowValues{
+		names:  make([]string, 0, len(row)),
+		values: make([]interface{}, 0, len(row)),
+	}
+	for _, c := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !containsString(info.columns, col.Name) {
+			continue
+		}
+
+		_, val, err := codec.DecodeOne(col.Value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		val = formatValue(val, col.Tp[0])
+		rv.names = append(rv.names, col.Name)
+		rv.values = append(rv.values, val.GetValue())
+
+		if !update {
+			continue
+		}
+		_, cVal, err := codec.DecodeOne(col.ChangedValue)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cVal = formatValue(cVal, col.Tp[0])
+		rv.changed = append(rv.changed, cVal.GetValue())
+	}
+
+	return rv, nil
+}
+
+// dmlSQL is a sql and its args
+type dmlSQL struct {
+	sql  string
+	args []interface{}
+}
+
+// genDMLSQL returns the sql and args to replay the event on the table,
+// the row is located by the primary key or unique key, or all the columns if the table has no one
+func genDMLSQL(ev *pb.Event, info *tableInfo) (string, []interface{}, error) {
+	rv, err := decodeRow(ev.GetRow(), info, ev.GetTp() == pb.EventType_Update)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	return genRowSQL(ev.GetTp(), info, rv)
+}
+
+// genRowSQL returns the sql and args of the decoded row
+func genRowSQL(tp pb.EventType, info *tableInfo, rv *rowValues) (string, []interface{}, error) {
+	switch tp {
+	case pb.EventType_Insert:
+		sql := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", quoteSchema(info.schema, info.table), quoteNames(rv.names), holderString(len(rv.names)))
+		return sql, rv.values, nil
+	case pb.EventType_Update:
+		var sets []string
+		for _, name := range rv.names {
+			sets = append(sets, quoteName(name)+" = ?")
+		}
+		where, whereArgs := genWhere(info, rv.names, rv.values)
+		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s LIMIT 1", quoteSchema(info.schema, info.table), strings.Join(sets, ", "), where)
+		return sql, append(rv.changed, whereArgs...), nil
+	case pb.EventType_Delete:
+		sql, args := genDeleteSQL(info, rv.names, rv.values)
+		return sql, args, nil
+	default:
+		return "", nil, errors.Errorf("unknown event type %v", tp)
+	}
+}
+
+// genSafeRowSQLs returns the idempotent sqls of the decoded row, the insert is changed to REPLACE,
+// and the update is changed to a DELETE of the old row and a REPLACE of the new row
+func genSafeRowSQLs(tp pb.EventType, info *tableInfo, rv *rowValues) ([]*dmlSQL, error) {
+	switch tp {
+	case pb.EventType_Insert:
+		return []*dmlSQL{genReplaceSQL(info, rv.names, rv.values)}, nil
+	case pb.EventType_Update:
+		sql, args := genDeleteSQL(info, rv.names, rv.values)
+		return []*dmlSQL{{sql: sql, args: args}, genReplaceSQL(info, rv.names, rv.changed)}, nil
+	case pb.EventType_Delete:
+		sql, args := genDeleteSQL(info, rv.names, rv.values)
+		return []*dmlSQL{{sql: sql, args: args}}, nil
+	default:
+		return nil, errors.Errorf("unknown event type %v", tp)
+	}
+}
+
+func genReplaceSQL(info *tableInfo, names []string, values []interface{}) *dmlSQL {
+	sql := fmt.Sprintf("REPLACE INTO %s(%s) VALUES(%s)", quoteSchema(info.schema, info.table), quoteNames(names), holderString(len(names)))
+	return &dmlSQL{sql: sql, args: values}
+}
+
+func genDeleteSQL(info *tableInfo, names []string, values []interface{}) (string, []interface{}) {
+	where, args := genWhere(info, names, values)
+	return fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1", quoteSchema(info.schema, info.table), where), args
+}
+
+// genWhere returns the condition to locate the row, the first unique key without null value is used if any
+func genWhere(info *tableInfo, names []string, values []interface{}) (string, []interface{}) {
+	valueOf := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		valueOf[name] = values[i]
+	}
+
+	columns := names
+	for _, key := range info.uniqueKeys {
+		hasNull := false
+		for _, col := range key.columns {
+			if valueOf[col] == nil {
+				hasNull = true
+				break
+			}
+		}
+		if !hasNull {
+			columns = key.columns
+			break
+		}
+	}
+
+	conds := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for _, col := range columns {
+		if valueOf[col] == nil {
+			conds = append(conds, quoteName(col)+" IS NULL")
+			continue
+		}
+		conds = append(conds, quoteName(col)+" = ?")
+		args = append(args, valueOf[col])
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func quoteNames(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteName(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// holderString returns n placeholders like "?, ?, ?"
+func holderString(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
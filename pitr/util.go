@@ -3,8 +3,14 @@ package pitr
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path"
 	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
 )
 
 // copy file
@@ -44,3 +50,136 @@ func quoteName(name string) string {
 func escapeName(name string) string {
 	return strings.Replace(name, "`", "``", -1)
 }
+
+// pitrDirMark is the file created in the directories made by pitr, --overwrite refuses to remove a directory without it
+const pitrDirMark = ".pitr"
+
+// prepareDir makes sure the directory exists and can be used, and returns the directory's path.
+// if dir is empty, a new unique directory named by pattern is created in the os temp directory.
+// if dir already exists, it's cleaned when overwrite is true and it's made by pitr, reused when resume is true,
+// otherwise an error is returned.
+func prepareDir(dir, pattern string, overwrite, resume bool) (string, error) {
+	if dir == "" {
+		dir, err := ioutil.TempDir("", pattern)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		return dir, errors.Trace(markPITRDir(dir))
+	}
+
+	_, err := os.Stat(dir)
+	if err == nil {
+		switch {
+		case overwrite:
+			isPITR, err := isPITRDir(dir)
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			if !isPITR {
+				return "", errors.Errorf("directory %s is not made by pitr, remove it manually or use another directory", dir)
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				return "", errors.Trace(err)
+			}
+		case resume:
+			return dir, nil
+		default:
+			return "", errors.Errorf("directory %s already exists, use --overwrite or --resume", dir)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", errors.Trace(err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Trace(err)
+	}
+	return dir, errors.Trace(markPITRDir(dir))
+}
+
+// markPITRDir creates the mark file in dir, so it can be removed by --overwrite later
+func markPITRDir(dir string) error {
+	return errors.Trace(ioutil.WriteFile(path.Join(dir, pitrDirMark), nil, 0600))
+}
+
+// isPITRDir returns whether dir is empty or made by pitr, the directories made by the earlier versions
+// have no mark file, but they have the manifest or checkpoint
+func isPITRDir(dir string) (bool, error) {
+	names, err := binlogfile.ReadDir(dir)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if len(names) == 0 {
+		return true, nil
+	}
+	for _, name := range names {
+		if name == pitrDirMark || name == manifestFileName || name == checkpointFileName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getFreePort asks the kernel for a free port
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// readSubDirs returns the sorted names of all the sub directories in dir, the hidden directories are ignored
+func readSubDirs(dir string) ([]string, error) {
+	names, err := binlogfile.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	subDirs := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		fi, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if fi.IsDir() {
+			subDirs = append(subDirs, name)
+		}
+	}
+
+	return subDirs, nil
+}
+
+// readPartitions returns the sorted paths like "schema_table/dml_0" of all the partitions in the temp dir
+func readPartitions(tempDir string) ([]string, error) {
+	tableDirs, err := readSubDirs(tempDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var partitions []string
+	for _, tableDir := range tableDirs {
+		subDirs, err := readSubDirs(path.Join(tempDir, tableDir))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, subDir := range subDirs {
+			partitions = append(partitions, path.Join(tableDir, subDir))
+		}
+	}
+
+	return partitions, nil
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
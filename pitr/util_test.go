@@ -0,0 +1,68 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestPrepareDir(t *testing.T) {
+	dir := "./test_prepare_dir"
+	os.RemoveAll(dir)
+
+	// create the dir if not exist
+	d, err := prepareDir(dir, "", false, false)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, d, dir)
+	err = ioutil.WriteFile(path.Join(dir, "f"), []byte("pitr"), 0600)
+	assert.Assert(t, err == nil)
+
+	// the dir already exists
+	_, err = prepareDir(dir, "", false, false)
+	assert.Assert(t, err != nil)
+
+	// reuse the dir
+	_, err = prepareDir(dir, "", false, true)
+	assert.Assert(t, err == nil)
+	_, err = os.Stat(path.Join(dir, "f"))
+	assert.Assert(t, err == nil)
+
+	// clean the dir
+	_, err = prepareDir(dir, "", true, false)
+	assert.Assert(t, err == nil)
+	_, err = os.Stat(path.Join(dir, "f"))
+	assert.Assert(t, os.IsNotExist(err))
+	os.RemoveAll(dir)
+
+	// the dir not made by pitr can't be cleaned unless it's empty
+	err = os.Mkdir(dir, 0700)
+	assert.Assert(t, err == nil)
+	_, err = prepareDir(dir, "", true, false)
+	assert.Assert(t, err == nil, err)
+	os.Remove(path.Join(dir, pitrDirMark))
+	err = ioutil.WriteFile(path.Join(dir, "f"), []byte("pitr"), 0600)
+	assert.Assert(t, err == nil)
+	_, err = prepareDir(dir, "", true, false)
+	assert.ErrorContains(t, err, "is not made by pitr")
+	_, err = os.Stat(path.Join(dir, "f"))
+	assert.Assert(t, err == nil)
+	os.RemoveAll(dir)
+
+	// generate unique dirs
+	d1, err := prepareDir("", "pitr_test", false, false)
+	assert.Assert(t, err == nil)
+	d2, err := prepareDir("", "pitr_test", false, false)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, d1 != d2)
+	os.RemoveAll(d1)
+	os.RemoveAll(d2)
+}
+
+func TestGetFreePort(t *testing.T) {
+	port, err := getFreePort()
+	assert.Assert(t, err == nil)
+	assert.Assert(t, port > 0)
+}
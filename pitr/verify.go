@@ -0,0 +1,431 @@
+package pitr
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// maxReportedKeys limits the number of differing keys reported for one table
+const maxReportedKeys = 10
+
+var (
+	// ErrVerifyFailed means the data replayed from the merged binlogs is different from the original binlogs
+	ErrVerifyFailed = errors.New("verify failed, the merged binlogs are different from the original binlogs")
+)
+
+// Verifier replays the original binlogs and the merged binlogs, and compares the data of every table.
+// the mock tidb can only run once in a process, so the binlogs are replayed one after another,
+// the checksums of the original data are saved in memory before the mock tidb is reset.
+type Verifier struct {
+	cfg *Config
+
+	filter *filter.Filter
+
+	ddlHandle *DDLHandle
+
+	replayer *replayer
+}
+
+// TableDiff describes a table whose data are different after replaying
+type TableDiff struct {
+	Schema string
+	Table  string
+
+	OriginalRows      int
+	MergedRows        int
+	OriginalChecksum  uint32
+	MergedChecksum    uint32
+	OriginalNotExists bool
+	MergedNotExists   bool
+
+	// Keys is the first differing keys, and why they are different
+	Keys []KeyDiff
+}
+
+// KeyDiff describes a row which is different after replaying
+type KeyDiff struct {
+	Key    string
+	Reason string
+}
+
+// tableChecksum is the checksum of the rows in a table, the rows are sorted by key and row hash
+type tableChecksum struct {
+	schema   string
+	table    string
+	checksum uint32
+	rows     []rowDigest
+}
+
+type rowDigest struct {
+	key  string
+	hash uint32
+}
+
+// NewVerifier creates a Verifier object.
+func NewVerifier(cfg *Config) (*Verifier, error) {
+	log.Info("New Verifier", zap.Stringer("config", cfg))
+
+	return &Verifier{
+		cfg:    cfg,
+		filter: filter.NewFilter(cfg.IgnoreDBs, cfg.IgnoreTables, cfg.DoDBs, cfg.DoTables),
+	}, nil
+}
+
+// Process replays the binlogs in data dir and merged dir, and returns ErrVerifyFailed if any table is different
+func (v *Verifier) Process() error {
+	files, err := searchFiles(v.cfg.Dir)
+	if err != nil {
+		return errors.Annotate(err, "searchFiles failed")
+	}
+
+	// the binlogs before start ts are read too, the ddls in them are needed to build the tables
+	files, _, err = filterFiles(files, 0, v.cfg.StopTSO)
+	if err != nil {
+		return errors.Annotate(err, "filterFiles failed")
+	}
+	if len(files) == 0 {
+		return errors.Errorf("no binlog file found in %s", v.cfg.Dir)
+	}
+
+	firstBinlogTs, _, err := getFirstBinlogCommitTSAndFileSize(files[0])
+	if err != nil {
+		return errors.Annotate(err, "get first binlog commit ts failed")
+	}
+
+	ddls, err := loadHistoryDDLJobs(v.cfg, firstBinlogTs)
+	if err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+
+	tidbDir, err := prepareDir(v.cfg.TiDBDir, "pitr_tidb", true, false)
+	if err != nil {
+		return errors.Annotate(err, "prepare tidb dir failed")
+	}
+	v.ddlHandle, err = NewDDLHandle(ddls, tidbDir, v.cfg.TiDBPort)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	diffs, err := v.verify(files, ddls)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(diffs) == 0 {
+		log.Info("verify success, the merged binlogs are same with the original binlogs")
+		return nil
+	}
+
+	for _, diff := range diffs {
+		log.Error("table is different",
+			zap.String("table", quoteSchema(diff.Schema, diff.Table)),
+			zap.Bool("original not exists", diff.OriginalNotExists),
+			zap.Bool("merged not exists", diff.MergedNotExists),
+			zap.Int("original rows", diff.OriginalRows),
+			zap.Int("merged rows", diff.MergedRows),
+			zap.Uint32("original checksum", diff.OriginalChecksum),
+			zap.Uint32("merged checksum", diff.MergedChecksum),
+			zap.Reflect("first differing keys", diff.Keys))
+	}
+	return errors.Annotatef(ErrVerifyFailed, "%d tables are different", len(diffs))
+}
+
+// Close closes the Verifier object.
+func (v *Verifier) Close() error {
+	if v.ddlHandle != nil {
+		v.ddlHandle.Close()
+	}
+	return nil
+}
+
+// verify replays the original binlog files and the merged binlogs in merged dir, and returns the different tables
+func (v *Verifier) verify(files []string, historyDDLs []*model.Job) ([]*TableDiff, error) {
+	v.replayer = newDDLHandleReplayer(v.ddlHandle, v.filter)
+	if err := v.replayHistoryDDLs(historyDDLs); err != nil {
+		return nil, errors.Annotate(err, "replay history ddls failed")
+	}
+	bootstrapDDLs, err := v.replayOriginal(files)
+	if err != nil {
+		return nil, errors.Annotate(err, "replay original binlogs failed")
+	}
+	original, err := v.checksumTables()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := v.ddlHandle.ResetDB(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := v.replayHistoryDDLs(historyDDLs); err != nil {
+		return nil, errors.Annotate(err, "replay history ddls failed")
+	}
+	for _, ddl := range bootstrapDDLs {
+		if err := v.ddlHandle.ExecuteDDL(ddl); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err := v.replayMerged(); err != nil {
+		return nil, errors.Annotate(err, "replay merged binlogs failed")
+	}
+	merged, err := v.checksumTables()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := v.ddlHandle.ResetDB(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return compareChecksums(original, merged), nil
+}
+
+// replayHistoryDDLs executes the queries of the history ddl jobs, so the tables exist before replaying binlogs
+func (v *Verifier) replayHistoryDDLs(jobs []*model.Job) error {
+	for _, query := range historyDDLQueries(jobs) {
+		if err := v.ddlHandle.ExecuteDDL(query); err != nil {
+			return errors.Annotatef(err, "execute history ddl %s failed", query)
+		}
+	}
+	return nil
+}
+
+// replayOriginal replays the binlogs in [start ts, stop ts] in files, and returns the ddls before start ts
+func (v *Verifier) replayOriginal(files []string) ([]string, error) {
+	reader, err := newFilesPbReader(files, 0, v.cfg.StopTSO)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader.close()
+
+	var bootstrapDDLs []string
+	for {
+		binlog, err := reader.read()
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return bootstrapDDLs, nil
+			}
+			return nil, errors.Trace(err)
+		}
+
+		if binlog.CommitTs < v.cfg.StartTSO {
+			if binlog.Tp == pb.BinlogType_DDL {
+				if err := v.ddlHandle.ExecuteDDL(string(binlog.DdlQuery)); err != nil {
+					return nil, errors.Trace(err)
+				}
+				bootstrapDDLs = append(bootstrapDDLs, string(binlog.DdlQuery))
+			}
+			continue
+		}
+
+		if err := v.replayer.replay(binlog); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replayMerged replays the merged binlogs in the order of commit ts, the database level directories are replayed first at the same commit ts
+func (v *Verifier) replayMerged() error {
+	if err := checkManifest(v.cfg.MergedDir); err != nil {
+		return errors.Trace(err)
+	}
+
+	dirs, err := searchBinlogDirs(v.cfg.MergedDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return readBinlogStream(dirs, 0, 0, v.replayer.replay)
+}
+
+// checksumTables returns the checksums of all the tables not skipped by filter, the key is the quoted table name
+func (v *Verifier) checksumTables() (map[string]*tableChecksum, error) {
+	schemas, err := v.ddlHandle.getAllDatabaseNames()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	checksums := make(map[string]*tableChecksum)
+	for _, schema := range schemas {
+		tables, err := v.ddlHandle.getAllTableNames(schema)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, table := range tables {
+			if v.filter.SkipSchemaAndTable(schema, table) {
+				continue
+			}
+			cs, err := checksumTable(v.ddlHandle.db, schema, table)
+			if err != nil {
+				return nil, errors.Annotatef(err, "checksum table %s failed", quoteSchema(schema, table))
+			}
+			checksums[quoteSchema(schema, table)] = cs
+		}
+	}
+	return checksums, nil
+}
+
+// checksumTable reads all the rows in the table, and calculates the digest of every row.
+// the key of a row is the values of the primary key or unique key, or all the columns if the table has no one.
+func checksumTable(db *sql.DB, schema, table string) (*tableChecksum, error) {
+	info, err := getTableInfo(db, schema, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	keyColumns := info.columns
+	if len(info.uniqueKeys) != 0 {
+		keyColumns = info.uniqueKeys[0].columns
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s", quoteSchema(schema, table)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var keyIdxs []int
+	for _, col := range keyColumns {
+		for i, name := range names {
+			if strings.EqualFold(name, col) {
+				keyIdxs = append(keyIdxs, i)
+				break
+			}
+		}
+	}
+
+	cs := &tableChecksum{schema: schema, table: table}
+	values := make([]sql.RawBytes, len(names))
+	dest := make([]interface{}, len(names))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		key := fmt.Sprintf("%s|%s|", schema, table)
+		for _, i := range keyIdxs {
+			key += fmt.Sprintf("%s|", formatRawValue(values[i]))
+		}
+		cs.rows = append(cs.rows, rowDigest{key: key, hash: hashRow(values)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sort.Slice(cs.rows, func(i, j int) bool {
+		if cs.rows[i].key != cs.rows[j].key {
+			return cs.rows[i].key < cs.rows[j].key
+		}
+		return cs.rows[i].hash < cs.rows[j].hash
+	})
+	h := crc32.NewIEEE()
+	var buf [4]byte
+	for _, row := range cs.rows {
+		h.Write([]byte(row.key))
+		binary.BigEndian.PutUint32(buf[:], row.hash)
+		h.Write(buf[:])
+	}
+	cs.checksum = h.Sum32()
+	return cs, nil
+}
+
+func formatRawValue(value sql.RawBytes) string {
+	if value == nil {
+		return "NULL"
+	}
+	return string(value)
+}
+
+// hashRow returns the crc32 of the values, every value is prefixed with its length, and null is different from empty
+func hashRow(values []sql.RawBytes) uint32 {
+	h := crc32.NewIEEE()
+	var buf [5]byte
+	for _, value := range values {
+		if value == nil {
+			buf[0] = 0
+		} else {
+			buf[0] = 1
+		}
+		binary.BigEndian.PutUint32(buf[1:], uint32(len(value)))
+		h.Write(buf[:])
+		h.Write(value)
+	}
+	return h.Sum32()
+}
+
+// compareChecksums returns the tables which are different in original and merged, sorted by the table name
+func compareChecksums(original, merged map[string]*tableChecksum) []*TableDiff {
+	var names []string
+	for name := range original {
+		names = append(names, name)
+	}
+	for name := range merged {
+		if _, ok := original[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []*TableDiff
+	for _, name := range names {
+		o, m := original[name], merged[name]
+		if o != nil && m != nil && o.checksum == m.checksum && len(o.rows) == len(m.rows) {
+			continue
+		}
+
+		diff := &TableDiff{}
+		if o == nil {
+			diff.Schema, diff.Table, diff.OriginalNotExists = m.schema, m.table, true
+			o = &tableChecksum{}
+		}
+		if m == nil {
+			diff.Schema, diff.Table, diff.MergedNotExists = o.schema, o.table, true
+			m = &tableChecksum{}
+		}
+		if diff.Schema == "" {
+			diff.Schema, diff.Table = o.schema, o.table
+		}
+		diff.OriginalRows, diff.OriginalChecksum = len(o.rows), o.checksum
+		diff.MergedRows, diff.MergedChecksum = len(m.rows), m.checksum
+		diff.Keys = compareRows(o.rows, m.rows)
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// compareRows returns the first differing keys of the sorted rows
+func compareRows(original, merged []rowDigest) []KeyDiff {
+	var keys []KeyDiff
+	i, j := 0, 0
+	for (i < len(original) || j < len(merged)) && len(keys) < maxReportedKeys {
+		switch {
+		case j >= len(merged) || (i < len(original) && original[i].key < merged[j].key):
+			keys = append(keys, KeyDiff{Key: original[i].key, Reason: "not exists in merged"})
+			i++
+		case i >= len(original) || original[i].key > merged[j].key:
+			keys = append(keys, KeyDiff{Key: merged[j].key, Reason: "not exists in original"})
+			j++
+		default:
+			if original[i].hash != merged[j].hash {
+				keys = append(keys, KeyDiff{Key: original[i].key, Reason: "values are different"})
+			}
+			i++
+			j++
+		}
+	}
+	return keys
+}